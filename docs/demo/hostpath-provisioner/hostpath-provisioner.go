@@ -35,14 +35,14 @@ import (
 )
 
 const (
-	resyncPeriod              = 15 * time.Second
-	provisionerName           = "example.com/hostpath"
-	exponentialBackOffOnError = false
-	failedRetryThreshold      = 5
-	leasePeriod               = leaderelection.DefaultLeaseDuration
-	retryPeriod               = leaderelection.DefaultRetryPeriod
-	renewDeadline             = leaderelection.DefaultRenewDeadline
-	termLimit                 = leaderelection.DefaultTermLimit
+	resyncPeriod         = 15 * time.Second
+	provisionerName      = "example.com/hostpath"
+	threadiness          = 2
+	failedRetryThreshold = 5
+	leasePeriod          = leaderelection.DefaultLeaseDuration
+	retryPeriod          = leaderelection.DefaultRetryPeriod
+	renewDeadline        = leaderelection.DefaultRenewDeadline
+	termLimit            = leaderelection.DefaultTermLimit
 )
 
 type hostPathProvisioner struct {
@@ -142,6 +142,6 @@ func main() {
 
 	// Start the provision controller which will dynamically provision hostPath
 	// PVs
-	pc := controller.NewProvisionController(clientset, resyncPeriod, provisionerName, hostPathProvisioner, serverVersion.GitVersion, exponentialBackOffOnError, failedRetryThreshold, leasePeriod, renewDeadline, retryPeriod, termLimit)
+	pc := controller.NewProvisionController(clientset, resyncPeriod, provisionerName, hostPathProvisioner, serverVersion.GitVersion, threadiness, failedRetryThreshold, leasePeriod, renewDeadline, retryPeriod, termLimit)
 	pc.Run(wait.NeverStop)
 }
@@ -20,11 +20,13 @@ import (
 	"fmt"
 	"os/exec"
 	"reflect"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/controller/metrics"
 	"github.com/kubernetes-incubator/external-storage/lib/leaderelection"
 	rl "github.com/kubernetes-incubator/external-storage/lib/leaderelection/resourcelock"
 	"k8s.io/client-go/kubernetes"
@@ -35,12 +37,15 @@ import (
 	"k8s.io/client-go/pkg/fields"
 	"k8s.io/client-go/pkg/runtime"
 	"k8s.io/client-go/pkg/types"
+	utilruntime "k8s.io/client-go/pkg/util/runtime"
 	"k8s.io/client-go/pkg/util/uuid"
+	"k8s.io/client-go/pkg/util/validation"
+	"k8s.io/client-go/pkg/util/wait"
 	"k8s.io/client-go/pkg/version"
 	"k8s.io/client-go/pkg/watch"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
-	"k8s.io/kubernetes/pkg/util/goroutinemap"
+	"k8s.io/kubernetes/pkg/util/workqueue"
 )
 
 // annClass annotation represents the storage class associated with a resource:
@@ -67,14 +72,34 @@ const createProvisionedPVRetryCount = 5
 // Interval between retries when we create a PV object for a provisioned volume.
 const createProvisionedPVInterval = 10 * time.Second
 
+// DefaultShutdownTimeout is how long the controller waits, once stopped, for
+// in-flight operations to finish before giving up on them.
+const DefaultShutdownTimeout = 20 * time.Second
+
+// ReclaimPolicyParameter is the StorageClass parameter that sets the reclaim
+// policy of the class's provisioned volumes, "Delete" (the default) or
+// "Retain". The controller consumes it: it is not passed to the Provisioner.
+const ReclaimPolicyParameter = "reclaimPolicy"
+
+// MountOptionsParameter is the StorageClass parameter that sets the comma
+// separated options, e.g. "hard,nfsvers=4.1,noatime", that the class's
+// provisioned volumes are mounted with. The controller consumes it: it is
+// validated & passed to the Provisioner as VolumeOptions.MountOptions instead.
+const MountOptionsParameter = "mountOptions"
+
+// AnnMountOptions is the annotation of a PV listing the comma separated options
+// kubelet mounts it with. If the PV a Provisioner returns doesn't have it, the
+// controller sets it to the VolumeOptions.MountOptions, if any.
+const AnnMountOptions = "volume.beta.kubernetes.io/mount-options"
+
 // ProvisionController is a controller that provisions PersistentVolumes for
 // PersistentVolumeClaims.
 type ProvisionController struct {
 	client kubernetes.Interface
 
 	// How often the controller relists PVCs, PVs, & storage classes. OnUpdate
-	// will be called even if nothing has changed, meaning failed operations may
-	// be retried on a PVC/PV every resyncPeriod regardless of whether it changed
+	// will be called even if nothing has changed, meaning PVCs/PVs are
+	// re-queued every resyncPeriod regardless of whether they changed
 	resyncPeriod time.Duration
 
 	// The name of the provisioner for which this controller dynamically
@@ -105,8 +130,14 @@ type ProvisionController struct {
 
 	eventRecorder record.EventRecorder
 
-	// Map of scheduled/running operations.
-	runningOperations goroutinemap.GoRoutineMap
+	// Rate-limited work queues of claim and volume keys to process. A key is
+	// never processed by more than one worker at a time and a failed key is
+	// re-queued with per-item exponential backoff.
+	claimQueue  workqueue.RateLimitingInterface
+	volumeQueue workqueue.RateLimitingInterface
+
+	// Number of workers processing each of claimQueue and volumeQueue
+	threadiness int
 
 	// Number of retries when we create a PV object for a provisioned volume.
 	createProvisionedPVRetryCount int
@@ -126,31 +157,80 @@ type ProvisionController struct {
 
 	mapMutex *sync.Mutex
 
-	// threshold for max number of retries on failure of provisioner
+	// Threshold for max number of times a claim is re-queued after a failure
+	// of the provisioner, after which it is dropped from the queue until it is
+	// next updated. Guarded by thresholdMutex, since it can be changed while
+	// the controller runs
 	failedRetryThreshold int
+	thresholdMutex       *sync.Mutex
+
+	// Map of the keys of the claims that exceeded failedRetryThreshold to the
+	// claims as they were then, so that resyncs don't retry them again until
+	// they change
+	failedClaims      map[string]*v1.PersistentVolumeClaim
+	failedClaimsMutex *sync.Mutex
 
-	// map of failed claims
-	failedClaimsStats map[types.UID]int
+	// The reclaim policy to set on all provisioned volumes regardless of their
+	// class's reclaimPolicy parameter, if non-empty
+	reclaimPolicy v1.PersistentVolumeReclaimPolicy
 
-	failedClaimsStatsMutex *sync.Mutex
+	// How long to wait, once stopped, for in-flight operations to finish
+	shutdownTimeout time.Duration
+
+	// The lock that controllers race for if only the leader of them is to run,
+	// in which case claims are provisioned without per-claim locks. Nil if all
+	// controllers run
+	leaderElectionLock rl.Interface
+
+	// Whether to only log what would be done instead of doing it
+	dryRun bool
 }
 
-// NewProvisionController creates a new provision controller
+// ReclaimPolicy overrides the reclaim policy of all provisioned volumes,
+// taking precedence over their StorageClass's reclaimPolicy parameter.
+func ReclaimPolicy(reclaimPolicy v1.PersistentVolumeReclaimPolicy) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if err := validateReclaimPolicy(reclaimPolicy); err != nil {
+			return err
+		}
+		c.reclaimPolicy = reclaimPolicy
+		return nil
+	}
+}
+
+// ShutdownTimeout sets how long Run waits, once stopped, for in-flight
+// Provision and Delete operations to finish. Defaults to
+// DefaultShutdownTimeout.
+func ShutdownTimeout(shutdownTimeout time.Duration) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		if shutdownTimeout < 0 {
+			return fmt.Errorf("shutdown timeout must not be negative")
+		}
+		c.shutdownTimeout = shutdownTimeout
+		return nil
+	}
+}
+
+// NewProvisionController creates a new provision controller. Optional
+// settings like ReclaimPolicy can be passed in as options.
 func NewProvisionController(
 	client kubernetes.Interface,
 	resyncPeriod time.Duration,
 	provisionerName string,
 	provisioner Provisioner,
 	serverGitVersion string,
-	exponentialBackOffOnError bool,
+	threadiness int,
 	failedRetryThreshold int,
 	leaseDuration time.Duration,
 	renewDeadline time.Duration,
 	retryPeriod time.Duration,
 	termLimit time.Duration,
+	options ...func(*ProvisionController) error,
 ) *ProvisionController {
 	identity := uuid.NewUUID()
 
+	metrics.Register()
+
 	broadcaster := record.NewBroadcaster()
 	broadcaster.StartRecordingToSink(&core_v1.EventSinkImpl{Interface: client.Core().Events(v1.NamespaceAll)})
 	var eventRecorder record.EventRecorder
@@ -172,7 +252,9 @@ func NewProvisionController(
 		provisioner:                   provisioner,
 		is1dot4:                       is1dot4,
 		eventRecorder:                 eventRecorder,
-		runningOperations:             goroutinemap.NewGoRoutineMap(exponentialBackOffOnError),
+		claimQueue:                    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "claims"),
+		volumeQueue:                   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "volumes"),
+		threadiness:                   threadiness,
 		createProvisionedPVRetryCount: createProvisionedPVRetryCount,
 		createProvisionedPVInterval:   createProvisionedPVInterval,
 		identity:                      identity,
@@ -182,9 +264,17 @@ func NewProvisionController(
 		termLimit:                     termLimit,
 		leaderElectors:                make(map[types.UID]*leaderelection.LeaderElector),
 		mapMutex:                      &sync.Mutex{},
-		failedClaimsStats:             make(map[types.UID]int),
 		failedRetryThreshold:          failedRetryThreshold,
-		failedClaimsStatsMutex:        &sync.Mutex{},
+		thresholdMutex:                &sync.Mutex{},
+		failedClaims:                  make(map[string]*v1.PersistentVolumeClaim),
+		failedClaimsMutex:             &sync.Mutex{},
+		shutdownTimeout:               DefaultShutdownTimeout,
+	}
+
+	for _, option := range options {
+		if err := option(controller); err != nil {
+			glog.Fatalf("Error processing controller options: %v", err)
+		}
 	}
 
 	controller.claimSource = &cache.ListWatch{
@@ -257,43 +347,451 @@ func NewProvisionController(
 	return controller
 }
 
-// Run starts all of this controller's control loops
+// LeaderElection makes controllers active/passive: of all the controllers given
+// a lock of the same type on the same object, only the elected leader runs,
+// while the others stand by to take over should it stop renewing its lease.
+// The leader provisions claims without racing for per-claim locks. lockType is
+// one of resourcelock.EndpointsResourceLock or
+// resourcelock.ConfigMapsResourceLock.
+func LeaderElection(lockType, namespace, name string) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		lock, err := rl.New(lockType, namespace, name, c.client, rl.ResourceLockConfig{
+			Identity:      string(c.identity),
+			EventRecorder: c.eventRecorder,
+		})
+		if err != nil {
+			return err
+		}
+		c.leaderElectionLock = lock
+		return nil
+	}
+}
+
+// DryRun makes the controller only log what it would do: which claims it would
+// provision volumes for & with what options, and which volumes it would
+// resize, snapshot or delete. It never calls the Provisioner, creates, updates
+// or deletes PVs, or writes leader election records, including those of the
+// LeaderElection option.
+func DryRun(dryRun bool) func(*ProvisionController) error {
+	return func(c *ProvisionController) error {
+		c.dryRun = dryRun
+		return nil
+	}
+}
+
+// SetFailedRetryThreshold sets the max number of times a claim is re-queued
+// after a failure of the provisioner. It can be called while the controller
+// runs, e.g. when the provisioner's configuration is reloaded, and applies to
+// the next failure.
+func (ctrl *ProvisionController) SetFailedRetryThreshold(failedRetryThreshold int) {
+	ctrl.thresholdMutex.Lock()
+	defer ctrl.thresholdMutex.Unlock()
+	ctrl.failedRetryThreshold = failedRetryThreshold
+}
+
+func (ctrl *ProvisionController) getFailedRetryThreshold() int {
+	ctrl.thresholdMutex.Lock()
+	defer ctrl.thresholdMutex.Unlock()
+	return ctrl.failedRetryThreshold
+}
+
+// Run starts all of this controller's control loops. If the controller was
+// created with the LeaderElection option, it first waits to be elected. Once
+// stopCh is closed it stops taking new work, waits for in-flight operations to
+// finish & releases the locks it holds before returning.
 func (ctrl *ProvisionController) Run(stopCh <-chan struct{}) {
+	if ctrl.leaderElectionLock == nil {
+		ctrl.run(stopCh)
+		return
+	}
+	if ctrl.dryRun {
+		glog.Infof("Dry run: would wait to acquire lock %s", ctrl.leaderElectionLock.Describe())
+		ctrl.run(stopCh)
+		return
+	}
+
+	desc := ctrl.leaderElectionLock.Describe()
+	elected := make(chan struct{})
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          ctrl.leaderElectionLock,
+		LeaseDuration: ctrl.leaseDuration,
+		RenewDeadline: ctrl.renewDeadline,
+		RetryPeriod:   ctrl.retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(_ <-chan struct{}) {
+				close(elected)
+			},
+			OnStoppedLeading: func() {
+				select {
+				case <-stopCh:
+					// The lock was released on shutdown
+				default:
+					// Another controller may already be running, so stop at once
+					glog.Fatalf("Lost lock %s, exiting so that another controller can take over", desc)
+				}
+			},
+		},
+	})
+	if err != nil {
+		glog.Fatalf("Error creating LeaderElector for lock %s: %v", desc, err)
+	}
+
+	go le.Run(nil)
+
+	glog.Infof("Provisioner controller %s waiting to acquire lock %s", string(ctrl.identity), desc)
+	select {
+	case <-elected:
+		ctrl.run(stopCh)
+	case <-stopCh:
+	}
+	le.Release()
+}
+
+// run runs this controller's control loops until stopCh is closed.
+func (ctrl *ProvisionController) run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+
 	glog.Infof("Starting provisioner controller %s!", string(ctrl.identity))
 	go ctrl.claimController.Run(stopCh)
 	go ctrl.volumeController.Run(stopCh)
 	go ctrl.classReflector.RunUntil(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, ctrl.claimController.HasSynced, ctrl.volumeController.HasSynced) {
+		ctrl.claimQueue.ShutDown()
+		ctrl.volumeQueue.ShutDown()
+		return
+	}
+
+	workers := &sync.WaitGroup{}
+	for i := 0; i < ctrl.threadiness; i++ {
+		workers.Add(2)
+		go func() {
+			defer workers.Done()
+			wait.Until(ctrl.runClaimWorker, time.Second, stopCh)
+		}()
+		go func() {
+			defer workers.Done()
+			wait.Until(ctrl.runVolumeWorker, time.Second, stopCh)
+		}()
+	}
+
 	<-stopCh
+	ctrl.shutDown(workers)
 }
 
-// On add claim, check if the added claim should have a volume provisioned for
-// it and provision one if so.
-func (ctrl *ProvisionController) addClaim(obj interface{}) {
+// shutDown shuts down the work queues so that workers take no new claims or
+// volumes and waits up to shutdownTimeout for them to finish the operations
+// they are in the middle of. If they do, the claim locks this controller holds
+// are released so that other controllers may take over provisioning without
+// waiting for the leases to expire. If they don't, the leases are left to
+// expire on their own, since a still-running Provision may yet create a PV.
+func (ctrl *ProvisionController) shutDown(workers *sync.WaitGroup) {
+	glog.Infof("Shutting down provisioner controller %s", string(ctrl.identity))
+	ctrl.claimQueue.ShutDown()
+	ctrl.volumeQueue.ShutDown()
+
+	finished := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(ctrl.shutdownTimeout):
+		glog.Warningf("Timed out after %v waiting for in-flight operations to finish, not releasing claim locks", ctrl.shutdownTimeout)
+		return
+	}
+
+	ctrl.mapMutex.Lock()
+	leaderElectors := make([]*leaderelection.LeaderElector, 0, len(ctrl.leaderElectors))
+	for _, le := range ctrl.leaderElectors {
+		leaderElectors = append(leaderElectors, le)
+	}
+	ctrl.mapMutex.Unlock()
+
+	released := &sync.WaitGroup{}
+	for _, le := range leaderElectors {
+		released.Add(1)
+		go func(le *leaderelection.LeaderElector) {
+			defer released.Done()
+			le.Release()
+		}(le)
+	}
+	released.Wait()
+	glog.Infof("Provisioner controller %s stopped", string(ctrl.identity))
+}
+
+// enqueueClaim takes a claim and converts it into a namespace/name string
+// which is then put onto the claim work queue.
+func (ctrl *ProvisionController) enqueueClaim(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	ctrl.claimQueue.Add(key)
+}
+
+// enqueueVolume takes a volume and converts it into a name string which is
+// then put onto the volume work queue.
+func (ctrl *ProvisionController) enqueueVolume(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	ctrl.volumeQueue.Add(key)
+}
+
+// runClaimWorker is a long-running function that will continually call the
+// processNextClaimWorkItem function in order to read and process a message on
+// the claim work queue.
+func (ctrl *ProvisionController) runClaimWorker() {
+	for ctrl.processNextClaimWorkItem() {
+	}
+}
+
+// runVolumeWorker is a long-running function that will continually call the
+// processNextVolumeWorkItem function in order to read and process a message on
+// the volume work queue.
+func (ctrl *ProvisionController) runVolumeWorker() {
+	for ctrl.processNextVolumeWorkItem() {
+	}
+}
+
+// processNextClaimWorkItem will read a single work item off the claim work
+// queue and attempt to process it by calling syncClaim. It returns false only
+// when the queue has been shut down.
+func (ctrl *ProvisionController) processNextClaimWorkItem() bool {
+	obj, shutdown := ctrl.claimQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer ctrl.claimQueue.Done(obj)
+
+	// Items still queued when the controller stops are dropped rather than
+	// drained, they will be picked up again by whoever next syncs them
+	if ctrl.claimQueue.ShuttingDown() {
+		return false
+	}
+
+	key, ok := obj.(string)
+	if !ok {
+		ctrl.claimQueue.Forget(obj)
+		utilruntime.HandleError(fmt.Errorf("expected string in claim work queue but got %#v", obj))
+		return true
+	}
+
+	claimObj, exists, err := ctrl.claims.GetByKey(key)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("error getting claim %q from informer cache: %v", key, err))
+		ctrl.claimQueue.AddRateLimited(key)
+		return true
+	}
+	if !exists {
+		// The claim was deleted, there is nothing left to provision for it
+		ctrl.forgetFailedClaim(key)
+		ctrl.claimQueue.Forget(key)
+		return true
+	}
+
+	if ctrl.hasFailed(key, claimObj) {
+		ctrl.claimQueue.Forget(key)
+		return true
+	}
+
+	if err := ctrl.syncClaim(claimObj); err != nil {
+		failedRetryThreshold := ctrl.getFailedRetryThreshold()
+		if ctrl.claimQueue.NumRequeues(key) < failedRetryThreshold {
+			glog.Errorf("Error syncing claim %q, re-queuing: %v", key, err)
+			metrics.RetriesTotal.WithLabelValues(metrics.QueueClaims).Inc()
+			ctrl.claimQueue.AddRateLimited(key)
+			return true
+		}
+		glog.Errorf("Exceeded failedRetryThreshold threshold: %d, for claim %q, provisioner will not attempt retries for this claim until it is next updated: %v", failedRetryThreshold, key, err)
+		ctrl.rememberFailedClaim(key, claimObj)
+	}
+
+	ctrl.claimQueue.Forget(key)
+	return true
+}
+
+// rememberFailedClaim records that the given claim exceeded
+// failedRetryThreshold, so that it is not retried until it changes.
+func (ctrl *ProvisionController) rememberFailedClaim(key string, obj interface{}) {
 	claim, ok := obj.(*v1.PersistentVolumeClaim)
 	if !ok {
-		glog.Errorf("Expected PersistentVolumeClaim but addClaim received %+v", obj)
 		return
 	}
+	ctrl.failedClaimsMutex.Lock()
+	defer ctrl.failedClaimsMutex.Unlock()
+	ctrl.failedClaims[key] = claim
+}
 
-	if ctrl.shouldProvision(claim) {
-		ctrl.mapMutex.Lock()
-		le, ok := ctrl.leaderElectors[claim.UID]
-		ctrl.mapMutex.Unlock()
-		if ok && le.IsLeader() {
-			opName := fmt.Sprintf("provision-%s[%s]", claimToClaimKey(claim), string(claim.UID))
-			ctrl.scheduleOperation(opName, func() error {
-				err := ctrl.provisionClaimOperation(claim)
-				ctrl.updateStats(claim, err)
-				return err
-			})
-		} else {
-			opName := fmt.Sprintf("lock-provision-%s[%s]", claimToClaimKey(claim), string(claim.UID))
-			ctrl.scheduleOperation(opName, func() error {
-				ctrl.lockProvisionClaimOperation(claim)
-				return nil
-			})
+// hasFailed returns whether the given claim exceeded failedRetryThreshold and
+// hasn't changed since, besides its leader election record. A claim that has
+// changed is forgotten and so retried.
+func (ctrl *ProvisionController) hasFailed(key string, obj interface{}) bool {
+	claim, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		return false
+	}
+	ctrl.failedClaimsMutex.Lock()
+	defer ctrl.failedClaimsMutex.Unlock()
+	failed, ok := ctrl.failedClaims[key]
+	if !ok {
+		return false
+	}
+	if failed.UID == claim.UID {
+		if failed.ResourceVersion == claim.ResourceVersion {
+			return true
+		}
+		if onlyRecord, err := ctrl.isOnlyRecordUpdate(failed, claim); err == nil && onlyRecord {
+			return true
+		}
+	}
+	delete(ctrl.failedClaims, key)
+	return false
+}
+
+func (ctrl *ProvisionController) forgetFailedClaim(key string) {
+	ctrl.failedClaimsMutex.Lock()
+	defer ctrl.failedClaimsMutex.Unlock()
+	delete(ctrl.failedClaims, key)
+}
+
+// processNextVolumeWorkItem will read a single work item off the volume work
+// queue and attempt to process it by calling syncVolume. It returns false
+// only when the queue has been shut down.
+func (ctrl *ProvisionController) processNextVolumeWorkItem() bool {
+	obj, shutdown := ctrl.volumeQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer ctrl.volumeQueue.Done(obj)
+
+	// Items still queued when the controller stops are dropped rather than
+	// drained, they will be picked up again by whoever next syncs them
+	if ctrl.volumeQueue.ShuttingDown() {
+		return false
+	}
+
+	key, ok := obj.(string)
+	if !ok {
+		ctrl.volumeQueue.Forget(obj)
+		utilruntime.HandleError(fmt.Errorf("expected string in volume work queue but got %#v", obj))
+		return true
+	}
+
+	volumeObj, exists, err := ctrl.volumes.GetByKey(key)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("error getting volume %q from informer cache: %v", key, err))
+		ctrl.volumeQueue.AddRateLimited(key)
+		return true
+	}
+	if !exists {
+		// The volume was deleted, there is nothing left to delete
+		ctrl.volumeQueue.Forget(key)
+		return true
+	}
+
+	if err := ctrl.syncVolume(volumeObj); err != nil {
+		glog.Errorf("Error syncing volume %q, re-queuing: %v", key, err)
+		metrics.RetriesTotal.WithLabelValues(metrics.QueueVolumes).Inc()
+		ctrl.volumeQueue.AddRateLimited(key)
+		return true
+	}
+
+	ctrl.volumeQueue.Forget(key)
+	return true
+}
+
+// syncClaim checks if the claim should have a volume provisioned for it and
+// provisions one if so. If this controller is not yet the leader for the
+// claim, it starts an election in the background; the claim is queued again
+// once the election is won. Returns an error if the claim should be re-queued.
+func (ctrl *ProvisionController) syncClaim(obj interface{}) error {
+	claim, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		return fmt.Errorf("expected PersistentVolumeClaim but syncClaim received %#v", obj)
+	}
+
+	if volume, ok := ctrl.shouldResize(claim); ok {
+		if ctrl.dryRun {
+			capacity := claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+			glog.Infof("Dry run: would resize volume %q for claim %q to %s", volume.Name, claimToClaimKey(claim), capacity.String())
+			return nil
 		}
+		return ctrl.resizeClaimOperation(claim, volume)
 	}
+
+	if !ctrl.shouldProvision(claim) {
+		return nil
+	}
+
+	if ctrl.dryRun {
+		ctrl.dryRunProvisionClaimOperation(claim)
+		return nil
+	}
+
+	// The elected leader of all the controllers needs no per-claim lock
+	if ctrl.leaderElectionLock != nil {
+		if !ctrl.qualifies(claim) {
+			return nil
+		}
+		return ctrl.provisionClaimOperation(claim)
+	}
+
+	ctrl.mapMutex.Lock()
+	le, ok := ctrl.leaderElectors[claim.UID]
+	ctrl.mapMutex.Unlock()
+	if ok {
+		if le.IsLeader() {
+			return ctrl.provisionClaimOperation(claim)
+		}
+		// An election for the claim is already underway
+		return nil
+	}
+
+	if !ctrl.qualifies(claim) {
+		return nil
+	}
+
+	return ctrl.lockProvisionClaimOperation(claim)
+}
+
+// syncVolume checks if the volume should be deleted and deletes it if so.
+// Returns an error if the volume should be re-queued.
+func (ctrl *ProvisionController) syncVolume(obj interface{}) error {
+	volume, ok := obj.(*v1.PersistentVolume)
+	if !ok {
+		return fmt.Errorf("expected PersistentVolume but syncVolume received %#v", obj)
+	}
+
+	if name, ok := ctrl.shouldSnapshot(volume); ok {
+		if ctrl.dryRun {
+			glog.Infof("Dry run: would take snapshot %q of volume %q", name, volume.Name)
+			return nil
+		}
+		return ctrl.snapshotVolumeOperation(volume, name)
+	}
+
+	if !ctrl.shouldDelete(volume) {
+		return nil
+	}
+
+	if ctrl.dryRun {
+		glog.Infof("Dry run: would delete volume %q", volume.Name)
+		return nil
+	}
+
+	return ctrl.deleteVolumeOperation(volume)
+}
+
+// On add claim, queue the claim so a worker checks if it should have a volume
+// provisioned for it and provisions one if so.
+func (ctrl *ProvisionController) addClaim(obj interface{}) {
+	ctrl.enqueueClaim(obj)
 }
 
 // On update claim, pass the new claim to addClaim. Updates occur at least every
@@ -330,21 +828,10 @@ func (ctrl *ProvisionController) updateClaim(oldObj, newObj interface{}) {
 	}
 }
 
-// On update volume, check if the updated volume should be deleted and delete if
-// so. Updates occur at least every resyncPeriod.
+// On update volume, queue the volume so a worker checks if it should be
+// deleted and deletes it if so. Updates occur at least every resyncPeriod.
 func (ctrl *ProvisionController) updateVolume(oldObj, newObj interface{}) {
-	volume, ok := newObj.(*v1.PersistentVolume)
-	if !ok {
-		glog.Errorf("Expected PersistentVolume but handler received %#v", newObj)
-		return
-	}
-
-	if ctrl.shouldDelete(volume) {
-		opName := fmt.Sprintf("delete-%s[%s]", volume.Name, string(volume.UID))
-		ctrl.scheduleOperation(opName, func() error {
-			return ctrl.deleteVolumeOperation(volume)
-		})
-	}
+	ctrl.enqueueVolume(newObj)
 }
 
 // isOnlyRecordUpdate checks if the only update between the old & new claim is
@@ -388,17 +875,6 @@ func (ctrl *ProvisionController) shouldProvision(claim *v1.PersistentVolumeClaim
 		return false
 	}
 
-	ctrl.failedClaimsStatsMutex.Lock()
-	if failureCount, exists := ctrl.failedClaimsStats[claim.UID]; exists == true {
-
-		if failureCount >= ctrl.failedRetryThreshold {
-			glog.Errorf("Exceeded failedRetryThreshold threshold: %d, for claim %q, provisioner will not attempt retries for this claim", ctrl.failedRetryThreshold, claimToClaimKey(claim))
-			ctrl.failedClaimsStatsMutex.Unlock()
-			return false
-		}
-	}
-	ctrl.failedClaimsStatsMutex.Unlock()
-
 	// Kubernetes 1.5 provisioning with annDynamicallyProvisioned
 	if provisioner, found := claim.Annotations[annDynamicallyProvisioned]; found {
 		if provisioner == ctrl.provisionerName {
@@ -417,6 +893,70 @@ func (ctrl *ProvisionController) shouldProvision(claim *v1.PersistentVolumeClaim
 	return true
 }
 
+// shouldResize returns whether the claim is bound to a volume this controller
+// provisioned whose capacity is less than the claim requests, and the volume
+// if so. Only applicable if the provisioner is a Resizer.
+func (ctrl *ProvisionController) shouldResize(claim *v1.PersistentVolumeClaim) (*v1.PersistentVolume, bool) {
+	if _, ok := ctrl.provisioner.(Resizer); !ok {
+		return nil, false
+	}
+
+	if claim.Spec.VolumeName == "" || claim.Status.Phase != v1.ClaimBound {
+		return nil, false
+	}
+
+	obj, found, err := ctrl.volumes.GetByKey(claim.Spec.VolumeName)
+	if err != nil || !found {
+		return nil, false
+	}
+	volume, ok := obj.(*v1.PersistentVolume)
+	if !ok {
+		return nil, false
+	}
+
+	if ann := volume.Annotations[annDynamicallyProvisioned]; ann != ctrl.provisionerName {
+		return nil, false
+	}
+
+	if volume.Spec.ClaimRef == nil || volume.Spec.ClaimRef.UID != claim.UID {
+		return nil, false
+	}
+
+	requested := claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	capacity := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	if requested.Cmp(capacity) <= 0 {
+		return nil, false
+	}
+
+	return volume, true
+}
+
+// shouldSnapshot returns whether a snapshot not yet taken has been requested of
+// the volume, and the snapshot's name if so. Only applicable if the
+// provisioner is a Snapshotter.
+func (ctrl *ProvisionController) shouldSnapshot(volume *v1.PersistentVolume) (string, bool) {
+	if _, ok := ctrl.provisioner.(Snapshotter); !ok {
+		return "", false
+	}
+
+	if ann := volume.Annotations[annDynamicallyProvisioned]; ann != ctrl.provisionerName {
+		return "", false
+	}
+
+	name := volume.Annotations[AnnSnapshotRequest]
+	if name == "" {
+		return "", false
+	}
+
+	for _, snapshot := range getSnapshots(volume) {
+		if snapshot == name {
+			return "", false
+		}
+	}
+
+	return name, true
+}
+
 func (ctrl *ProvisionController) shouldDelete(volume *v1.PersistentVolume) bool {
 	// In 1.5+ we delete only if the volume is in state Released. In 1.4 we must
 	// delete if the volume is in state Failed too.
@@ -449,8 +989,10 @@ func (ctrl *ProvisionController) shouldDelete(volume *v1.PersistentVolume) bool
 // controllers are serving the same claims, to prevent them all from creating
 // volumes for a claim & racing to submit their PV, each controller creates a
 // LeaderElector to instead race for the leadership (lock), where only the
-// leader is tasked with provisioning & may try to do so
-func (ctrl *ProvisionController) lockProvisionClaimOperation(claim *v1.PersistentVolumeClaim) {
+// leader is tasked with provisioning & may try to do so. The election runs in
+// the background; when it is won the claim is queued again for a worker to
+// provision it.
+func (ctrl *ProvisionController) lockProvisionClaimOperation(claim *v1.PersistentVolumeClaim) error {
 	stoppedLeading := false
 	rl := rl.ProvisionPVCLock{
 		PVCMeta: claim.ObjectMeta,
@@ -468,74 +1010,83 @@ func (ctrl *ProvisionController) lockProvisionClaimOperation(claim *v1.Persisten
 		TermLimit:     ctrl.termLimit,
 		Callbacks: leaderelection.LeaderCallbacks{
 			OnStartedLeading: func(_ <-chan struct{}) {
-				opName := fmt.Sprintf("provision-%s[%s]", claimToClaimKey(claim), string(claim.UID))
-				ctrl.scheduleOperation(opName, func() error {
-					err := ctrl.provisionClaimOperation(claim)
-					ctrl.updateStats(claim, err)
-					return err
-
-				})
+				ctrl.enqueueClaim(claim)
 			},
 			OnStoppedLeading: func() {
 				stoppedLeading = true
 			},
+			OnNewLeader: func(identity string) {
+				if identity != "" {
+					glog.V(4).Infof("Claim %q is now locked by %s", claimToClaimKey(claim), identity)
+				}
+			},
 		},
 	})
 	if err != nil {
-		glog.Errorf("Error creating LeaderElector, can't provision for claim %q: %v", claimToClaimKey(claim), err)
-		return
+		return fmt.Errorf("error creating LeaderElector, can't provision for claim %q: %v", claimToClaimKey(claim), err)
 	}
 
-	ctrl.mapMutex.Lock()
-	ctrl.leaderElectors[claim.UID] = le
-	ctrl.mapMutex.Unlock()
-
 	// To determine when to stop trying to acquire/renew the lock, watch for
 	// provisioning success/failure. (The leader could get the result of its
 	// operation but it has to watch anyway)
 	stopCh := make(chan struct{})
 	successCh, err := ctrl.watchProvisioning(claim, stopCh)
 	if err != nil {
-		glog.Errorf("Error watching for provisioning success, can't provision for claim %q: %v", claimToClaimKey(claim), err)
+		close(stopCh)
+		return fmt.Errorf("error watching for provisioning success, can't provision for claim %q: %v", claimToClaimKey(claim), err)
 	}
 
-	le.Run(successCh)
+	ctrl.mapMutex.Lock()
+	ctrl.leaderElectors[claim.UID] = le
+	metrics.LeaderElectionsInFlight.Set(float64(len(ctrl.leaderElectors)))
+	ctrl.mapMutex.Unlock()
 
-	close(stopCh)
+	go func() {
+		le.Run(successCh)
 
-	// If we were the leader and stopped, give others a chance to acquire
-	// (whether they exist & want to or not). Else, there must have been a
-	// success so just proceed.
-	if stoppedLeading {
-		time.Sleep(ctrl.leaseDuration + ctrl.retryPeriod)
-	}
+		close(stopCh)
 
-	ctrl.mapMutex.Lock()
-	delete(ctrl.leaderElectors, claim.UID)
-	ctrl.mapMutex.Unlock()
+		// If we were the leader and stopped, give others a chance to acquire
+		// (whether they exist & want to or not). Else, there must have been a
+		// success so just proceed.
+		if stoppedLeading {
+			time.Sleep(ctrl.leaseDuration + ctrl.retryPeriod)
+		}
+
+		ctrl.mapMutex.Lock()
+		delete(ctrl.leaderElectors, claim.UID)
+		metrics.LeaderElectionsInFlight.Set(float64(len(ctrl.leaderElectors)))
+		ctrl.mapMutex.Unlock()
+	}()
+
+	return nil
 }
 
-func (ctrl *ProvisionController) updateStats(claim *v1.PersistentVolumeClaim, err error) {
-	ctrl.failedClaimsStatsMutex.Lock()
-	defer ctrl.failedClaimsStatsMutex.Unlock()
+// dryRunProvisionClaimOperation logs the options provisionClaimOperation would
+// provision a volume for the given claim with, without provisioning it.
+func (ctrl *ProvisionController) dryRunProvisionClaimOperation(claim *v1.PersistentVolumeClaim) {
+	storageClass, err := ctrl.getStorageClass(getClaimClass(claim))
 	if err != nil {
-		if failureRetryCount, exists := ctrl.failedClaimsStats[claim.UID]; exists == true {
-			failureRetryCount = failureRetryCount + 1
-			ctrl.failedClaimsStats[claim.UID] = failureRetryCount
-		} else {
-			ctrl.failedClaimsStats[claim.UID] = 1
-		}
+		glog.Infof("Dry run: would not provision volume for claim %q: %v", claimToClaimKey(claim), err)
+		return
+	}
 
-	} else {
-		delete(ctrl.failedClaimsStats, claim.UID)
+	options, err := ctrl.getVolumeOptions(claim, storageClass)
+	if err != nil {
+		glog.Infof("Dry run: would fail to provision volume for claim %q with StorageClass %q: %v", claimToClaimKey(claim), storageClass.Name, err)
+		return
 	}
+
+	capacity := claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	glog.Infof("Dry run: would provision volume %q of capacity %s with reclaim policy %q and parameters %v for claim %q with StorageClass %q", options.PVName, capacity.String(), options.PersistentVolumeReclaimPolicy, options.Parameters, claimToClaimKey(claim), storageClass.Name)
 }
 
 // provisionClaimOperation attempts to provision a volume for the given claim.
-// Returns an error for use by goroutinemap when expbackoff is enabled: if nil,
-// the operation is deleted, else the operation may be retried with expbackoff.
+// Returns an error if the provisioner failed, in which case the claim is
+// re-queued with exponential backoff, up to failedRetryThreshold times.
 func (ctrl *ProvisionController) provisionClaimOperation(claim *v1.PersistentVolumeClaim) error {
 	// Most code here is identical to that found in controller.go of kube's PV controller...
+	startTime := time.Now()
 	claimClass := getClaimClass(claim)
 	glog.V(4).Infof("provisionClaimOperation [%s] started, class: %q", claimToClaimKey(claim), claimClass)
 
@@ -564,19 +1115,25 @@ func (ctrl *ProvisionController) provisionClaimOperation(claim *v1.PersistentVol
 		return nil
 	}
 
-	options := VolumeOptions{
-		// TODO SHOULD be set to `Delete` unless user manually congiures other reclaim policy.
-		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
-		PVName:     pvName,
-		PVC:        claim,
-		Parameters: storageClass.Parameters,
+	options, err := ctrl.getVolumeOptions(claim, storageClass)
+	if err != nil {
+		strerr := fmt.Sprintf("Failed to provision volume with StorageClass %q: %v", storageClass.Name, err)
+		glog.Errorf("Failed to provision volume for claim %q with StorageClass %q: %v", claimToClaimKey(claim), storageClass.Name, err)
+		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+		return nil
 	}
 
 	volume, err = ctrl.provisioner.Provision(options)
 	if err != nil {
+		if ierr, ok := err.(*IgnoredError); ok {
+			// Provision ignored, do nothing and hope another provisioner will provision it.
+			glog.Infof("provision of claim %q ignored: %v", claimToClaimKey(claim), ierr)
+			return nil
+		}
 		strerr := fmt.Sprintf("Failed to provision volume with StorageClass %q: %v", storageClass.Name, err)
 		glog.Errorf("Failed to provision volume for claim %q with StorageClass %q: %v", claimToClaimKey(claim), storageClass.Name, err)
 		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+		metrics.PersistentVolumeClaimProvisionTotal.WithLabelValues(claimClass, metrics.ResultFailure).Inc()
 		return err
 	}
 
@@ -587,6 +1144,9 @@ func (ctrl *ProvisionController) provisionClaimOperation(claim *v1.PersistentVol
 
 	setAnnotation(&volume.ObjectMeta, annDynamicallyProvisioned, ctrl.provisionerName)
 	setAnnotation(&volume.ObjectMeta, annClass, claimClass)
+	if _, ok := volume.Annotations[AnnMountOptions]; !ok && len(options.MountOptions) != 0 {
+		setAnnotation(&volume.ObjectMeta, AnnMountOptions, strings.Join(options.MountOptions, ","))
+	}
 
 	// Try to create the PV object several times
 	for i := 0; i < ctrl.createProvisionedPVRetryCount; i++ {
@@ -609,6 +1169,7 @@ func (ctrl *ProvisionController) provisionClaimOperation(claim *v1.PersistentVol
 		strerr := fmt.Sprintf("Error creating provisioned PV object for claim %s: %v. Deleting the volume.", claimToClaimKey(claim), err)
 		glog.Error(strerr)
 		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ProvisioningFailed", strerr)
+		metrics.PersistentVolumeClaimProvisionTotal.WithLabelValues(claimClass, metrics.ResultFailure).Inc()
 
 		for i := 0; i < ctrl.createProvisionedPVRetryCount; i++ {
 			if err = ctrl.provisioner.Delete(volume); err == nil {
@@ -632,6 +1193,8 @@ func (ctrl *ProvisionController) provisionClaimOperation(claim *v1.PersistentVol
 		glog.Infof("volume %q provisioned for claim %q", volume.Name, claimToClaimKey(claim))
 		msg := fmt.Sprintf("Successfully provisioned volume %s", volume.Name)
 		ctrl.eventRecorder.Event(claim, v1.EventTypeNormal, "ProvisioningSucceeded", msg)
+		metrics.PersistentVolumeClaimProvisionTotal.WithLabelValues(claimClass, metrics.ResultSuccess).Inc()
+		metrics.PersistentVolumeClaimProvisionDurationSeconds.WithLabelValues(claimClass).Observe(time.Since(startTime).Seconds())
 	}
 
 	return nil
@@ -791,7 +1354,82 @@ func (ctrl *ProvisionController) getPVCEventWatch(claim *v1.PersistentVolumeClai
 	})
 }
 
+// resizeClaimOperation expands the volume bound to the claim to the claim's
+// requested capacity and saves the expanded volume. Returns an error if the
+// claim should be re-queued.
+func (ctrl *ProvisionController) resizeClaimOperation(claim *v1.PersistentVolumeClaim, volume *v1.PersistentVolume) error {
+	requested := claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	glog.V(4).Infof("resizeClaimOperation [%s] started, volume: %q, capacity: %s", claimToClaimKey(claim), volume.Name, requested.String())
+
+	newVolume, err := ctrl.provisioner.(Resizer).Resize(volume, requested)
+	if err != nil {
+		if ierr, ok := err.(*IgnoredError); ok {
+			// Resize ignored, do nothing and hope another provisioner will resize it.
+			glog.Infof("resize of volume %q for claim %q ignored: %v", volume.Name, claimToClaimKey(claim), ierr)
+			return nil
+		}
+		strerr := fmt.Sprintf("Failed to resize volume %q to %s: %v", volume.Name, requested.String(), err)
+		glog.Errorf("Failed to resize volume %q for claim %q to %s: %v", volume.Name, claimToClaimKey(claim), requested.String(), err)
+		ctrl.eventRecorder.Event(claim, v1.EventTypeWarning, "ResizingFailed", strerr)
+		return err
+	}
+
+	if _, err = ctrl.client.Core().PersistentVolumes().Update(newVolume); err != nil {
+		glog.Errorf("Failed to save resized volume %q for claim %q: %v", volume.Name, claimToClaimKey(claim), err)
+		return err
+	}
+
+	msg := fmt.Sprintf("Successfully resized volume %s to %s", volume.Name, requested.String())
+	ctrl.eventRecorder.Event(claim, v1.EventTypeNormal, "Resized", msg)
+	glog.Infof("volume %q for claim %q resized to %s", volume.Name, claimToClaimKey(claim), requested.String())
+	return nil
+}
+
+// snapshotVolumeOperation takes the named snapshot of the volume and records it
+// in the volume's snapshots annotation. Returns an error if the volume should
+// be re-queued.
+func (ctrl *ProvisionController) snapshotVolumeOperation(volume *v1.PersistentVolume, name string) error {
+	glog.V(4).Infof("snapshotVolumeOperation [%s] started, snapshot: %q", volume.Name, name)
+
+	if errs := validation.IsDNS1123Label(name); len(errs) != 0 {
+		strerr := fmt.Sprintf("Invalid snapshot name %q: %s", name, strings.Join(errs, ", "))
+		glog.Errorf("Failed to snapshot volume %q: %s", volume.Name, strerr)
+		ctrl.eventRecorder.Event(volume, v1.EventTypeWarning, "SnapshotFailed", strerr)
+		return nil
+	}
+
+	if err := ctrl.provisioner.(Snapshotter).Snapshot(volume, name); err != nil {
+		if ierr, ok := err.(*IgnoredError); ok {
+			// Snapshot ignored, do nothing and hope another provisioner will take it.
+			glog.Infof("snapshot %q of volume %q ignored: %v", name, volume.Name, ierr)
+			return nil
+		}
+		glog.Errorf("Failed to take snapshot %q of volume %q: %v", name, volume.Name, err)
+		ctrl.eventRecorder.Event(volume, v1.EventTypeWarning, "SnapshotFailed", err.Error())
+		return err
+	}
+
+	newVolume := *volume
+	newVolume.Annotations = make(map[string]string)
+	for k, v := range volume.Annotations {
+		newVolume.Annotations[k] = v
+	}
+	newVolume.Annotations[AnnSnapshots] = strings.Join(append(getSnapshots(volume), name), ",")
+	delete(newVolume.Annotations, AnnSnapshotRequest)
+
+	if _, err := ctrl.client.Core().PersistentVolumes().Update(&newVolume); err != nil {
+		glog.Errorf("Failed to record snapshot %q of volume %q: %v", name, volume.Name, err)
+		return err
+	}
+
+	ctrl.eventRecorder.Event(volume, v1.EventTypeNormal, "SnapshotTaken", fmt.Sprintf("Successfully took snapshot %s", name))
+	glog.Infof("snapshot %q of volume %q taken", name, volume.Name)
+	return nil
+}
+
 func (ctrl *ProvisionController) deleteVolumeOperation(volume *v1.PersistentVolume) error {
+	startTime := time.Now()
+	volumeClass := getVolumeClass(volume)
 	glog.V(4).Infof("deleteVolumeOperation [%s] started", volume.Name)
 
 	// This method may have been waiting for a volume lock for some time.
@@ -816,6 +1454,7 @@ func (ctrl *ProvisionController) deleteVolumeOperation(volume *v1.PersistentVolu
 		// Delete failed, emit an event.
 		glog.Errorf("Deletion of volume %q failed: %v", volume.Name, err)
 		ctrl.eventRecorder.Event(volume, v1.EventTypeWarning, "VolumeFailedDelete", err.Error())
+		metrics.PersistentVolumeDeleteTotal.WithLabelValues(volumeClass, metrics.ResultFailure).Inc()
 		return err
 	}
 
@@ -827,10 +1466,13 @@ func (ctrl *ProvisionController) deleteVolumeOperation(volume *v1.PersistentVolu
 		// Oops, could not delete the volume and therefore the controller will
 		// try to delete the volume again on next update.
 		glog.Infof("failed to delete volume %q from database: %v", volume.Name, err)
+		metrics.PersistentVolumeDeleteTotal.WithLabelValues(volumeClass, metrics.ResultFailure).Inc()
 		return nil
 	}
 
 	glog.Infof("volume %q deleted from database", volume.Name)
+	metrics.PersistentVolumeDeleteTotal.WithLabelValues(volumeClass, metrics.ResultSuccess).Inc()
+	metrics.PersistentVolumeDeleteDurationSeconds.WithLabelValues(volumeClass).Observe(time.Since(startTime).Seconds())
 	return nil
 }
 
@@ -840,21 +1482,6 @@ func (ctrl *ProvisionController) getProvisionedVolumeNameForClaim(claim *v1.Pers
 	return "pvc-" + string(claim.UID)
 }
 
-// scheduleOperation starts given asynchronous operation on given volume. It
-// makes sure the operation is already not running.
-func (ctrl *ProvisionController) scheduleOperation(operationName string, operation func() error) {
-	glog.Infof("scheduleOperation[%s]", operationName)
-
-	err := ctrl.runningOperations.Run(operationName, operation)
-	if err != nil {
-		if goroutinemap.IsAlreadyExists(err) {
-			glog.V(4).Infof("operation %q is already running, skipping", operationName)
-		} else {
-			glog.Errorf("Error scheduling operaion %q: %v", operationName, err)
-		}
-	}
-}
-
 func (ctrl *ProvisionController) getStorageClass(name string) (*v1beta1.StorageClass, error) {
 	classObj, found, err := ctrl.classes.GetByKey(name)
 	if err != nil {
@@ -880,6 +1507,148 @@ func (ctrl *ProvisionController) getStorageClass(name string) (*v1beta1.StorageC
 	return storageClass, nil
 }
 
+// qualifies returns whether the provisioner, if it is a Qualifier, should
+// attempt to provision a volume for the claim. If it can't be asked, e.g.
+// because the claim's class is invalid, the claim qualifies so that
+// provisionClaimOperation may report the problem.
+func (ctrl *ProvisionController) qualifies(claim *v1.PersistentVolumeClaim) bool {
+	qualifier, ok := ctrl.provisioner.(Qualifier)
+	if !ok {
+		return true
+	}
+
+	storageClass, err := ctrl.getStorageClass(getClaimClass(claim))
+	if err != nil {
+		return true
+	}
+	options, err := ctrl.getVolumeOptions(claim, storageClass)
+	if err != nil {
+		return true
+	}
+
+	if !qualifier.ShouldProvision(options) {
+		glog.V(4).Infof("provisioner declined claim %q, not taking part in its leader election", claimToClaimKey(claim))
+		return false
+	}
+	return true
+}
+
+// getVolumeOptions returns the options to provision a volume for the claim
+// with, given the claim's class.
+func (ctrl *ProvisionController) getVolumeOptions(claim *v1.PersistentVolumeClaim, storageClass *v1beta1.StorageClass) (VolumeOptions, error) {
+	reclaimPolicy, parameters, err := ctrl.getReclaimPolicy(storageClass)
+	if err != nil {
+		return VolumeOptions{}, err
+	}
+	mountOptions, parameters, err := getMountOptions(parameters)
+	if err != nil {
+		return VolumeOptions{}, err
+	}
+
+	return VolumeOptions{
+		PersistentVolumeReclaimPolicy: reclaimPolicy,
+		PVName:                        ctrl.getProvisionedVolumeNameForClaim(claim),
+		PVC:                           claim,
+		Parameters:                    parameters,
+		MountOptions:                  mountOptions,
+	}, nil
+}
+
+// getMountOptions returns the mount options of the given class parameters and
+// the parameters minus the mountOptions one, which is for the controller to
+// consume.
+func getMountOptions(classParameters map[string]string) ([]string, map[string]string, error) {
+	var mountOptions []string
+	parameters := make(map[string]string)
+	for k, v := range classParameters {
+		if strings.ToLower(k) != strings.ToLower(MountOptionsParameter) {
+			parameters[k] = v
+			continue
+		}
+		var err error
+		mountOptions, err = ParseMountOptions(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid value for parameter %s: %v", k, err)
+		}
+	}
+	return mountOptions, parameters, nil
+}
+
+// mountOptionRe matches a mount option, a name optionally followed by '=' and
+// a value, neither containing whitespace, commas or quotes.
+var mountOptionRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+(=[^\s,'"=]+)?$`)
+
+// ParseMountOptions parses and validates a comma separated list of mount
+// options, as found in the mount options annotation. Whether the volume plugin
+// supports them is left for the mount to tell: an option may only be given
+// once.
+func ParseMountOptions(value string) ([]string, error) {
+	mountOptions := []string{}
+	names := map[string]bool{}
+	for _, option := range strings.Split(value, ",") {
+		option = strings.TrimSpace(option)
+		if !mountOptionRe.MatchString(option) {
+			return nil, fmt.Errorf("invalid mount option %q", option)
+		}
+		name := MountOptionName(option)
+		if names[name] {
+			return nil, fmt.Errorf("mount option %q given more than once", name)
+		}
+		names[name] = true
+		mountOptions = append(mountOptions, option)
+	}
+	return mountOptions, nil
+}
+
+// MountOptionName returns the name of the mount option, e.g. "nfsvers" for
+// "nfsvers=4.1".
+func MountOptionName(option string) string {
+	return strings.SplitN(option, "=", 2)[0]
+}
+
+// getReclaimPolicy returns the reclaim policy to provision a volume of the
+// given class with and the class's parameters minus the reclaimPolicy one,
+// which is for the controller and not the provisioner to consume. The policy
+// is the controller's override if set, else the class's parameter if set, else
+// Delete.
+func (ctrl *ProvisionController) getReclaimPolicy(storageClass *v1beta1.StorageClass) (v1.PersistentVolumeReclaimPolicy, map[string]string, error) {
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	parameters := make(map[string]string)
+	for k, v := range storageClass.Parameters {
+		if strings.ToLower(k) != strings.ToLower(ReclaimPolicyParameter) {
+			parameters[k] = v
+			continue
+		}
+		reclaimPolicy = v1.PersistentVolumeReclaimPolicy(v)
+		if err := validateReclaimPolicy(reclaimPolicy); err != nil {
+			return "", nil, fmt.Errorf("invalid value for parameter %s: %v", k, err)
+		}
+	}
+	if ctrl.reclaimPolicy != "" {
+		reclaimPolicy = ctrl.reclaimPolicy
+	}
+	return reclaimPolicy, parameters, nil
+}
+
+// validateReclaimPolicy tests if the given reclaim policy is one a
+// dynamically provisioned volume may have. Recycle isn't: the recycler would
+// scrub the volume and make it available again, to be bound by any claim.
+func validateReclaimPolicy(reclaimPolicy v1.PersistentVolumeReclaimPolicy) error {
+	switch reclaimPolicy {
+	case v1.PersistentVolumeReclaimDelete, v1.PersistentVolumeReclaimRetain:
+		return nil
+	}
+	return fmt.Errorf("unsupported reclaim policy %q, valid values are: %q, %q", reclaimPolicy, v1.PersistentVolumeReclaimDelete, v1.PersistentVolumeReclaimRetain)
+}
+
+// getSnapshots returns the names of the snapshots taken of the volume.
+func getSnapshots(volume *v1.PersistentVolume) []string {
+	if snapshots := volume.Annotations[AnnSnapshots]; snapshots != "" {
+		return strings.Split(snapshots, ",")
+	}
+	return []string{}
+}
+
 func hasAnnotation(obj v1.ObjectMeta, ann string) bool {
 	_, found := obj.Annotations[ann]
 	return found
@@ -905,6 +1674,16 @@ func getClaimClass(claim *v1.PersistentVolumeClaim) string {
 	return ""
 }
 
+// getVolumeClass returns name of class that the given volume belongs to, ""
+// for a classless PV.
+func getVolumeClass(volume *v1.PersistentVolume) string {
+	if class, found := volume.Annotations[annClass]; found {
+		return class
+	}
+
+	return ""
+}
+
 func claimToClaimKey(claim *v1.PersistentVolumeClaim) string {
 	return fmt.Sprintf("%s/%s", claim.Namespace, claim.Name)
 }
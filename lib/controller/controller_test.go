@@ -22,11 +22,15 @@ import (
 	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/kubernetes-incubator/external-storage/lib/controller/metrics"
 	"github.com/kubernetes-incubator/external-storage/lib/leaderelection"
 	rl "github.com/kubernetes-incubator/external-storage/lib/leaderelection/resourcelock"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
 	fakev1core "k8s.io/client-go/kubernetes/typed/core/v1/fake"
@@ -37,6 +41,7 @@ import (
 	"k8s.io/client-go/pkg/conversion"
 	"k8s.io/client-go/pkg/runtime"
 	"k8s.io/client-go/pkg/types"
+	"k8s.io/client-go/pkg/util/wait"
 	"k8s.io/client-go/pkg/watch"
 	testclient "k8s.io/client-go/testing"
 	fcache "k8s.io/client-go/tools/cache/testing"
@@ -44,6 +49,7 @@ import (
 
 const (
 	resyncPeriod         = 100 * time.Millisecond
+	threadiness          = 2
 	failedRetryThreshold = 5
 )
 
@@ -134,6 +140,96 @@ func TestController(t *testing.T) {
 			provisioner:     newBadTestProvisioner(),
 			expectedVolumes: []v1.PersistentVolume(nil),
 		},
+		{
+			name: "provision for claim-1 with the mount options of class-1",
+			objs: []runtime.Object{
+				newStorageClassWithParameters("class-1", "foo.bar/baz", map[string]string{"mountOptions": "hard,nfsvers=4.1"}),
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			expectedVolumes: []v1.PersistentVolume{
+				*newProvisionedVolumeWithMountOptions(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "", nil), "hard,nfsvers=4.1"),
+			},
+		},
+		{
+			name: "don't provision for claim-1 because the mount options of class-1 are invalid",
+			objs: []runtime.Object{
+				newStorageClassWithParameters("class-1", "foo.bar/baz", map[string]string{"mountOptions": "hard,,nfsvers=4.1"}),
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			expectedVolumes: []v1.PersistentVolume(nil),
+		},
+		{
+			name: "qualifier declines claim-1: no pv is created",
+			objs: []runtime.Object{
+				newStorageClass("class-1", "foo.bar/baz"),
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newQualifiedTestProvisioner(false),
+			expectedVolumes: []v1.PersistentVolume(nil),
+		},
+		{
+			name: "qualifier accepts claim-1: pv is created",
+			objs: []runtime.Object{
+				newStorageClass("class-1", "foo.bar/baz"),
+				newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newQualifiedTestProvisioner(true),
+			expectedVolumes: []v1.PersistentVolume{
+				*newProvisionedVolume(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "", nil)),
+			},
+		},
+		{
+			name: "resize volume-1 for claim-1",
+			objs: []runtime.Object{
+				newBoundClaim("claim-1", "uid-1-1", "class-1", "volume-1", "2Mi"),
+				newBoundVolume("volume-1", "foo.bar/baz", newBoundClaim("claim-1", "uid-1-1", "class-1", "volume-1", "2Mi"), "1Mi"),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newResizingTestProvisioner(),
+			expectedVolumes: []v1.PersistentVolume{
+				*newBoundVolume("volume-1", "foo.bar/baz", newBoundClaim("claim-1", "uid-1-1", "class-1", "volume-1", "2Mi"), "2Mi"),
+			},
+		},
+		{
+			name: "don't resize volume-1 for claim-1 because the provisioner isn't a resizer",
+			objs: []runtime.Object{
+				newBoundClaim("claim-1", "uid-1-1", "class-1", "volume-1", "2Mi"),
+				newBoundVolume("volume-1", "foo.bar/baz", newBoundClaim("claim-1", "uid-1-1", "class-1", "volume-1", "2Mi"), "1Mi"),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newTestProvisioner(),
+			expectedVolumes: []v1.PersistentVolume{
+				*newBoundVolume("volume-1", "foo.bar/baz", newBoundClaim("claim-1", "uid-1-1", "class-1", "volume-1", "2Mi"), "1Mi"),
+			},
+		},
+		{
+			name: "take snapshot of volume-1",
+			objs: []runtime.Object{
+				newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", AnnSnapshots: "snap-1", AnnSnapshotRequest: "snap-2"}),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newSnapshottingTestProvisioner(),
+			expectedVolumes: []v1.PersistentVolume{
+				*newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", AnnSnapshots: "snap-1,snap-2"}),
+			},
+		},
+		{
+			name: "don't take snapshot of volume-1 because its name is invalid",
+			objs: []runtime.Object{
+				newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", AnnSnapshotRequest: "Snap_1"}),
+			},
+			provisionerName: "foo.bar/baz",
+			provisioner:     newSnapshottingTestProvisioner(),
+			expectedVolumes: []v1.PersistentVolume{
+				*newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", AnnSnapshotRequest: "Snap_1"}),
+			},
+		},
 		{
 			name: "provisioner fails to delete volume-1: pv is not deleted",
 			objs: []runtime.Object{
@@ -182,12 +278,11 @@ func TestController(t *testing.T) {
 				client.Fake.PrependReactor(v, "persistentvolumes", test.reaction)
 			}
 		}
-		ctrl := newTestProvisionController(client, resyncPeriod, test.provisionerName, test.provisioner, "v1.5.0", false, failedRetryThreshold)
+		ctrl := newTestProvisionController(client, resyncPeriod, test.provisionerName, test.provisioner, "v1.5.0", threadiness, failedRetryThreshold)
 		stopCh := make(chan struct{})
 		go ctrl.Run(stopCh)
 
-		time.Sleep(2 * resyncPeriod)
-		ctrl.runningOperations.Wait()
+		time.Sleep(3 * resyncPeriod)
 
 		pvList, _ := client.Core().PersistentVolumes().List(v1.ListOptions{})
 		if !reflect.DeepEqual(test.expectedVolumes, pvList.Items) {
@@ -245,7 +340,7 @@ func TestMultipleControllers(t *testing.T) {
 		ctrls := make([]*ProvisionController, test.numControllers)
 		stopChs := make([]chan struct{}, test.numControllers)
 		for i := 0; i < test.numControllers; i++ {
-			ctrls[i] = NewProvisionController(client, 15*time.Second, test.provisionerName, provisioner, "v1.5.0", false, failedRetryThreshold, leaderelection.DefaultLeaseDuration, leaderelection.DefaultRenewDeadline, leaderelection.DefaultRetryPeriod, leaderelection.DefaultTermLimit)
+			ctrls[i] = NewProvisionController(client, 15*time.Second, test.provisionerName, provisioner, "v1.5.0", threadiness, failedRetryThreshold, leaderelection.DefaultLeaseDuration, leaderelection.DefaultRenewDeadline, leaderelection.DefaultRetryPeriod, leaderelection.DefaultTermLimit)
 			ctrls[i].createProvisionedPVInterval = 10 * time.Millisecond
 			ctrls[i].claimSource = claimSource
 			ctrls[i].claims.Add(newClaim("claim-1", "uid-1-1", "class-1", "", nil))
@@ -253,8 +348,11 @@ func TestMultipleControllers(t *testing.T) {
 			stopChs[i] = make(chan struct{})
 		}
 
+		// Run only the claim workers: the informers would overwrite the claims
+		// added to the caches above with the (empty) fake clientset's
 		for i := 0; i < test.numControllers; i++ {
-			go ctrls[i].addClaim(newClaim("claim-1", "uid-1-1", "class-1", "", nil))
+			go wait.Until(ctrls[i].runClaimWorker, time.Second, stopChs[i])
+			ctrls[i].addClaim(newClaim("claim-1", "uid-1-1", "class-1", "", nil))
 		}
 
 		// Sleep for 3 election retry periods
@@ -265,10 +363,211 @@ func TestMultipleControllers(t *testing.T) {
 			t.Errorf("expected provision calls:\n %v\n but got:\n %v\n", test.expectedCalls, len(provisioner.provisionCalls))
 		}
 
-		for _, stopCh := range stopChs {
+		for i, stopCh := range stopChs {
 			close(stopCh)
+			ctrls[i].claimQueue.ShutDown()
+		}
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	tests := []struct {
+		name     string
+		lockType string
+	}{
+		{
+			name:     "configmaps lock",
+			lockType: rl.ConfigMapsResourceLock,
+		},
+		{
+			name:     "endpoints lock",
+			lockType: rl.EndpointsResourceLock,
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "", nil))
+		provisioner := newTestProvisioner()
+		stopCh := make(chan struct{})
+		identities := map[string]bool{}
+		var ctrl *ProvisionController
+		for i := 0; i < 3; i++ {
+			ctrl = NewProvisionController(client, resyncPeriod, "foo.bar/baz", provisioner, "v1.5.0", threadiness, failedRetryThreshold, leaderelection.DefaultLeaseDuration, leaderelection.DefaultRenewDeadline, leaderelection.DefaultRetryPeriod, 0, LeaderElection(test.lockType, "default", "foo.bar-baz"))
+			ctrl.createProvisionedPVInterval = 10 * time.Millisecond
+			identities[string(ctrl.identity)] = true
+			go ctrl.Run(stopCh)
+		}
+
+		time.Sleep(5 * resyncPeriod)
+
+		if len(provisioner.provisionCalls) != 1 {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected provision calls:\n %v\n but got:\n %v\n", 1, len(provisioner.provisionCalls))
+		}
+		record, err := ctrl.leaderElectionLock.Get()
+		if err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error getting leader election record: %v", err)
+		} else if !identities[record.HolderIdentity] {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected a controller to hold the lock but got holder %q", record.HolderIdentity)
+		}
+		close(stopCh)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	volume := newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"})
+	client := fake.NewSimpleClientset(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "", nil), volume)
+	provisioner := newTestProvisioner()
+	ctrl := newTestProvisionController(client, resyncPeriod, "foo.bar/baz", provisioner, "v1.5.0", threadiness, failedRetryThreshold, DryRun(true))
+	stopCh := make(chan struct{})
+	go ctrl.Run(stopCh)
+
+	time.Sleep(3 * resyncPeriod)
+	close(stopCh)
+
+	if len(provisioner.provisionCalls) != 0 {
+		t.Errorf("expected no provision calls but got %v", len(provisioner.provisionCalls))
+	}
+	pvList, _ := client.Core().PersistentVolumes().List(v1.ListOptions{})
+	if !reflect.DeepEqual([]v1.PersistentVolume{*volume}, pvList.Items) {
+		t.Errorf("expected PVs:\n %v\n but got:\n %v\n", []v1.PersistentVolume{*volume}, pvList.Items)
+	}
+	claim, _ := client.Core().PersistentVolumeClaims("default").Get("claim-1")
+	if _, ok := claim.Annotations[rl.LeaderElectionRecordAnnotationKey]; ok {
+		t.Errorf("expected no leader election record on claim but got %v", claim.Annotations)
+	}
+}
+
+func TestShutDown(t *testing.T) {
+	client := fake.NewSimpleClientset(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "", nil))
+	provisioner := newTestProvisioner()
+	ctrl := newTestProvisionController(client, resyncPeriod, "foo.bar/baz", provisioner, "v1.5.0", threadiness, failedRetryThreshold)
+	stopCh := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		ctrl.Run(stopCh)
+		close(stopped)
+	}()
+
+	// Stop the controller while Provision is in flight
+	select {
+	case <-provisioner.provisionCalls:
+	case <-time.After(3 * resyncPeriod):
+		t.Fatalf("expected a provision call")
+	}
+	close(stopCh)
+
+	select {
+	case <-stopped:
+	case <-time.After(DefaultShutdownTimeout):
+		t.Fatalf("expected Run to return after being stopped")
+	}
+
+	if _, err := client.Core().PersistentVolumes().Get("pvc-uid-1-1"); err != nil {
+		t.Errorf("expected the in-flight provision to finish but got error getting its PV: %v", err)
+	}
+}
+
+func TestFailedRetryThreshold(t *testing.T) {
+	client := fake.NewSimpleClientset(newStorageClass("class-1", "foo.bar/baz"), newClaim("claim-1", "uid-1-1", "class-1", "", nil))
+	provisioner := &badTestProvisioner{}
+	ctrl := newTestProvisionController(client, resyncPeriod, "foo.bar/baz", provisioner, "v1.5.0", threadiness, 2)
+	stopCh := make(chan struct{})
+	go ctrl.Run(stopCh)
+
+	// Resyncs don't retry the claim once it has exceeded the threshold
+	time.Sleep(10 * resyncPeriod)
+	if calls := atomic.LoadInt32(&provisioner.provisionCalls); calls != 3 {
+		t.Errorf("expected %v provision calls but got %v", 3, calls)
+	}
+
+	// Updating the claim does
+	claim, _ := client.Core().PersistentVolumeClaims("default").Get("claim-1")
+	claim.Labels = map[string]string{"foo": "bar"}
+	// The fake client doesn't bump ResourceVersion like the API server would
+	claim.ResourceVersion = "2"
+	client.Core().PersistentVolumeClaims("default").Update(claim)
+	time.Sleep(10 * resyncPeriod)
+	close(stopCh)
+	if calls := atomic.LoadInt32(&provisioner.provisionCalls); calls != 6 {
+		t.Errorf("expected %v provision calls after update but got %v", 6, calls)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	tests := []struct {
+		name        string
+		claim       *v1.PersistentVolumeClaim
+		volume      *v1.PersistentVolume
+		provisioner Provisioner
+		expected    metricValues
+	}{
+		{
+			name:        "provision succeeds",
+			claim:       newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			provisioner: newTestProvisioner(),
+			expected:    metricValues{provisionSuccess: 1, provisionDurations: 1},
+		},
+		{
+			name:        "provision fails",
+			claim:       newClaim("claim-1", "uid-1-1", "class-1", "", nil),
+			provisioner: newBadTestProvisioner(),
+			expected:    metricValues{provisionFailure: 1, claimRetries: 1},
+		},
+		{
+			name:        "delete succeeds",
+			volume:      newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", annClass: "class-1"}),
+			provisioner: newTestProvisioner(),
+			expected:    metricValues{deleteSuccess: 1, deleteDurations: 1},
+		},
+		{
+			name:        "delete fails",
+			volume:      newVolume("volume-1", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", annClass: "class-1"}),
+			provisioner: newBadTestProvisioner(),
+			expected:    metricValues{deleteFailure: 1, volumeRetries: 1},
+		},
+	}
+	for _, test := range tests {
+		storageClass := newStorageClass("class-1", "foo.bar/baz")
+		client := fake.NewSimpleClientset(storageClass)
+		// As the elected leader of all the controllers, the controller
+		// provisions in the claim's worker rather than in a per-claim election
+		ctrl := newTestProvisionController(client, resyncPeriod, "foo.bar/baz", test.provisioner, "v1.5.0", threadiness, failedRetryThreshold, LeaderElection(rl.ConfigMapsResourceLock, "default", "foo.bar-baz"))
+		ctrl.classes.Add(storageClass)
+
+		before := getMetricValues("class-1")
+		if test.claim != nil {
+			client.Core().PersistentVolumeClaims(test.claim.Namespace).Create(test.claim)
+			ctrl.claims.Add(test.claim)
+			ctrl.claimQueue.Add(claimToClaimKey(test.claim))
+			ctrl.processNextClaimWorkItem()
+		}
+		if test.volume != nil {
+			client.Core().PersistentVolumes().Create(test.volume)
+			ctrl.volumes.Add(test.volume)
+			ctrl.volumeQueue.Add(test.volume.Name)
+			ctrl.processNextVolumeWorkItem()
+		}
+		after := getMetricValues("class-1")
+
+		if got := after.minus(before); !reflect.DeepEqual(test.expected, got) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected metrics to change by %+v but got %+v", test.expected, got)
 		}
 	}
+
+	// A per-claim election is in flight as soon as it starts
+	claim := newClaim("claim-1", "uid-1-1", "class-1", "", nil)
+	client := fake.NewSimpleClientset(newStorageClass("class-1", "foo.bar/baz"), claim)
+	ctrl := newTestProvisionController(client, resyncPeriod, "foo.bar/baz", newTestProvisioner(), "v1.5.0", threadiness, failedRetryThreshold)
+	before := readMetric(metrics.LeaderElectionsInFlight).GetGauge().GetValue()
+	if err := ctrl.lockProvisionClaimOperation(claim); err != nil {
+		t.Fatalf("Error starting election: %v", err)
+	}
+	if after := readMetric(metrics.LeaderElectionsInFlight).GetGauge().GetValue(); after != before+1 {
+		t.Errorf("expected %v leader elections in flight but got %v", before+1, after)
+	}
 }
 
 func TestShouldProvision(t *testing.T) {
@@ -329,7 +628,7 @@ func TestShouldProvision(t *testing.T) {
 	for _, test := range tests {
 		client := fake.NewSimpleClientset(test.claim)
 		provisioner := newTestProvisioner()
-		ctrl := newTestProvisionController(client, resyncPeriod, test.provisionerName, provisioner, "v1.5.0", false, failedRetryThreshold)
+		ctrl := newTestProvisionController(client, resyncPeriod, test.provisionerName, provisioner, "v1.5.0", threadiness, failedRetryThreshold)
 
 		err := ctrl.classes.Add(test.class)
 		if err != nil {
@@ -399,7 +698,7 @@ func TestShouldDelete(t *testing.T) {
 	for _, test := range tests {
 		client := fake.NewSimpleClientset()
 		provisioner := newTestProvisioner()
-		ctrl := newTestProvisionController(client, resyncPeriod, test.provisionerName, provisioner, test.serverGitVersion, false, failedRetryThreshold)
+		ctrl := newTestProvisionController(client, resyncPeriod, test.provisionerName, provisioner, test.serverGitVersion, threadiness, failedRetryThreshold)
 
 		should := ctrl.shouldDelete(test.volume)
 		if test.expectedShould != should {
@@ -409,6 +708,270 @@ func TestShouldDelete(t *testing.T) {
 	}
 }
 
+func TestGetReclaimPolicy(t *testing.T) {
+	tests := []struct {
+		name                  string
+		reclaimPolicy         v1.PersistentVolumeReclaimPolicy
+		parameters            map[string]string
+		expectedReclaimPolicy v1.PersistentVolumeReclaimPolicy
+		expectedParameters    map[string]string
+		expectError           bool
+	}{
+		{
+			name:                  "no parameter",
+			parameters:            map[string]string{"foo": "bar"},
+			expectedReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			expectedParameters:    map[string]string{"foo": "bar"},
+		},
+		{
+			name:                  "retain parameter",
+			parameters:            map[string]string{"foo": "bar", "reclaimPolicy": "Retain"},
+			expectedReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			expectedParameters:    map[string]string{"foo": "bar"},
+		},
+		{
+			name:                  "delete parameter, different case",
+			parameters:            map[string]string{"reclaimpolicy": "Delete"},
+			expectedReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+			expectedParameters:    map[string]string{},
+		},
+		{
+			name:        "recycle parameter",
+			parameters:  map[string]string{"reclaimPolicy": "Recycle"},
+			expectError: true,
+		},
+		{
+			name:        "bad parameter",
+			parameters:  map[string]string{"reclaimPolicy": "foo"},
+			expectError: true,
+		},
+		{
+			name:                  "override no parameter",
+			reclaimPolicy:         v1.PersistentVolumeReclaimRetain,
+			parameters:            map[string]string{},
+			expectedReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			expectedParameters:    map[string]string{},
+		},
+		{
+			name:                  "override delete parameter",
+			reclaimPolicy:         v1.PersistentVolumeReclaimRetain,
+			parameters:            map[string]string{"reclaimPolicy": "Delete"},
+			expectedReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			expectedParameters:    map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		provisioner := newTestProvisioner()
+		ctrl := newTestProvisionController(client, resyncPeriod, "foo.bar/baz", provisioner, "v1.5.0", threadiness, failedRetryThreshold)
+		ctrl.reclaimPolicy = test.reclaimPolicy
+
+		class := newStorageClass("class-1", "foo.bar/baz")
+		class.Parameters = test.parameters
+
+		reclaimPolicy, parameters, err := ctrl.getReclaimPolicy(class)
+		if test.expectError != (err != nil) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected error %v but got %v\n", test.expectError, err)
+			continue
+		}
+		if test.expectedReclaimPolicy != reclaimPolicy {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected reclaim policy %v but got %v\n", test.expectedReclaimPolicy, reclaimPolicy)
+		}
+		if !reflect.DeepEqual(test.expectedParameters, parameters) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected parameters %v but got %v\n", test.expectedParameters, parameters)
+		}
+	}
+}
+
+func TestGetMountOptions(t *testing.T) {
+	tests := []struct {
+		name                 string
+		parameters           map[string]string
+		expectedMountOptions []string
+		expectedParameters   map[string]string
+		expectError          bool
+	}{
+		{
+			name:                 "no parameter",
+			parameters:           map[string]string{"foo": "bar"},
+			expectedMountOptions: nil,
+			expectedParameters:   map[string]string{"foo": "bar"},
+		},
+		{
+			name:                 "parameter",
+			parameters:           map[string]string{"foo": "bar", "mountOptions": "hard, nfsvers=4.1,rsize=1048576,noatime"},
+			expectedMountOptions: []string{"hard", "nfsvers=4.1", "rsize=1048576", "noatime"},
+			expectedParameters:   map[string]string{"foo": "bar"},
+		},
+		{
+			name:                 "parameter, different case",
+			parameters:           map[string]string{"mountoptions": "ro"},
+			expectedMountOptions: []string{"ro"},
+			expectedParameters:   map[string]string{},
+		},
+		{
+			name:        "empty option",
+			parameters:  map[string]string{"mountOptions": "hard,,noatime"},
+			expectError: true,
+		},
+		{
+			name:        "option with whitespace",
+			parameters:  map[string]string{"mountOptions": "context=a b"},
+			expectError: true,
+		},
+		{
+			name:        "option without value",
+			parameters:  map[string]string{"mountOptions": "nfsvers="},
+			expectError: true,
+		},
+		{
+			name:        "option given twice",
+			parameters:  map[string]string{"mountOptions": "nfsvers=3,nfsvers=4"},
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		mountOptions, parameters, err := getMountOptions(test.parameters)
+		if test.expectError != (err != nil) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected error %v but got %v\n", test.expectError, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.expectedMountOptions, mountOptions) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected mount options %v but got %v\n", test.expectedMountOptions, mountOptions)
+		}
+		if !reflect.DeepEqual(test.expectedParameters, parameters) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected parameters %v but got %v\n", test.expectedParameters, parameters)
+		}
+	}
+}
+
+func TestShouldResize(t *testing.T) {
+	tests := []struct {
+		name           string
+		provisioner    Provisioner
+		claim          *v1.PersistentVolumeClaim
+		volume         *v1.PersistentVolume
+		expectedShould bool
+	}{
+		{
+			name:           "should resize",
+			provisioner:    newResizingTestProvisioner(),
+			claim:          newBoundClaim("claim-1", "1-1", "class-1", "volume-1", "2Mi"),
+			volume:         newBoundVolume("volume-1", "foo.bar/baz", newBoundClaim("claim-1", "1-1", "class-1", "volume-1", "2Mi"), "1Mi"),
+			expectedShould: true,
+		},
+		{
+			name:           "provisioner isn't a resizer",
+			provisioner:    newTestProvisioner(),
+			claim:          newBoundClaim("claim-1", "1-1", "class-1", "volume-1", "2Mi"),
+			volume:         newBoundVolume("volume-1", "foo.bar/baz", newBoundClaim("claim-1", "1-1", "class-1", "volume-1", "2Mi"), "1Mi"),
+			expectedShould: false,
+		},
+		{
+			name:           "capacity already big enough",
+			provisioner:    newResizingTestProvisioner(),
+			claim:          newBoundClaim("claim-1", "1-1", "class-1", "volume-1", "1Mi"),
+			volume:         newBoundVolume("volume-1", "foo.bar/baz", newBoundClaim("claim-1", "1-1", "class-1", "volume-1", "1Mi"), "1Mi"),
+			expectedShould: false,
+		},
+		{
+			name:           "claim not bound",
+			provisioner:    newResizingTestProvisioner(),
+			claim:          newClaim("claim-1", "1-1", "class-1", "", nil),
+			volume:         newBoundVolume("volume-1", "foo.bar/baz", newBoundClaim("claim-1", "1-1", "class-1", "volume-1", "2Mi"), "1Mi"),
+			expectedShould: false,
+		},
+		{
+			name:           "volume bound to another claim",
+			provisioner:    newResizingTestProvisioner(),
+			claim:          newBoundClaim("claim-1", "1-1", "class-1", "volume-1", "2Mi"),
+			volume:         newBoundVolume("volume-1", "foo.bar/baz", newBoundClaim("claim-2", "1-2", "class-1", "volume-1", "2Mi"), "1Mi"),
+			expectedShould: false,
+		},
+		{
+			name:           "not this provisioner's job",
+			provisioner:    newResizingTestProvisioner(),
+			claim:          newBoundClaim("claim-1", "1-1", "class-1", "volume-1", "2Mi"),
+			volume:         newBoundVolume("volume-1", "abc.def/ghi", newBoundClaim("claim-1", "1-1", "class-1", "volume-1", "2Mi"), "1Mi"),
+			expectedShould: false,
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		ctrl := newTestProvisionController(client, resyncPeriod, "foo.bar/baz", test.provisioner, "v1.5.0", threadiness, failedRetryThreshold)
+
+		err := ctrl.volumes.Add(test.volume)
+		if err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("error adding volume %v to cache: %v", test.volume, err)
+		}
+
+		_, should := ctrl.shouldResize(test.claim)
+		if test.expectedShould != should {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected should resize %v but got %v\n", test.expectedShould, should)
+		}
+	}
+}
+
+func TestShouldSnapshot(t *testing.T) {
+	tests := []struct {
+		name           string
+		provisioner    Provisioner
+		volume         *v1.PersistentVolume
+		expectedName   string
+		expectedShould bool
+	}{
+		{
+			name:           "should snapshot",
+			provisioner:    newSnapshottingTestProvisioner(),
+			volume:         newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", AnnSnapshotRequest: "snap-1"}),
+			expectedName:   "snap-1",
+			expectedShould: true,
+		},
+		{
+			name:           "provisioner isn't a snapshotter",
+			provisioner:    newTestProvisioner(),
+			volume:         newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", AnnSnapshotRequest: "snap-1"}),
+			expectedShould: false,
+		},
+		{
+			name:           "no snapshot requested",
+			provisioner:    newSnapshottingTestProvisioner(),
+			volume:         newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz"}),
+			expectedShould: false,
+		},
+		{
+			name:           "snapshot already taken",
+			provisioner:    newSnapshottingTestProvisioner(),
+			volume:         newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "foo.bar/baz", AnnSnapshotRequest: "snap-1", AnnSnapshots: "snap-0,snap-1"}),
+			expectedShould: false,
+		},
+		{
+			name:           "not this provisioner's job",
+			provisioner:    newSnapshottingTestProvisioner(),
+			volume:         newVolume("volume-1", v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: "abc.def/ghi", AnnSnapshotRequest: "snap-1"}),
+			expectedShould: false,
+		},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		ctrl := newTestProvisionController(client, resyncPeriod, "foo.bar/baz", test.provisioner, "v1.5.0", threadiness, failedRetryThreshold)
+
+		name, should := ctrl.shouldSnapshot(test.volume)
+		if test.expectedShould != should || test.expectedName != name {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected should snapshot %v %q but got %v %q\n", test.expectedShould, test.expectedName, should, name)
+		}
+	}
+}
+
 func TestIsOnlyRecordUpdate(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -444,7 +1007,7 @@ func TestIsOnlyRecordUpdate(t *testing.T) {
 	for _, test := range tests {
 		client := fake.NewSimpleClientset()
 		provisioner := newTestProvisioner()
-		ctrl := newTestProvisionController(client, resyncPeriod, "foo.bar/baz", provisioner, "v1.5.0", false, failedRetryThreshold)
+		ctrl := newTestProvisionController(client, resyncPeriod, "foo.bar/baz", provisioner, "v1.5.0", threadiness, failedRetryThreshold)
 
 		is, _ := ctrl.isOnlyRecordUpdate(test.old, test.new)
 		if test.expectedIs != is {
@@ -460,10 +1023,11 @@ func newTestProvisionController(
 	provisionerName string,
 	provisioner Provisioner,
 	serverGitVersion string,
-	exponentialBackOffOnError bool,
+	threadiness int,
 	failedRetryThreshold int,
+	options ...func(*ProvisionController) error,
 ) *ProvisionController {
-	ctrl := NewProvisionController(client, resyncPeriod, provisionerName, provisioner, serverGitVersion, exponentialBackOffOnError, failedRetryThreshold, 2*resyncPeriod, resyncPeriod, resyncPeriod/2, 2*resyncPeriod)
+	ctrl := NewProvisionController(client, resyncPeriod, provisionerName, provisioner, serverGitVersion, threadiness, failedRetryThreshold, 2*resyncPeriod, resyncPeriod, resyncPeriod/2, 2*resyncPeriod, options...)
 	ctrl.createProvisionedPVInterval = 10 * time.Millisecond
 	return ctrl
 }
@@ -477,6 +1041,12 @@ func newStorageClass(name, provisioner string) *v1beta1.StorageClass {
 	}
 }
 
+func newStorageClassWithParameters(name, provisioner string, parameters map[string]string) *v1beta1.StorageClass {
+	storageClass := newStorageClass(name, provisioner)
+	storageClass.Parameters = parameters
+	return storageClass
+}
+
 func newClaim(name, claimUID, provisioner, volumeName string, annotations map[string]string) *v1.PersistentVolumeClaim {
 	claim := &v1.PersistentVolumeClaim{
 		ObjectMeta: v1.ObjectMeta{
@@ -534,6 +1104,24 @@ func newVolume(name string, phase v1.PersistentVolumePhase, policy v1.Persistent
 	return pv
 }
 
+// newBoundClaim returns a claim bound to the given volume requesting the given
+// capacity
+func newBoundClaim(name, claimUID, provisioner, volumeName, capacity string) *v1.PersistentVolumeClaim {
+	claim := newClaim(name, claimUID, provisioner, volumeName, nil)
+	claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)] = resource.MustParse(capacity)
+	claim.Status.Phase = v1.ClaimBound
+	return claim
+}
+
+// newBoundVolume returns a volume provisioned by the given provisioner bound to
+// the given claim with the given capacity
+func newBoundVolume(name, provisionerName string, claim *v1.PersistentVolumeClaim, capacity string) *v1.PersistentVolume {
+	volume := newVolume(name, v1.VolumeBound, v1.PersistentVolumeReclaimDelete, map[string]string{annDynamicallyProvisioned: provisionerName})
+	volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)] = resource.MustParse(capacity)
+	volume.Spec.ClaimRef, _ = v1.GetReference(claim)
+	return volume
+}
+
 // newProvisionedVolume returns the volume the test controller should provision for the
 // given claim with the given class
 func newProvisionedVolume(storageClass *v1beta1.StorageClass, claim *v1.PersistentVolumeClaim) *v1.PersistentVolume {
@@ -559,6 +1147,57 @@ func newProvisionedVolume(storageClass *v1beta1.StorageClass, claim *v1.Persiste
 	return volume
 }
 
+func newProvisionedVolumeWithMountOptions(storageClass *v1beta1.StorageClass, claim *v1.PersistentVolumeClaim, mountOptions string) *v1.PersistentVolume {
+	volume := newProvisionedVolume(storageClass, claim)
+	volume.Annotations[AnnMountOptions] = mountOptions
+	return volume
+}
+
+// metricValues are the values of the metrics of a class that the controller
+// changes as it provisions and deletes.
+type metricValues struct {
+	provisionSuccess   float64
+	provisionFailure   float64
+	provisionDurations uint64
+	deleteSuccess      float64
+	deleteFailure      float64
+	deleteDurations    uint64
+	claimRetries       float64
+	volumeRetries      float64
+}
+
+func getMetricValues(class string) metricValues {
+	return metricValues{
+		provisionSuccess:   readMetric(metrics.PersistentVolumeClaimProvisionTotal.WithLabelValues(class, metrics.ResultSuccess)).GetCounter().GetValue(),
+		provisionFailure:   readMetric(metrics.PersistentVolumeClaimProvisionTotal.WithLabelValues(class, metrics.ResultFailure)).GetCounter().GetValue(),
+		provisionDurations: readMetric(metrics.PersistentVolumeClaimProvisionDurationSeconds.WithLabelValues(class)).GetHistogram().GetSampleCount(),
+		deleteSuccess:      readMetric(metrics.PersistentVolumeDeleteTotal.WithLabelValues(class, metrics.ResultSuccess)).GetCounter().GetValue(),
+		deleteFailure:      readMetric(metrics.PersistentVolumeDeleteTotal.WithLabelValues(class, metrics.ResultFailure)).GetCounter().GetValue(),
+		deleteDurations:    readMetric(metrics.PersistentVolumeDeleteDurationSeconds.WithLabelValues(class)).GetHistogram().GetSampleCount(),
+		claimRetries:       readMetric(metrics.RetriesTotal.WithLabelValues(metrics.QueueClaims)).GetCounter().GetValue(),
+		volumeRetries:      readMetric(metrics.RetriesTotal.WithLabelValues(metrics.QueueVolumes)).GetCounter().GetValue(),
+	}
+}
+
+func (v metricValues) minus(other metricValues) metricValues {
+	return metricValues{
+		provisionSuccess:   v.provisionSuccess - other.provisionSuccess,
+		provisionFailure:   v.provisionFailure - other.provisionFailure,
+		provisionDurations: v.provisionDurations - other.provisionDurations,
+		deleteSuccess:      v.deleteSuccess - other.deleteSuccess,
+		deleteFailure:      v.deleteFailure - other.deleteFailure,
+		deleteDurations:    v.deleteDurations - other.deleteDurations,
+		claimRetries:       v.claimRetries - other.claimRetries,
+		volumeRetries:      v.volumeRetries - other.volumeRetries,
+	}
+}
+
+func readMetric(metric prometheus.Metric) *dto.Metric {
+	m := &dto.Metric{}
+	metric.Write(m)
+	return m
+}
+
 func newTestProvisioner() *testProvisioner {
 	return &testProvisioner{make(chan bool, 16)}
 }
@@ -606,16 +1245,68 @@ func (p *testProvisioner) Delete(volume *v1.PersistentVolume) error {
 	return nil
 }
 
+func newQualifiedTestProvisioner(answer bool) Provisioner {
+	return &qualifiedTestProvisioner{newTestProvisioner(), answer}
+}
+
+type qualifiedTestProvisioner struct {
+	*testProvisioner
+	answer bool
+}
+
+var _ Provisioner = &qualifiedTestProvisioner{}
+var _ Qualifier = &qualifiedTestProvisioner{}
+
+func (p *qualifiedTestProvisioner) ShouldProvision(options VolumeOptions) bool {
+	return p.answer
+}
+
+func newResizingTestProvisioner() Provisioner {
+	return &resizingTestProvisioner{newTestProvisioner()}
+}
+
+type resizingTestProvisioner struct {
+	*testProvisioner
+}
+
+var _ Provisioner = &resizingTestProvisioner{}
+var _ Resizer = &resizingTestProvisioner{}
+
+func (p *resizingTestProvisioner) Resize(volume *v1.PersistentVolume, capacity resource.Quantity) (*v1.PersistentVolume, error) {
+	newVolume := *volume
+	newVolume.Spec.Capacity = v1.ResourceList{
+		v1.ResourceName(v1.ResourceStorage): capacity,
+	}
+	return &newVolume, nil
+}
+
+func newSnapshottingTestProvisioner() Provisioner {
+	return &snapshottingTestProvisioner{newTestProvisioner()}
+}
+
+type snapshottingTestProvisioner struct {
+	*testProvisioner
+}
+
+var _ Provisioner = &snapshottingTestProvisioner{}
+var _ Snapshotter = &snapshottingTestProvisioner{}
+
+func (p *snapshottingTestProvisioner) Snapshot(volume *v1.PersistentVolume, name string) error {
+	return nil
+}
+
 func newBadTestProvisioner() Provisioner {
 	return &badTestProvisioner{}
 }
 
 type badTestProvisioner struct {
+	provisionCalls int32
 }
 
 var _ Provisioner = &badTestProvisioner{}
 
 func (p *badTestProvisioner) Provision(options VolumeOptions) (*v1.PersistentVolume, error) {
+	atomic.AddInt32(&p.provisionCalls, 1)
 	return nil, errors.New("fake error")
 }
 
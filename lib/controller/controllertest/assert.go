@@ -0,0 +1,125 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	rl "github.com/kubernetes-incubator/external-storage/lib/leaderelection/resourcelock"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/util/wait"
+)
+
+// Timeout is how long the Expect functions wait for the controller, which
+// works in the background, to get the cluster into the expected state.
+var Timeout = 5 * time.Second
+
+// pollInterval is how often the Expect functions check the cluster's state
+const pollInterval = 10 * time.Millisecond
+
+// ExpectVolumes waits for the names of the PVs in the clientset to be exactly
+// the given ones, failing the test if they aren't within Timeout.
+func ExpectVolumes(t *testing.T, client kubernetes.Interface, names ...string) {
+	sort.Strings(names)
+	var got []string
+	err := wait.Poll(pollInterval, Timeout, func() (bool, error) {
+		volumes, err := client.Core().PersistentVolumes().List(v1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		got = []string{}
+		for _, volume := range volumes.Items {
+			got = append(got, volume.Name)
+		}
+		sort.Strings(got)
+		return len(names) == 0 && len(got) == 0 || reflect.DeepEqual(names, got), nil
+	})
+	if err != nil {
+		t.Errorf("expected PVs %v but got %v: %v", names, got, err)
+	}
+}
+
+// ExpectEvents waits for events with each of the given reasons, e.g.
+// "ProvisioningSucceeded", to have been recorded on the named object, failing
+// the test if they haven't been within Timeout. Events on PVs are recorded in
+// the default namespace.
+func ExpectEvents(t *testing.T, client kubernetes.Interface, namespace, name string, reasons ...string) {
+	var got []string
+	err := wait.Poll(pollInterval, Timeout, func() (bool, error) {
+		events, err := client.Core().Events(namespace).List(v1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		got = []string{}
+		found := map[string]bool{}
+		for _, event := range events.Items {
+			if event.InvolvedObject.Name == name {
+				got = append(got, event.Reason)
+				found[event.Reason] = true
+			}
+		}
+		for _, reason := range reasons {
+			if !found[reason] {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		t.Errorf("expected events with reasons %v on %s/%s but got %v: %v", reasons, namespace, name, got, err)
+	}
+}
+
+// GetClaimLeaderRecord returns the leader election record the controllers
+// racing to provision for the named claim wrote on it, or nil if there is none.
+func GetClaimLeaderRecord(client kubernetes.Interface, namespace, name string) (*rl.LeaderElectionRecord, error) {
+	claim, err := client.Core().PersistentVolumeClaims(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	recordBytes, ok := claim.Annotations[rl.LeaderElectionRecordAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	var record rl.LeaderElectionRecord
+	if err := json.Unmarshal([]byte(recordBytes), &record); err != nil {
+		return nil, fmt.Errorf("error unmarshalling leader election record %q: %v", recordBytes, err)
+	}
+	return &record, nil
+}
+
+// ExpectClaimLeaderRecord waits for the named claim to have a leader election
+// record, failing the test if it doesn't within Timeout. It returns the record,
+// or nil if there is none.
+func ExpectClaimLeaderRecord(t *testing.T, client kubernetes.Interface, namespace, name string) *rl.LeaderElectionRecord {
+	var record *rl.LeaderElectionRecord
+	err := wait.Poll(pollInterval, Timeout, func() (bool, error) {
+		var err error
+		record, err = GetClaimLeaderRecord(client, namespace, name)
+		return record != nil, err
+	})
+	if err != nil {
+		t.Errorf("expected a leader election record on claim %s/%s: %v", namespace, name, err)
+	}
+	return record
+}
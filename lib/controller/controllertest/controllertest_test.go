@@ -0,0 +1,92 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllertest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const resyncPeriod = 100 * time.Millisecond
+
+func newController(client kubernetes.Interface, provisioner controller.Provisioner) *controller.ProvisionController {
+	return controller.NewProvisionController(client, resyncPeriod, "foo.bar/baz", provisioner, "v1.5.0", 2, 5, 2*resyncPeriod, resyncPeriod, resyncPeriod/2, 2*resyncPeriod)
+}
+
+func TestProvision(t *testing.T) {
+	tests := []struct {
+		name             string
+		provisionErrs    []error
+		expectedReasons  []string
+		expectedVolumes  []string
+		expectedAttempts int
+	}{
+		{
+			name:             "provision",
+			expectedReasons:  []string{"ProvisioningSucceeded"},
+			expectedVolumes:  []string{"pvc-uid-1"},
+			expectedAttempts: 1,
+		},
+		{
+			name:             "provision after failure",
+			provisionErrs:    []error{errors.New("fake error")},
+			expectedReasons:  []string{"ProvisioningFailed", "ProvisioningSucceeded"},
+			expectedVolumes:  []string{"pvc-uid-1"},
+			expectedAttempts: 2,
+		},
+	}
+	for _, test := range tests {
+		client := NewClientset(NewStorageClass("class-1", "foo.bar/baz", nil), NewClaim("claim-1", "uid-1", "class-1", "1Mi"))
+		provisioner := NewProvisioner()
+		provisioner.FailProvision("pvc-uid-1", test.provisionErrs...)
+		stopCh := make(chan struct{})
+		go newController(client, provisioner).Run(stopCh)
+
+		t.Logf("test case: %s", test.name)
+		ExpectVolumes(t, client, test.expectedVolumes...)
+		ExpectEvents(t, client, v1.NamespaceDefault, "claim-1", test.expectedReasons...)
+		if record := ExpectClaimLeaderRecord(t, client, v1.NamespaceDefault, "claim-1"); record != nil && record.HolderIdentity == "" {
+			t.Errorf("expected a holder of the claim's lock")
+		}
+		if len(provisioner.ProvisionCalls()) != test.expectedAttempts {
+			t.Errorf("expected %d provision calls but got %d", test.expectedAttempts, len(provisioner.ProvisionCalls()))
+		}
+		close(stopCh)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	claim := NewClaim("claim-1", "uid-1", "class-1", "1Mi")
+	client := NewClientset(NewStorageClass("class-1", "foo.bar/baz", nil), NewVolume("foo.bar/baz", claim, v1.VolumeReleased, v1.PersistentVolumeReclaimDelete))
+	provisioner := NewProvisioner()
+	provisioner.SetDelay(10 * time.Millisecond)
+	provisioner.FailDelete("pvc-uid-1", errors.New("fake error"))
+	stopCh := make(chan struct{})
+	go newController(client, provisioner).Run(stopCh)
+
+	ExpectVolumes(t, client)
+	ExpectEvents(t, client, v1.NamespaceDefault, "pvc-uid-1", "VolumeFailedDelete")
+	if len(provisioner.DeleteCalls()) != 2 {
+		t.Errorf("expected %d delete calls but got %d", 2, len(provisioner.DeleteCalls()))
+	}
+	close(stopCh)
+}
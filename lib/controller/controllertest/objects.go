@@ -0,0 +1,120 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllertest
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/resource"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/storage/v1beta1"
+	"k8s.io/client-go/pkg/runtime"
+	"k8s.io/client-go/pkg/types"
+)
+
+// The annotations the controller reads & writes, see controller.go
+const (
+	annClass                  = "volume.beta.kubernetes.io/storage-class"
+	annDynamicallyProvisioned = "pv.kubernetes.io/provisioned-by"
+)
+
+// NewClientset returns a fake clientset seeded with the given objects, e.g.
+// those returned by NewStorageClass, NewClaim and NewVolume.
+func NewClientset(objects ...runtime.Object) *fake.Clientset {
+	return fake.NewSimpleClientset(objects...)
+}
+
+// NewStorageClass returns a StorageClass with the given name, provisioner and
+// parameters.
+func NewStorageClass(name, provisioner string, parameters map[string]string) *v1beta1.StorageClass {
+	return &v1beta1.StorageClass{
+		ObjectMeta: v1.ObjectMeta{
+			Name: name,
+		},
+		Provisioner: provisioner,
+		Parameters:  parameters,
+	}
+}
+
+// NewClaim returns a pending claim in the default namespace with the given
+// name and UID for a volume of the given class and capacity, e.g. "1Mi". The
+// controller names the volume it provisions for it "pvc-<uid>".
+func NewClaim(name, uid, class, capacity string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{
+			Name:            name,
+			Namespace:       v1.NamespaceDefault,
+			UID:             types.UID(uid),
+			ResourceVersion: "0",
+			Annotations:     map[string]string{annClass: class},
+			SelfLink:        fmt.Sprintf("/api/v1/namespaces/%s/persistentvolumeclaims/%s", v1.NamespaceDefault, name),
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceName(v1.ResourceStorage): resource.MustParse(capacity),
+				},
+			},
+		},
+		Status: v1.PersistentVolumeClaimStatus{
+			Phase: v1.ClaimPending,
+		},
+	}
+}
+
+// NewVolume returns a volume dynamically provisioned by the named provisioner
+// for the given claim, in the given phase and with the given reclaim policy.
+// A Released volume with policy Delete is one the controller should delete.
+func NewVolume(provisionerName string, claim *v1.PersistentVolumeClaim, phase v1.PersistentVolumePhase, policy v1.PersistentVolumeReclaimPolicy) *v1.PersistentVolume {
+	name := "pvc-" + string(claim.UID)
+	return &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Name:            name,
+			ResourceVersion: "0",
+			Annotations: map[string]string{
+				annDynamicallyProvisioned: provisionerName,
+				annClass:                  claim.Annotations[annClass],
+			},
+			SelfLink: "/api/v1/persistentvolumes/" + name,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: policy,
+			AccessModes:                   claim.Spec.AccessModes,
+			Capacity: v1.ResourceList{
+				v1.ResourceName(v1.ResourceStorage): claim.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
+			},
+			ClaimRef: &v1.ObjectReference{
+				Kind:      "PersistentVolumeClaim",
+				Namespace: claim.Namespace,
+				Name:      claim.Name,
+				UID:       claim.UID,
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{
+					Server:   "foo",
+					Path:     "bar",
+					ReadOnly: false,
+				},
+			},
+		},
+		Status: v1.PersistentVolumeStatus{
+			Phase: phase,
+		},
+	}
+}
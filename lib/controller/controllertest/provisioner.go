@@ -0,0 +1,149 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package controllertest contains a fake Provisioner and helpers for testing a
+// ProvisionController, or a provisioner with one, against a fake clientset.
+package controllertest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Provisioner is a controller.Provisioner that records its calls and whose
+// delays and failures can be scripted. By default Provision returns an NFS PV
+// satisfying the options it's given and Delete succeeds. It is safe for use by
+// multiple controllers at once.
+type Provisioner struct {
+	mutex sync.Mutex
+
+	delay          time.Duration
+	provisionErrs  map[string][]error
+	deleteErrs     map[string][]error
+	provisionCalls []controller.VolumeOptions
+	deleteCalls    []*v1.PersistentVolume
+}
+
+var _ controller.Provisioner = &Provisioner{}
+
+// NewProvisioner creates a Provisioner that succeeds at everything at once.
+func NewProvisioner() *Provisioner {
+	return &Provisioner{
+		provisionErrs: map[string][]error{},
+		deleteErrs:    map[string][]error{},
+	}
+}
+
+// SetDelay makes every subsequent Provision and Delete call take the given
+// duration before returning.
+func (p *Provisioner) SetDelay(delay time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.delay = delay
+}
+
+// FailProvision makes the next Provision calls for the PV with the given name
+// return the given errors, one per call and in order. Later calls succeed.
+func (p *Provisioner) FailProvision(pvName string, errs ...error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.provisionErrs[pvName] = append(p.provisionErrs[pvName], errs...)
+}
+
+// FailDelete makes the next Delete calls for the PV with the given name return
+// the given errors, one per call and in order. Later calls succeed.
+func (p *Provisioner) FailDelete(pvName string, errs ...error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.deleteErrs[pvName] = append(p.deleteErrs[pvName], errs...)
+}
+
+// ProvisionCalls returns the options of every Provision call so far.
+func (p *Provisioner) ProvisionCalls() []controller.VolumeOptions {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]controller.VolumeOptions{}, p.provisionCalls...)
+}
+
+// DeleteCalls returns the volume of every Delete call so far.
+func (p *Provisioner) DeleteCalls() []*v1.PersistentVolume {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]*v1.PersistentVolume{}, p.deleteCalls...)
+}
+
+// Provision records the call and, after any delay, returns either the next
+// scripted error for options.PVName or a PV.
+func (p *Provisioner) Provision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
+	p.mutex.Lock()
+	p.provisionCalls = append(p.provisionCalls, options)
+	delay := p.delay
+	err := popError(p.provisionErrs, options.PVName)
+	p.mutex.Unlock()
+
+	time.Sleep(delay)
+	if err != nil {
+		return nil, err
+	}
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Name: options.PVName,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: options.PersistentVolumeReclaimPolicy,
+			AccessModes:                   options.PVC.Spec.AccessModes,
+			Capacity: v1.ResourceList{
+				v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{
+					Server:   "foo",
+					Path:     "bar",
+					ReadOnly: false,
+				},
+			},
+		},
+	}
+
+	return pv, nil
+}
+
+// Delete records the call and, after any delay, returns the next scripted
+// error for the volume, if any.
+func (p *Provisioner) Delete(volume *v1.PersistentVolume) error {
+	p.mutex.Lock()
+	p.deleteCalls = append(p.deleteCalls, volume)
+	delay := p.delay
+	err := popError(p.deleteErrs, volume.Name)
+	p.mutex.Unlock()
+
+	time.Sleep(delay)
+	return err
+}
+
+// popError removes and returns the first of the errors for the given name.
+func popError(errs map[string][]error, name string) error {
+	if len(errs[name]) == 0 {
+		return nil
+	}
+	err := errs[name][0]
+	errs[name] = errs[name][1:]
+	return err
+}
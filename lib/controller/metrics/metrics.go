@@ -0,0 +1,133 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics contains the Prometheus metrics the provision controller
+// reports about its work and a way of exposing them over HTTP.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// ControllerSubsystem is the subsystem of all the controller's metrics
+	ControllerSubsystem = "controller"
+
+	// DefaultPath is the path metrics are exposed at by Serve
+	DefaultPath = "/metrics"
+
+	// ResultSuccess is the result label value of a successful operation
+	ResultSuccess = "success"
+	// ResultFailure is the result label value of a failed operation
+	ResultFailure = "failure"
+
+	// QueueClaims is the queue label value of the claim work queue
+	QueueClaims = "claims"
+	// QueueVolumes is the queue label value of the volume work queue
+	QueueVolumes = "volumes"
+)
+
+var (
+	// PersistentVolumeClaimProvisionTotal is used to collect accumulated count
+	// of persistent volume provision attempts, by class and result.
+	PersistentVolumeClaimProvisionTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: ControllerSubsystem,
+			Name:      "persistentvolumeclaim_provision_total",
+			Help:      "Total number of persistent volume provision attempts. Broken down by storage class name and result.",
+		},
+		[]string{"class", "result"},
+	)
+	// PersistentVolumeClaimProvisionDurationSeconds is used to collect latency
+	// in seconds of successful provision operations, by class.
+	PersistentVolumeClaimProvisionDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Subsystem: ControllerSubsystem,
+			Name:      "persistentvolumeclaim_provision_duration_seconds",
+			Help:      "Latency in seconds to provision persistent volumes. Broken down by storage class name.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"class"},
+	)
+	// PersistentVolumeDeleteTotal is used to collect accumulated count of
+	// persistent volume delete attempts, by class and result.
+	PersistentVolumeDeleteTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: ControllerSubsystem,
+			Name:      "persistentvolume_delete_total",
+			Help:      "Total number of persistent volume delete attempts. Broken down by storage class name and result.",
+		},
+		[]string{"class", "result"},
+	)
+	// PersistentVolumeDeleteDurationSeconds is used to collect latency in
+	// seconds of successful delete operations, by class.
+	PersistentVolumeDeleteDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Subsystem: ControllerSubsystem,
+			Name:      "persistentvolume_delete_duration_seconds",
+			Help:      "Latency in seconds to delete persistent volumes. Broken down by storage class name.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"class"},
+	)
+	// LeaderElectionsInFlight is used to report the number of per-claim leader
+	// elections the controller is currently taking part in.
+	LeaderElectionsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: ControllerSubsystem,
+			Name:      "leader_elections_in_flight",
+			Help:      "Number of per-claim leader elections the controller is taking part in.",
+		},
+	)
+	// RetriesTotal is used to collect accumulated count of failed claims and
+	// volumes re-queued to be retried, by queue.
+	RetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: ControllerSubsystem,
+			Name:      "retries_total",
+			Help:      "Total number of claims and volumes re-queued after a failure. Broken down by work queue.",
+		},
+		[]string{"queue"},
+	)
+)
+
+var registerMetrics sync.Once
+
+// Register registers the controller's metrics with the default Prometheus
+// registry. It is safe to call more than once.
+func Register() {
+	registerMetrics.Do(func() {
+		prometheus.MustRegister(PersistentVolumeClaimProvisionTotal)
+		prometheus.MustRegister(PersistentVolumeClaimProvisionDurationSeconds)
+		prometheus.MustRegister(PersistentVolumeDeleteTotal)
+		prometheus.MustRegister(PersistentVolumeDeleteDurationSeconds)
+		prometheus.MustRegister(LeaderElectionsInFlight)
+		prometheus.MustRegister(RetriesTotal)
+	})
+}
+
+// Serve listens on the given address and serves the metrics registered with
+// the default Prometheus registry at the given path. It blocks until the
+// listener fails.
+func Serve(address, path string) error {
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.Handler())
+	return http.ListenAndServe(address, mux)
+}
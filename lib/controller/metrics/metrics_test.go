@@ -0,0 +1,57 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRegister(t *testing.T) {
+	// Registering again must not panic on the duplicate collectors
+	Register()
+	Register()
+
+	PersistentVolumeClaimProvisionTotal.WithLabelValues("class-1", ResultSuccess).Inc()
+	PersistentVolumeClaimProvisionDurationSeconds.WithLabelValues("class-1").Observe(1)
+	PersistentVolumeDeleteTotal.WithLabelValues("class-1", ResultFailure).Inc()
+	PersistentVolumeDeleteDurationSeconds.WithLabelValues("class-1").Observe(1)
+	LeaderElectionsInFlight.Set(1)
+	RetriesTotal.WithLabelValues(QueueClaims).Inc()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Error gathering metrics: %v", err)
+	}
+	gathered := map[string]bool{}
+	for _, family := range families {
+		gathered[family.GetName()] = true
+	}
+	for _, name := range []string{
+		"controller_persistentvolumeclaim_provision_total",
+		"controller_persistentvolumeclaim_provision_duration_seconds",
+		"controller_persistentvolume_delete_total",
+		"controller_persistentvolume_delete_duration_seconds",
+		"controller_leader_elections_in_flight",
+		"controller_retries_total",
+	} {
+		if !gathered[name] {
+			t.Errorf("expected metric %s to be registered but it isn't", name)
+		}
+	}
+}
@@ -19,6 +19,7 @@ package controller
 import (
 	"fmt"
 
+	"k8s.io/client-go/pkg/api/resource"
 	"k8s.io/client-go/pkg/api/v1"
 )
 
@@ -29,6 +30,9 @@ import (
 type Provisioner interface {
 	// Provision creates a volume i.e. the storage asset and returns a PV object
 	// for the volume
+	//
+	// May return IgnoredError to indicate that the call has been ignored and no
+	// action taken, e.g. because the claim's selector can't be satisfied.
 	Provision(VolumeOptions) (*v1.PersistentVolume, error)
 	// Delete removes the storage asset that was created by Provision backing the
 	// given PV. Does not delete the PV object itself.
@@ -38,11 +42,75 @@ type Provisioner interface {
 	Delete(*v1.PersistentVolume) error
 }
 
-// IgnoredError is the value for Delete to return to indicate that the call has
-// been ignored and no action taken. In case multiple provisioners are serving
-// the same storage class, provisioners may ignore PVs they are not responsible
-// for (e.g. ones they didn't create). The controller will act accordingly,
-// i.e. it won't emit a misleading VolumeFailedDelete event.
+// Qualifier is an optional interface implemented by provisioners to determine
+// whether they can provision a volume for a claim before the controller takes
+// part in the claim's leader election. In case multiple controllers are serving
+// the same claims, only the ones whose provisioners qualify contend to lead
+// it, so it isn't stalled by a leader that was always going to fail.
+type Qualifier interface {
+	// ShouldProvision returns whether Provision should be attempted with the
+	// given options. It should be cheap: it is called every time the claim is
+	// processed until a volume is provisioned for it.
+	ShouldProvision(VolumeOptions) bool
+}
+
+// Resizer is an optional interface implemented by provisioners that can expand
+// the volumes they provisioned while they are bound. The controller calls
+// Resize when a bound claim requests more storage than its volume's capacity.
+type Resizer interface {
+	// Resize expands the storage asset backing the given PV to the given
+	// capacity and returns a copy of the PV with its capacity and whatever
+	// else changed updated, for the controller to save. Does not modify the
+	// given PV. May be called again for the same capacity if saving fails.
+	//
+	// May return IgnoredError to indicate that the call has been ignored and no
+	// action taken.
+	Resize(volume *v1.PersistentVolume, capacity resource.Quantity) (*v1.PersistentVolume, error)
+}
+
+// Snapshotter is an optional interface implemented by provisioners that can
+// take point-in-time copies of the volumes they provisioned. The controller
+// calls Snapshot when a PV is annotated with AnnSnapshotRequest and, on
+// success, records the snapshot in the PV's AnnSnapshots annotation.
+// Provisioning a volume populated from a snapshot named by a claim's
+// AnnSnapshotSource annotation is up to the provisioner.
+type Snapshotter interface {
+	// Snapshot takes a snapshot with the given name of the storage asset
+	// backing the given PV. May be called again with the same name if
+	// recording the snapshot fails.
+	//
+	// May return IgnoredError to indicate that the call has been ignored and no
+	// action taken.
+	Snapshot(volume *v1.PersistentVolume, name string) error
+}
+
+const (
+	// AnnSnapshotRequest is the annotation on a PV requesting that a snapshot
+	// named the annotation's value be taken of it. The controller removes it
+	// once the snapshot is taken.
+	AnnSnapshotRequest = "snapshot.external-storage.kubernetes.io/request"
+
+	// AnnSnapshots is the annotation on a PV listing, comma separated, the names
+	// of the snapshots taken of it.
+	AnnSnapshots = "snapshot.external-storage.kubernetes.io/snapshots"
+
+	// AnnSnapshotSource is the annotation on a PVC naming, as "<PV name>/<snapshot
+	// name>", the snapshot to populate its provisioned volume from.
+	AnnSnapshotSource = "snapshot.external-storage.kubernetes.io/source"
+)
+
+// AnnCloneSource is the annotation on a PVC naming a bound PVC in the same
+// namespace whose volume's data to populate its provisioned volume with. Like
+// AnnSnapshotSource, it is up to the provisioner to honor it.
+const AnnCloneSource = "clone.external-storage.kubernetes.io/source"
+
+// IgnoredError is the value for Provision, Delete, Resize or Snapshot to return
+// to indicate that the call has been ignored and no action taken. In case
+// multiple provisioners are serving the same storage class, provisioners may
+// ignore claims they can't satisfy (e.g. ones whose selector doesn't match) and
+// PVs they are not responsible for (e.g. ones they didn't create). The
+// controller will act accordingly, i.e. it won't emit a misleading
+// ProvisioningFailed or VolumeFailedDelete event.
 type IgnoredError struct {
 	Reason string
 }
@@ -64,6 +132,12 @@ type VolumeOptions struct {
 	// i.e. with required capacity, accessMode, labels matching PVC.Selector and
 	// so on.
 	PVC *v1.PersistentVolumeClaim
-	// Volume provisioning parameters from StorageClass
+	// Volume provisioning parameters from StorageClass, minus the reclaimPolicy
+	// and mountOptions parameters consumed by the controller
 	Parameters map[string]string
+	// Options from the StorageClass's mountOptions parameter that the volume
+	// should be mounted with. The controller puts them in the PV's
+	// AnnMountOptions annotation unless the Provisioner sets it itself, e.g. to
+	// add options of its own.
+	MountOptions []string
 }
@@ -26,6 +26,7 @@ package leaderelection
 import (
 	"fmt"
 	"reflect"
+	"sync"
 	"time"
 
 	rl "github.com/kubernetes-incubator/external-storage/lib/leaderelection/resourcelock"
@@ -57,7 +58,9 @@ func NewLeaderElector(lec LeaderElectionConfig) (*LeaderElector, error) {
 		return nil, fmt.Errorf("Lock must not be nil.")
 	}
 	return &LeaderElector{
-		config: lec,
+		config:   lec,
+		released: make(chan struct{}),
+		done:     make(chan struct{}),
 	}, nil
 }
 
@@ -115,6 +118,10 @@ type LeaderElector struct {
 	// value observedRecord.HolderIdentity if the transition has
 	// not yet been reported.
 	reportedLeader string
+	// closed by Release to stop the election, and by Run when it returns
+	released    chan struct{}
+	releaseOnce sync.Once
+	done        chan struct{}
 }
 
 // Run starts the leader election loop
@@ -122,6 +129,7 @@ func (le *LeaderElector) Run(task <-chan bool) {
 	defer func() {
 		runtime.HandleCrash()
 	}()
+	defer close(le.done)
 	over := le.acquire(task)
 	if over {
 		return
@@ -129,15 +137,32 @@ func (le *LeaderElector) Run(task <-chan bool) {
 	stop := make(chan struct{})
 	go le.config.Callbacks.OnStartedLeading(stop)
 	timeout := make(chan bool, 1)
-	go func() {
-		time.Sleep(le.config.TermLimit)
-		timeout <- true
-	}()
+	if le.config.TermLimit > 0 {
+		go func() {
+			time.Sleep(le.config.TermLimit)
+			timeout <- true
+		}()
+	}
 	le.renew(task, timeout)
 	close(stop)
+	select {
+	case <-le.released:
+		le.release()
+	default:
+	}
 	le.config.Callbacks.OnStoppedLeading()
 }
 
+// Release stops the leader election loop and, if this client is the leader,
+// gives up the lease so that another candidate may acquire it without waiting
+// for it to expire. It blocks until Run has returned.
+func (le *LeaderElector) Release() {
+	le.releaseOnce.Do(func() {
+		close(le.released)
+	})
+	<-le.done
+}
+
 // GetLeader returns the identity of the last observed leader or returns the empty string if
 // no leader has yet been observed.
 func (le *LeaderElector) GetLeader() string {
@@ -157,6 +182,12 @@ func (le *LeaderElector) acquire(task <-chan bool) bool {
 	glog.Infof("attempting to acquire leader lease...")
 	wait.JitterUntil(func() {
 		select {
+		case <-le.released:
+			desc := le.config.Lock.Describe()
+			glog.Infof("stopped trying to acquire lease %v, released", desc)
+			over = true
+			close(stop)
+			return
 		case taskSucceeded := <-task:
 			if taskSucceeded {
 				// if the leader succeeded at the task, stop trying to acquire
@@ -202,9 +233,15 @@ func (le *LeaderElector) renew(task <-chan bool, timeout <-chan bool) {
 		case <-timeout:
 			// our term limit has ended, let somebody else have a try
 			desc := le.config.Lock.Describe()
+			le.config.Lock.RecordEvent("reached term limit")
 			glog.Infof("stopped trying to renew lease %v, timeout reached", desc)
 			close(stop)
 			return
+		case <-le.released:
+			desc := le.config.Lock.Describe()
+			glog.Infof("stopped trying to renew lease %v, released", desc)
+			close(stop)
+			return
 		default:
 		}
 		err := wait.Poll(le.config.RetryPeriod, le.config.RenewDeadline, func() (bool, error) {
@@ -255,7 +292,8 @@ func (le *LeaderElector) tryAcquireOrRenew() bool {
 		le.observedRecord = *oldLeaderElectionRecord
 		le.observedTime = time.Now()
 	}
-	if le.observedTime.Add(le.config.LeaseDuration).After(now.Time) &&
+	if len(oldLeaderElectionRecord.HolderIdentity) > 0 &&
+		le.observedTime.Add(le.config.LeaseDuration).After(now.Time) &&
 		oldLeaderElectionRecord.HolderIdentity != le.config.Lock.Identity() {
 		glog.V(4).Infof("lock is held by %v and has not yet expired", oldLeaderElectionRecord.HolderIdentity)
 		return false
@@ -279,6 +317,25 @@ func (le *LeaderElector) tryAcquireOrRenew() bool {
 	return true
 }
 
+// release clears the holder of the lease if this client is the leader. A lease
+// without a holder may be acquired immediately by any candidate.
+func (le *LeaderElector) release() {
+	if !le.IsLeader() {
+		return
+	}
+	leaderElectionRecord := rl.LeaderElectionRecord{
+		LeaderTransitions: le.observedRecord.LeaderTransitions,
+	}
+	if err := le.config.Lock.Update(leaderElectionRecord); err != nil {
+		glog.Errorf("Failed to release lock: %v", err)
+		return
+	}
+	le.observedRecord = leaderElectionRecord
+	le.observedTime = time.Now()
+	le.config.Lock.RecordEvent("released lease")
+	glog.Infof("released lease %v", le.config.Lock.Describe())
+}
+
 func (l *LeaderElector) maybeReportTransition() {
 	if l.observedRecord.HolderIdentity == l.reportedLeader {
 		return
@@ -17,12 +17,18 @@ limitations under the License.
 package resourcelock
 
 import (
+	"fmt"
+
+	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/tools/record"
 )
 
 const (
 	LeaderElectionRecordAnnotationKey = "control-plane.alpha.kubernetes.io/leader"
+	EndpointsResourceLock             = "endpoints"
+	ConfigMapsResourceLock            = "configmaps"
 )
 
 // LeaderElectionRecord is the record that is stored in the leader election annotation.
@@ -69,3 +75,28 @@ type Interface interface {
 	// into a string
 	Describe() string
 }
+
+// New creates a lock of the given type, EndpointsResourceLock or
+// ConfigMapsResourceLock, on the object with the given namespace and name.
+func New(lockType string, namespace string, name string, client clientset.Interface, rlc ResourceLockConfig) (Interface, error) {
+	meta := v1.ObjectMeta{
+		Namespace: namespace,
+		Name:      name,
+	}
+	switch lockType {
+	case EndpointsResourceLock:
+		return &EndpointsLock{
+			EndpointsMeta: meta,
+			Client:        client,
+			LockConfig:    rlc,
+		}, nil
+	case ConfigMapsResourceLock:
+		return &ConfigMapLock{
+			ConfigMapMeta: meta,
+			Client:        client,
+			LockConfig:    rlc,
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid lock-type %s, must be %s or %s", lockType, EndpointsResourceLock, ConfigMapsResourceLock)
+	}
+}
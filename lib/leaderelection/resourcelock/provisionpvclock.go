@@ -74,10 +74,21 @@ func (pl *ProvisionPVCLock) Update(ler LeaderElectionRecord) error {
 	return err
 }
 
-// RecordEvent in leader election while adding meta-data
+// RecordEvent in leader election while adding meta-data: the holder identity
+// and the number of leader transitions in the PVC's LeaderElectionRecord, as
+// last seen by this lock
 func (pl *ProvisionPVCLock) RecordEvent(s string) {
-	// events := fmt.Sprintf("%v %v", pl.LockConfig.Identity, s)
-	// pl.LockConfig.EventRecorder.Eventf(&v1.PersistentVolumeClaim{ObjectMeta: pl.p.ObjectMeta}, v1.EventTypeNormal, "LeaderElection", events)
+	if pl.LockConfig.EventRecorder == nil || pl.p == nil {
+		return
+	}
+	var record LeaderElectionRecord
+	if recordBytes, found := pl.p.Annotations[LeaderElectionRecordAnnotationKey]; found {
+		if err := json.Unmarshal([]byte(recordBytes), &record); err != nil {
+			return
+		}
+	}
+	events := fmt.Sprintf("%v %v (holder: %q, transitions: %d)", pl.LockConfig.Identity, s, record.HolderIdentity, record.LeaderTransitions)
+	pl.LockConfig.EventRecorder.Event(&v1.PersistentVolumeClaim{ObjectMeta: pl.p.ObjectMeta}, v1.EventTypeNormal, "LeaderElection", events)
 }
 
 // Describe is used to convert details on current resource lock
@@ -0,0 +1,81 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resourcelock
+
+import (
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestProvisionPVCLockRecordEvent(t *testing.T) {
+	tests := []struct {
+		name          string
+		record        *LeaderElectionRecord
+		expectedEvent string
+	}{
+		{
+			name:          "no event before get",
+			record:        nil,
+			expectedEvent: "",
+		},
+		{
+			name:          "event with holder and transitions",
+			record:        &LeaderElectionRecord{HolderIdentity: "foo", LeaderTransitions: 2},
+			expectedEvent: "Normal LeaderElection foo became leader (holder: \"foo\", transitions: 2)",
+		},
+	}
+	for _, test := range tests {
+		claim := &v1.PersistentVolumeClaim{
+			ObjectMeta: v1.ObjectMeta{
+				Name:      "claim-1",
+				Namespace: "default",
+			},
+		}
+		recorder := record.NewFakeRecorder(1)
+		lock := &ProvisionPVCLock{
+			PVCMeta: claim.ObjectMeta,
+			Client:  fake.NewSimpleClientset(claim),
+			LockConfig: ResourceLockConfig{
+				Identity:      "foo",
+				EventRecorder: recorder,
+			},
+		}
+		if test.record != nil {
+			if _, err := lock.Get(); err != nil {
+				t.Fatalf("Error getting record: %v", err)
+			}
+			if err := lock.Update(*test.record); err != nil {
+				t.Fatalf("Error updating record: %v", err)
+			}
+		}
+
+		lock.RecordEvent("became leader")
+
+		event := ""
+		select {
+		case event = <-recorder.Events:
+		default:
+		}
+		if event != test.expectedEvent {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected event %q but got %q", test.expectedEvent, event)
+		}
+	}
+}
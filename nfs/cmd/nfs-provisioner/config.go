@@ -0,0 +1,128 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"github.com/kubernetes-incubator/external-storage/nfs/pkg/config"
+	vol "github.com/kubernetes-incubator/external-storage/nfs/pkg/volume"
+)
+
+// loadConfig sets the flags to the values in the config file at path, except
+// those in setFlags, i.e. those set on the command line.
+func loadConfig(path string, setFlags map[string]bool) error {
+	c, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	for name, value := range c.Flags() {
+		if setFlags[name] {
+			glog.Infof("Flag %s set on the command line, ignoring its value in the config file", name)
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchConfig reloads the config file at path whenever it, or the ConfigMap
+// volume it is mounted from, changes or the process receives SIGHUP, until
+// stopCh is closed.
+func watchConfig(path string, setFlags map[string]bool, pc *controller.ProvisionController, p vol.Reconfigurable, stopCh <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// Watch the directory rather than the file, since editors and ConfigMap
+	// volume updates replace the file instead of writing to it
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		glog.Errorf("Error watching config file %s, it will only be reloaded on SIGHUP: %v", path, err)
+	} else {
+		defer watcher.Close()
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			glog.Errorf("Error watching config file %s, it will only be reloaded on SIGHUP: %v", path, err)
+		}
+	}
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if watcher != nil {
+		events = watcher.Events
+		errs = watcher.Errors
+	}
+
+	path = filepath.Clean(path)
+	for {
+		select {
+		case event := <-events:
+			if filepath.Clean(event.Name) != path && filepath.Base(event.Name) != "..data" {
+				continue
+			}
+			glog.V(4).Infof("Config file event %v", event)
+		case err := <-errs:
+			glog.Errorf("Error watching config file %s: %v", path, err)
+			continue
+		case <-hup:
+			glog.Infof("Received SIGHUP, reloading config file %s", path)
+		case <-stopCh:
+			return
+		}
+		reloadConfig(path, setFlags, pc, p)
+	}
+}
+
+// reloadConfig applies the values in the config file at path that can be
+// changed while the provisioner runs, and logs those that need a restart.
+// Flags set on the command line still take precedence, and values removed from
+// the file keep their current value.
+func reloadConfig(path string, setFlags map[string]bool, pc *controller.ProvisionController, p vol.Reconfigurable) {
+	c, err := config.Load(path)
+	if err != nil {
+		glog.Errorf("Error reloading config file, keeping the current configuration: %v", err)
+		return
+	}
+
+	for name, value := range c.Flags() {
+		f := flag.Lookup(name)
+		if setFlags[name] || f.Value.String() == value {
+			continue
+		}
+		switch name {
+		case "root-squash", "failed-retry-threshold":
+			if err := f.Value.Set(value); err != nil {
+				glog.Errorf("Error reloading %s from config file: %v", name, err)
+				continue
+			}
+			glog.Infof("Reloaded %s = %s from config file", name, value)
+		default:
+			glog.Warningf("Config file changed %s to %s, the provisioner must be restarted for it to take effect", name, value)
+		}
+	}
+
+	p.SetRootSquash(*rootSquash)
+	pc.SetFailedRetryThreshold(*failedRetryThreshold)
+}
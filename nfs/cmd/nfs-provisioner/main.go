@@ -18,18 +18,24 @@ package main
 
 import (
 	"flag"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"github.com/kubernetes-incubator/external-storage/lib/controller/metrics"
 	"github.com/kubernetes-incubator/external-storage/lib/leaderelection"
+	rl "github.com/kubernetes-incubator/external-storage/lib/leaderelection/resourcelock"
 	"github.com/kubernetes-incubator/external-storage/nfs/pkg/server"
 	vol "github.com/kubernetes-incubator/external-storage/nfs/pkg/volume"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/labels"
 	"k8s.io/client-go/pkg/util/validation"
 	"k8s.io/client-go/pkg/util/validation/field"
-	"k8s.io/client-go/pkg/util/wait"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -42,24 +48,50 @@ var (
 	useGanesha           = flag.Bool("use-ganesha", true, "If the provisioner will create volumes using NFS Ganesha (D-Bus method calls) as opposed to using the kernel NFS server ('exportfs'). If run-server is true, this must be true. Default true.")
 	gracePeriod          = flag.Uint("grace-period", 90, "NFS Ganesha grace period to use in seconds, from 0-180. If the server is not expected to survive restarts, i.e. it is running as a pod & its export directory is not persisted, this can be set to 0. Can only be set if both run-server and use-ganesha are true. Default 90.")
 	rootSquash           = flag.Bool("root-squash", false, "If the provisioner will squash root users by adding the NFS Ganesha root_id_squash or kernel root_squash option to each export. Default false.")
-	enableXfsQuota       = flag.Bool("enable-xfs-quota", false, "If the provisioner will set xfs quotas for each volume it provisions. Requires that the directory it creates volumes in ('/export') is xfs mounted with option prjquota/pquota, and that it has the privilege to run xfs_quota. Default false.")
+	enableQuota          = flag.Bool("enable-quota", false, "If the provisioner will set a quota for each volume it provisions, using xfs or ext4 project quotas depending on the filesystem of the directory it creates volumes in ('/export'). Requires that the directory be the mountpoint of an xfs filesystem mounted with option prjquota/pquota or of an ext4 filesystem with the project & quota features mounted with option prjquota, and that the provisioner has the privilege (CAP_SYS_ADMIN) to set project quotas with quotactl on the filesystem's block device, which must be visible to it. Default false.")
+	enableXfsQuota       = flag.Bool("enable-xfs-quota", false, "Deprecated: same as enable-quota. Default false.")
 	failedRetryThreshold = flag.Int("failed-retry-threshold", 10, "If the number of retries on provisioning failure need to be limited to a set number of attempts. Default 10")
+	threadiness          = flag.Int("threadiness", 4, "The number of claim workers and of volume workers the provision controller runs, i.e. how many claims it may provision for and how many volumes it may delete at once. Must be positive. Default 4.")
 	serverHostname       = flag.String("server-hostname", "", "The hostname for the NFS server to export from. Only applicable when running out-of-cluster i.e. it can only be set if either master or kubeconfig are set. If unset, the first IP output by `hostname -i` is used.")
-)
-
-const (
-	exportDir     = "/export"
-	ganeshaConfig = "/export/vfs.conf"
-	leasePeriod   = leaderelection.DefaultLeaseDuration
-	retryPeriod   = leaderelection.DefaultRetryPeriod
-	renewDeadline = leaderelection.DefaultRenewDeadline
-	termLimit     = leaderelection.DefaultTermLimit
+	metricsAddress       = flag.String("metrics-address", "", "The address, e.g. ':9090', to listen on for HTTP requests for the provision controller's Prometheus metrics at /metrics. If unset, metrics are not exposed.")
+	reclaimPolicy        = flag.String("reclaim-policy", "", "The reclaim policy, 'Delete' or 'Retain', to set on all provisioned PVs regardless of the reclaimPolicy parameter of their StorageClass. If unset, the parameter is used, which defaults to 'Delete'.")
+	pvLabels             = flag.String("labels", "", "Comma separated list of key=value labels, e.g. 'tier=gold,pool=ssd', that the provisioner advertises. Claims with a selector are only provisioned for if it matches these labels, and provisioned PVs are labeled with them. If unset, only claims with an empty or no selector are provisioned for.")
+	leaderElect          = flag.Bool("leader-elect", false, "If the provisioner replicas should elect a leader, so that only it provisions and deletes volumes while the others stand by. Replicas must share the same provisioner name and namespace. Default false.")
+	leaderElectLockType  = flag.String("leader-elect-resource-lock", rl.EndpointsResourceLock, "The type of object, 'endpoints' or 'configmaps', to hold the leader election lock on, in the provisioner's namespace. It is named after the provisioner. Default 'endpoints'.")
+	dryRun               = flag.Bool("dry-run", false, "If the provisioner should only log the volumes it would provision, resize, snapshot and delete, without doing so or writing leader election records. Orphans, state migrations and crash recovery are only reported. Default false.")
+	orphanPolicy         = flag.String("orphan-policy", string(vol.OrphanPolicyReport), "What to do with the directories, snapshots, export blocks, quota projects and state entries found without a PV, and the PVs found without them: 'Report' them in the log, also remove the export blocks, quota projects and state entries with 'RemoveBlocks', or also remove the directories and snapshots with 'RemoveAll'. Default 'Report'.")
+	orphanPeriod         = flag.Duration("orphan-period", 10*time.Minute, "How often to look for orphans. Default 10m.")
+	orphanGracePeriod    = flag.Duration("orphan-grace-period", time.Hour, "How long something must have been an orphan for before it is removed, so that volumes in the middle of being provisioned or deleted are left alone. Default 1h.")
+	shutdownTimeout      = flag.Duration("shutdown-timeout", controller.DefaultShutdownTimeout, "How long the provisioner waits on SIGTERM for in-flight provisioning and deletion operations to finish before stopping the NFS server and exiting. Should be less than the pod's terminationGracePeriodSeconds. Default 20s.")
+	exportDir            = flag.String("export-dir", "/export", "The directory to create volumes in. Default '/export'.")
+	ganeshaConfig        = flag.String("ganesha-config", "/export/vfs.conf", "The NFS Ganesha config file to add exports to. Default '/export/vfs.conf'.")
+	resyncPeriod         = flag.Duration("resync-period", 15*time.Second, "How often the provision controller resyncs all claims and volumes. Default 15s.")
+	leaseDuration        = flag.Duration("lease-duration", leaderelection.DefaultLeaseDuration, "How long non-leaders wait before trying to take over a leader election lock, whether per claim or, with leader-elect, for the whole provisioner. Default 15s.")
+	renewDeadline        = flag.Duration("renew-deadline", leaderelection.DefaultRenewDeadline, "How long the leader tries to renew its lock for before giving it up. Default 10s.")
+	retryPeriod          = flag.Duration("retry-period", leaderelection.DefaultRetryPeriod, "How long to wait between attempts to acquire or renew a leader election lock. Default 2s.")
+	termLimit            = flag.Duration("term-limit", leaderelection.DefaultTermLimit, "The maximum time a provisioner may hold a per-claim leader election lock for. Default 30s.")
+	krb5Principal        = flag.String("krb5-principal", "", "The Kerberos service name, e.g. 'nfs', whose key in krb5-keytab the NFS server uses to accept the krb5, krb5i and krb5p security flavors a StorageClass's secType parameter may ask for. Can only be set if run-server is true. If unset, Kerberos is not configured.")
+	krb5Keytab           = flag.String("krb5-keytab", "/etc/krb5.keytab", "The keytab holding the key for krb5-principal, e.g. principal 'nfs/server.example.com@EXAMPLE.COM' for service 'nfs'. Default '/etc/krb5.keytab'.")
+	idRange              = flag.String("id-range", vol.DefaultIDRange.String(), "The range, min-max, of the export and quota project IDs the provisioner assigns. Provisioners sharing an NFS server's exports or an xfs filesystem's projects must be given ranges that don't overlap. Default '1-65535'.")
+	configFile           = flag.String("config", "", "Path to a YAML or JSON config file setting any of the other flags, which take precedence over it. The file is reloaded when it changes or on SIGHUP: root-squash and failed-retry-threshold are applied immediately, changes to other flags require a restart. If unset, only flags are used.")
 )
 
 func main() {
 	flag.Set("logtostderr", "true")
 	flag.Parse()
 
+	// Flags set on the command line take precedence over the config file
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	if *configFile != "" {
+		if err := loadConfig(*configFile, setFlags); err != nil {
+			glog.Fatalf("Invalid config file specified: %v", err)
+		}
+		glog.Infof("Config file %s loaded", *configFile)
+	}
+
 	if errs := validateProvisioner(*provisioner, field.NewPath("provisioner")); len(errs) != 0 {
 		glog.Fatalf("Invalid provisioner specified: %v", errs)
 	}
@@ -75,6 +107,14 @@ func main() {
 		glog.Fatalf("Invalid flags specified: custom grace period must be in the range 0-180")
 	}
 
+	if *threadiness <= 0 {
+		glog.Fatalf("Invalid flags specified: threadiness must be positive.")
+	}
+
+	if *krb5Principal != "" && !*runServer {
+		glog.Fatalf("Invalid flags specified: krb5-principal can only be set if run-server is true.")
+	}
+
 	// Create the client according to whether we are running in or out-of-cluster
 	outOfCluster := *master != "" || *kubeconfig != ""
 
@@ -82,16 +122,29 @@ func main() {
 		glog.Fatalf("Invalid flags specified: if server-hostname is set, either master or kube-config must also be set.")
 	}
 
+	if err := vol.ValidateOrphanPolicy(vol.OrphanPolicy(*orphanPolicy)); err != nil {
+		glog.Fatalf("Invalid flags specified: %v", err)
+	}
+
+	labelsMap, err := labels.ConvertSelectorToLabelsMap(*pvLabels)
+	if err != nil {
+		glog.Fatalf("Invalid labels specified: %v", err)
+	}
+
+	ids, err := vol.ParseIDRange(*idRange)
+	if err != nil {
+		glog.Fatalf("Invalid flags specified: %v", err)
+	}
+
 	if *runServer {
 		glog.Infof("Starting NFS server!")
-		err := server.Start(ganeshaConfig, *gracePeriod)
+		err := server.Start(*ganeshaConfig, *gracePeriod, *krb5Principal, *krb5Keytab)
 		if err != nil {
 			glog.Fatalf("Error starting NFS server: %v", err)
 		}
 	}
 
 	var config *rest.Config
-	var err error
 	if outOfCluster {
 		config, err = clientcmd.BuildConfigFromFlags(*master, *kubeconfig)
 	} else {
@@ -114,11 +167,61 @@ func main() {
 
 	// Create the provisioner: it implements the Provisioner interface expected by
 	// the controller
-	nfsProvisioner := vol.NewNFSProvisioner(exportDir, clientset, outOfCluster, *useGanesha, ganeshaConfig, *rootSquash, *enableXfsQuota, *serverHostname)
+	nfsProvisioner := vol.NewNFSProvisioner(*exportDir, clientset, outOfCluster, *useGanesha, *ganeshaConfig, *rootSquash, *enableQuota || *enableXfsQuota, *serverHostname, labelsMap, ids, *dryRun)
+
+	if *metricsAddress != "" {
+		go func() {
+			glog.Infof("Serving metrics at %s%s", *metricsAddress, metrics.DefaultPath)
+			glog.Fatalf("Error serving metrics: %v", metrics.Serve(*metricsAddress, metrics.DefaultPath))
+		}()
+	}
 
 	// Start the provision controller which will dynamically provision NFS PVs
-	pc := controller.NewProvisionController(clientset, 15*time.Second, *provisioner, nfsProvisioner, serverVersion.GitVersion, false, *failedRetryThreshold, leasePeriod, renewDeadline, retryPeriod, termLimit)
-	pc.Run(wait.NeverStop)
+	options := []func(*controller.ProvisionController) error{
+		controller.ShutdownTimeout(*shutdownTimeout),
+		controller.DryRun(*dryRun),
+	}
+	if *reclaimPolicy != "" {
+		options = append(options, controller.ReclaimPolicy(v1.PersistentVolumeReclaimPolicy(*reclaimPolicy)))
+	}
+	if *leaderElect {
+		namespace := os.Getenv("POD_NAMESPACE")
+		if namespace == "" {
+			glog.Fatalf("Invalid flags specified: if leader-elect is true, the POD_NAMESPACE env variable must be set.")
+		}
+		options = append(options, controller.LeaderElection(*leaderElectLockType, namespace, strings.Replace(*provisioner, "/", "-", -1)))
+	}
+	pc := controller.NewProvisionController(clientset, *resyncPeriod, *provisioner, nfsProvisioner, serverVersion.GitVersion, *threadiness, *failedRetryThreshold, *leaseDuration, *renewDeadline, *retryPeriod, *termLimit, options...)
+
+	// On SIGTERM or SIGINT stop taking new claims, let in-flight operations
+	// finish, then stop the NFS server
+	stopCh := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		glog.Infof("Received signal %v, shutting down", sig)
+		close(stopCh)
+	}()
+
+	policy := vol.OrphanPolicy(*orphanPolicy)
+	if *dryRun {
+		policy = vol.OrphanPolicyReport
+	}
+	go nfsProvisioner.(vol.OrphanCollector).RunOrphanCollector(policy, *orphanPeriod, *orphanGracePeriod, stopCh)
+
+	if *configFile != "" {
+		go watchConfig(*configFile, setFlags, pc, nfsProvisioner.(vol.Reconfigurable), stopCh)
+	}
+
+	pc.Run(stopCh)
+
+	if *runServer {
+		glog.Infof("Stopping NFS server!")
+		if err := server.Stop(); err != nil {
+			glog.Fatalf("Error stopping NFS server: %v", err)
+		}
+	}
 }
 
 // validateProvisioner tests if provisioner is a valid qualified name.
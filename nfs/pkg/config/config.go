@@ -0,0 +1,159 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config contains the versioned format of nfs-provisioner's
+// configuration file, an alternative to setting its flags one by one.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/pkg/api/unversioned"
+)
+
+// Version is the current version of the configuration file format
+const Version = "v1"
+
+// Config is the configuration file of nfs-provisioner, in YAML or JSON. Each
+// field but Version corresponds to the flag of the same name in kebab case,
+// e.g. rootSquash to root-squash, and is left unset by omitting it.
+type Config struct {
+	// Version of the format the file is in, must be Version
+	Version string `json:"version"`
+
+	Provisioner             *string               `json:"provisioner,omitempty"`
+	Master                  *string               `json:"master,omitempty"`
+	Kubeconfig              *string               `json:"kubeconfig,omitempty"`
+	RunServer               *bool                 `json:"runServer,omitempty"`
+	UseGanesha              *bool                 `json:"useGanesha,omitempty"`
+	GracePeriod             *uint                 `json:"gracePeriod,omitempty"`
+	RootSquash              *bool                 `json:"rootSquash,omitempty"`
+	EnableQuota             *bool                 `json:"enableQuota,omitempty"`
+	EnableXfsQuota          *bool                 `json:"enableXfsQuota,omitempty"`
+	FailedRetryThreshold    *int                  `json:"failedRetryThreshold,omitempty"`
+	Threadiness             *int                  `json:"threadiness,omitempty"`
+	ServerHostname          *string               `json:"serverHostname,omitempty"`
+	MetricsAddress          *string               `json:"metricsAddress,omitempty"`
+	ReclaimPolicy           *string               `json:"reclaimPolicy,omitempty"`
+	Labels                  *string               `json:"labels,omitempty"`
+	LeaderElect             *bool                 `json:"leaderElect,omitempty"`
+	LeaderElectResourceLock *string               `json:"leaderElectResourceLock,omitempty"`
+	DryRun                  *bool                 `json:"dryRun,omitempty"`
+	OrphanPolicy            *string               `json:"orphanPolicy,omitempty"`
+	OrphanPeriod            *unversioned.Duration `json:"orphanPeriod,omitempty"`
+	OrphanGracePeriod       *unversioned.Duration `json:"orphanGracePeriod,omitempty"`
+	ShutdownTimeout         *unversioned.Duration `json:"shutdownTimeout,omitempty"`
+	IDRange                 *string               `json:"idRange,omitempty"`
+
+	// Paths
+	ExportDir     *string `json:"exportDir,omitempty"`
+	GaneshaConfig *string `json:"ganeshaConfig,omitempty"`
+
+	// Kerberos
+	Krb5Principal *string `json:"krb5Principal,omitempty"`
+	Krb5Keytab    *string `json:"krb5Keytab,omitempty"`
+
+	// Controller resync and leader election timings
+	ResyncPeriod  *unversioned.Duration `json:"resyncPeriod,omitempty"`
+	LeaseDuration *unversioned.Duration `json:"leaseDuration,omitempty"`
+	RenewDeadline *unversioned.Duration `json:"renewDeadline,omitempty"`
+	RetryPeriod   *unversioned.Duration `json:"retryPeriod,omitempty"`
+	TermLimit     *unversioned.Duration `json:"termLimit,omitempty"`
+}
+
+// Load reads the configuration file at the given path.
+func Load(path string) (*Config, error) {
+	read, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if err := yaml.Unmarshal(read, config); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+	if config.Version != Version {
+		return nil, fmt.Errorf("config file %s has unsupported version %q, must be %q", path, config.Version, Version)
+	}
+
+	return config, nil
+}
+
+// Flags returns the values of the fields that are set, as they would be
+// passed on the command line, keyed by the names of their flags.
+func (c *Config) Flags() map[string]string {
+	flags := map[string]string{}
+	setString(flags, "provisioner", c.Provisioner)
+	setString(flags, "master", c.Master)
+	setString(flags, "kubeconfig", c.Kubeconfig)
+	setBool(flags, "run-server", c.RunServer)
+	setBool(flags, "use-ganesha", c.UseGanesha)
+	if c.GracePeriod != nil {
+		flags["grace-period"] = strconv.FormatUint(uint64(*c.GracePeriod), 10)
+	}
+	setBool(flags, "root-squash", c.RootSquash)
+	setBool(flags, "enable-quota", c.EnableQuota)
+	setBool(flags, "enable-xfs-quota", c.EnableXfsQuota)
+	if c.FailedRetryThreshold != nil {
+		flags["failed-retry-threshold"] = strconv.Itoa(*c.FailedRetryThreshold)
+	}
+	if c.Threadiness != nil {
+		flags["threadiness"] = strconv.Itoa(*c.Threadiness)
+	}
+	setString(flags, "server-hostname", c.ServerHostname)
+	setString(flags, "metrics-address", c.MetricsAddress)
+	setString(flags, "reclaim-policy", c.ReclaimPolicy)
+	setString(flags, "labels", c.Labels)
+	setBool(flags, "leader-elect", c.LeaderElect)
+	setString(flags, "leader-elect-resource-lock", c.LeaderElectResourceLock)
+	setBool(flags, "dry-run", c.DryRun)
+	setString(flags, "orphan-policy", c.OrphanPolicy)
+	setDuration(flags, "orphan-period", c.OrphanPeriod)
+	setDuration(flags, "orphan-grace-period", c.OrphanGracePeriod)
+	setDuration(flags, "shutdown-timeout", c.ShutdownTimeout)
+	setString(flags, "id-range", c.IDRange)
+	setString(flags, "export-dir", c.ExportDir)
+	setString(flags, "ganesha-config", c.GaneshaConfig)
+	setString(flags, "krb5-principal", c.Krb5Principal)
+	setString(flags, "krb5-keytab", c.Krb5Keytab)
+	setDuration(flags, "resync-period", c.ResyncPeriod)
+	setDuration(flags, "lease-duration", c.LeaseDuration)
+	setDuration(flags, "renew-deadline", c.RenewDeadline)
+	setDuration(flags, "retry-period", c.RetryPeriod)
+	setDuration(flags, "term-limit", c.TermLimit)
+	return flags
+}
+
+func setString(flags map[string]string, name string, value *string) {
+	if value != nil {
+		flags[name] = *value
+	}
+}
+
+func setBool(flags map[string]string, name string, value *bool) {
+	if value != nil {
+		flags[name] = strconv.FormatBool(*value)
+	}
+}
+
+func setDuration(flags map[string]string, name string, value *unversioned.Duration) {
+	if value != nil {
+		flags[name] = value.Duration.String()
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "config-test")
+	if err != nil {
+		t.Fatalf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name          string
+		contents      string
+		expectedFlags map[string]string
+		expectError   bool
+	}{
+		{
+			name:          "empty v1",
+			contents:      "version: v1\n",
+			expectedFlags: map[string]string{},
+		},
+		{
+			name: "yaml",
+			contents: "version: v1\n" +
+				"provisioner: example.com/nfs\n" +
+				"rootSquash: true\n" +
+				"gracePeriod: 0\n" +
+				"failedRetryThreshold: 5\n" +
+				"threadiness: 8\n" +
+				"orphanGracePeriod: 2h\n" +
+				"exportDir: /data\n",
+			expectedFlags: map[string]string{
+				"provisioner":            "example.com/nfs",
+				"root-squash":            "true",
+				"grace-period":           "0",
+				"failed-retry-threshold": "5",
+				"threadiness":            "8",
+				"orphan-grace-period":    "2h0m0s",
+				"export-dir":             "/data",
+			},
+		},
+		{
+			name:     "json",
+			contents: `{"version": "v1", "useGanesha": false, "resyncPeriod": "30s"}`,
+			expectedFlags: map[string]string{
+				"use-ganesha":   "false",
+				"resync-period": "30s",
+			},
+		},
+		{
+			name:        "no version",
+			contents:    "rootSquash: true\n",
+			expectError: true,
+		},
+		{
+			name:        "unsupported version",
+			contents:    "version: v2\n",
+			expectError: true,
+		},
+		{
+			name:        "bad duration",
+			contents:    "version: v1\nresyncPeriod: soon\n",
+			expectError: true,
+		},
+		{
+			name:        "bad type",
+			contents:    "version: v1\nrootSquash: maybe\n",
+			expectError: true,
+		},
+	}
+	for i, test := range tests {
+		file := path.Join(tmpDir, string(rune('a'+i)))
+		if err := ioutil.WriteFile(file, []byte(test.contents), 0644); err != nil {
+			t.Fatalf("error writing config file: %v", err)
+		}
+		config, err := Load(file)
+		if !test.expectError && err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error loading config: %v", err)
+		} else if test.expectError && err == nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected error but got config: %v", config)
+		} else if err == nil && !reflect.DeepEqual(test.expectedFlags, config.Flags()) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected flags %v but got %v", test.expectedFlags, config.Flags())
+		}
+	}
+
+	if _, err := Load(path.Join(tmpDir, "nonexistent")); err == nil {
+		t.Errorf("expected error loading nonexistent config file")
+	}
+}
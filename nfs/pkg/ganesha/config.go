@@ -0,0 +1,232 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ganesha parses, edits and writes NFS Ganesha config files, e.g.
+// vfs.conf, as a tree of blocks, so that they can be edited regardless of how
+// they are formatted.
+package ganesha
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/kubernetes-incubator/external-storage/nfs/pkg/util"
+)
+
+// Entry is an entry of a Block: a *Block, *Param, *Comment or *Directive.
+type Entry interface {
+	write(buf *bytes.Buffer, depth int)
+}
+
+// Block is a block, e.g. EXPORT { ... }, and the entries in it. A parsed config
+// file is a Block without a Name, holding the file's top-level entries.
+type Block struct {
+	Name    string
+	Entries []Entry
+}
+
+// Param is a key = value; parameter. Value is as written in the file, e.g.
+// with its quotes or as a comma separated list.
+type Param struct {
+	Key   string
+	Value string
+}
+
+// Comment is a comment, Text being everything after the '#' on its line.
+type Comment struct {
+	Text string
+}
+
+// Directive is a directive like %include "file", Text being everything after
+// the '%' on its line.
+type Directive struct {
+	Text string
+}
+
+var _ Entry = &Block{}
+var _ Entry = &Param{}
+var _ Entry = &Comment{}
+var _ Entry = &Directive{}
+
+// NewBlock returns a block with the given name and params, which are given as
+// alternating keys and values.
+func NewBlock(name string, keysAndValues ...string) *Block {
+	block := &Block{Name: name}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		block.Entries = append(block.Entries, &Param{Key: keysAndValues[i], Value: keysAndValues[i+1]})
+	}
+	return block
+}
+
+// ReadFile parses the config file at path.
+func ReadFile(path string) (*Block, error) {
+	read, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := Parse(read)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ganesha config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// WriteFile atomically replaces the file at path with the config, keeping its
+// permissions if it exists.
+func (b *Block) WriteFile(path string) error {
+	return util.WriteFileAtomic(path, []byte(b.String()), 0600)
+}
+
+// Blocks returns the blocks in b with the given name. Like ganesha, it ignores
+// case.
+func (b *Block) Blocks(name string) []*Block {
+	blocks := []*Block{}
+	for _, entry := range b.Entries {
+		if block, ok := entry.(*Block); ok && strings.EqualFold(block.Name, name) {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// Block returns the first block in b with the given name, or nil.
+func (b *Block) Block(name string) *Block {
+	if blocks := b.Blocks(name); len(blocks) != 0 {
+		return blocks[0]
+	}
+	return nil
+}
+
+// EnsureBlock returns the first block in b with the given name, appending an
+// empty one if there is none.
+func (b *Block) EnsureBlock(name string) *Block {
+	if block := b.Block(name); block != nil {
+		return block
+	}
+	block := &Block{Name: name}
+	b.Entries = append(b.Entries, block)
+	return block
+}
+
+// Get returns the value of the first param in b with the given key.
+func (b *Block) Get(key string) (string, bool) {
+	if param := b.param(key); param != nil {
+		return param.Value, true
+	}
+	return "", false
+}
+
+// Set sets the value of the first param in b with the given key, adding it
+// after b's last param if there is none.
+func (b *Block) Set(key, value string) {
+	if param := b.param(key); param != nil {
+		param.Value = value
+		return
+	}
+	i := len(b.Entries)
+	for ; i > 0; i-- {
+		if _, ok := b.Entries[i-1].(*Param); ok {
+			break
+		}
+	}
+	if i == 0 {
+		// No params: add it before any blocks rather than after comments
+		for ; i < len(b.Entries); i++ {
+			if _, ok := b.Entries[i].(*Block); ok {
+				break
+			}
+		}
+	}
+	b.Entries = append(b.Entries[:i], append([]Entry{&Param{Key: key, Value: value}}, b.Entries[i:]...)...)
+}
+
+func (b *Block) param(key string) *Param {
+	for _, entry := range b.Entries {
+		if param, ok := entry.(*Param); ok && strings.EqualFold(param.Key, key) {
+			return param
+		}
+	}
+	return nil
+}
+
+// Add appends the entries to b.
+func (b *Block) Add(entries ...Entry) {
+	b.Entries = append(b.Entries, entries...)
+}
+
+// RemoveBlocks removes the blocks in b for which remove returns true and
+// returns how many it removed.
+func (b *Block) RemoveBlocks(remove func(*Block) bool) int {
+	removed := 0
+	entries := b.Entries[:0]
+	for _, entry := range b.Entries {
+		if block, ok := entry.(*Block); ok && remove(block) {
+			removed++
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	b.Entries = entries
+	return removed
+}
+
+// String serializes b. The output depends only on the tree, not on how the file
+// it was parsed from was formatted: entries are on lines of their own,
+// indented by tabs, and top-level entries are separated by blank lines except
+// after comments, which are kept with the entry they precede.
+func (b *Block) String() string {
+	buf := &bytes.Buffer{}
+	if b.Name != "" {
+		b.write(buf, 0)
+		return buf.String()
+	}
+	for i, entry := range b.Entries {
+		if i > 0 {
+			if _, comment := b.Entries[i-1].(*Comment); !comment {
+				buf.WriteString("\n")
+			}
+		}
+		entry.write(buf, 0)
+	}
+	return buf.String()
+}
+
+func (b *Block) write(buf *bytes.Buffer, depth int) {
+	indent := strings.Repeat("\t", depth)
+	if depth == 0 {
+		buf.WriteString(b.Name + "\n{\n")
+	} else {
+		buf.WriteString(indent + b.Name + " {\n")
+	}
+	for _, entry := range b.Entries {
+		entry.write(buf, depth+1)
+	}
+	buf.WriteString(indent + "}\n")
+}
+
+func (p *Param) write(buf *bytes.Buffer, depth int) {
+	buf.WriteString(strings.Repeat("\t", depth) + p.Key + " = " + p.Value + ";\n")
+}
+
+func (c *Comment) write(buf *bytes.Buffer, depth int) {
+	buf.WriteString(strings.Repeat("\t", depth) + "#" + c.Text + "\n")
+}
+
+func (d *Directive) write(buf *bytes.Buffer, depth int) {
+	buf.WriteString(strings.Repeat("\t", depth) + "%" + d.Text + "\n")
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ganesha
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		expected    *Block
+		expectError string
+	}{
+		{
+			name:     "empty",
+			config:   "",
+			expected: &Block{},
+		},
+		{
+			name: "formatted",
+			config: "# comment\n" +
+				"%include \"other.conf\"\n" +
+				"\n" +
+				"EXPORT\n{\n\tExport_Id = 1;\n\tClients = a, b;\n\tFSAL {\n\t\tName = VFS;\n\t}\n}\n",
+			expected: &Block{Entries: []Entry{
+				&Comment{Text: " comment"},
+				&Directive{Text: "include \"other.conf\""},
+				&Block{Name: "EXPORT", Entries: []Entry{
+					&Param{Key: "Export_Id", Value: "1"},
+					&Param{Key: "Clients", Value: "a, b"},
+					&Block{Name: "FSAL", Entries: []Entry{
+						&Param{Key: "Name", Value: "VFS"},
+					}},
+				}},
+			}},
+		},
+		{
+			name:   "compact with trailing comment and quoted semicolon",
+			config: "NFSV4{Grace_Period=90;};LOG{Default_Log_Level = \"a;b\";} # end",
+			expected: &Block{Entries: []Entry{
+				&Block{Name: "NFSV4", Entries: []Entry{
+					&Param{Key: "Grace_Period", Value: "90"},
+				}},
+				&Block{Name: "LOG", Entries: []Entry{
+					&Param{Key: "Default_Log_Level", Value: "\"a;b\""},
+				}},
+				&Comment{Text: " end"},
+			}},
+		},
+		{
+			name:        "unclosed block",
+			config:      "EXPORT {\n\tExport_Id = 1;\n",
+			expectError: "line 3: block EXPORT is not closed",
+		},
+		{
+			name:        "missing semicolon",
+			config:      "EXPORT {\n\tExport_Id = 1\n}\n",
+			expectError: "line 3: param Export_Id: expected ';' but got '}'",
+		},
+		{
+			name:        "unexpected brace",
+			config:      "EXPORT {}\n}\n",
+			expectError: "line 2: unexpected '}'",
+		},
+		{
+			name:        "name without value",
+			config:      "EXPORT {\n\tExport_Id;\n}\n",
+			expectError: "line 2: expected '{' or '=' after Export_Id but got ';'",
+		},
+		{
+			name:        "empty value",
+			config:      "EXPORT { Export_Id = ; }",
+			expectError: "line 1: param Export_Id: empty value",
+		},
+	}
+	for _, test := range tests {
+		config, err := Parse([]byte(test.config))
+		if test.expectError != "" {
+			if err == nil || err.Error() != test.expectError {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected error %q but got %v", test.expectError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error parsing config: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(test.expected, config) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected config %q but got %q", test.expected.String(), config.String())
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	configs := []string{
+		"# a\n#b\nEXPORT{Export_Id=1;FSAL{Name=VFS;}}NFSV4{Grace_Period=90;}\n%include x\n",
+		"\n\n  # a\n\n  #b\n\n\nEXPORT\n{\n  Export_Id   =   1 ;\n  FSAL\n  {\n    Name = VFS;\n  }\n}\n\nNFSV4 {\n Grace_Period = 90;\n}\n%include x",
+	}
+	expected := "# a\n#b\nEXPORT\n{\n\tExport_Id = 1;\n\tFSAL {\n\t\tName = VFS;\n\t}\n}\n\nNFSV4\n{\n\tGrace_Period = 90;\n}\n\n%include x\n"
+
+	for _, c := range configs {
+		config, err := Parse([]byte(c))
+		if err != nil {
+			t.Fatalf("unexpected error parsing config: %v", err)
+		}
+		if config.String() != expected {
+			t.Errorf("expected %q but got %q", expected, config.String())
+		}
+		// Serializing is deterministic: the output parses back to itself
+		reparsed, err := Parse([]byte(config.String()))
+		if err != nil {
+			t.Fatalf("unexpected error parsing serialized config: %v", err)
+		}
+		if !reflect.DeepEqual(config, reparsed) {
+			t.Errorf("expected serialized config %q to parse back to itself but got %q", config.String(), reparsed.String())
+		}
+	}
+}
+
+func TestEdit(t *testing.T) {
+	config, err := Parse([]byte("# comment\nNFS_CORE_PARAM {\n\tMNT_Port = 20048;\n\tFoo { }\n}\nexport { export_id = 1; }\nEXPORT { Export_Id = 2; }\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %v", err)
+	}
+
+	// Names and keys are case insensitive
+	core := config.Block("NFS_Core_Param")
+	if core == nil {
+		t.Fatalf("expected block NFS_Core_Param")
+	}
+	if value, ok := core.Get("mnt_port"); !ok || value != "20048" {
+		t.Errorf("expected MNT_Port 20048 but got %q, %v", value, ok)
+	}
+	if _, ok := core.Get("fsid_device"); ok {
+		t.Errorf("expected no fsid_device")
+	}
+	core.Set("mnt_port", "20049")
+	core.Set("fsid_device", "true")
+
+	if exports := config.Blocks("Export"); len(exports) != 2 {
+		t.Errorf("expected 2 EXPORT blocks but got %d", len(exports))
+	}
+	removed := config.RemoveBlocks(func(b *Block) bool {
+		id, _ := b.Get("Export_Id")
+		return strings.EqualFold(b.Name, "EXPORT") && id == "1"
+	})
+	if removed != 1 {
+		t.Errorf("expected 1 block removed but got %d", removed)
+	}
+
+	config.EnsureBlock("NFSV4").Set("Grace_Period", "0")
+	config.EnsureBlock("nfsv4").Set("Lease_Lifetime", "60")
+	config.Add(NewBlock("EXPORT", "Export_Id", "3", "Path", "/export/pvc-3"))
+
+	expected := "# comment\n" +
+		"NFS_CORE_PARAM\n{\n\tMNT_Port = 20049;\n\tfsid_device = true;\n\tFoo {\n\t}\n}\n\n" +
+		"EXPORT\n{\n\tExport_Id = 2;\n}\n\n" +
+		"NFSV4\n{\n\tGrace_Period = 0;\n\tLease_Lifetime = 60;\n}\n\n" +
+		"EXPORT\n{\n\tExport_Id = 3;\n\tPath = /export/pvc-3;\n}\n"
+	if config.String() != expected {
+		t.Errorf("expected %q but got %q", expected, config.String())
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ganesha
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Parse parses the contents of a config file into a Block without a Name.
+func Parse(data []byte) (*Block, error) {
+	p := &parser{data: data, line: 1}
+	root := &Block{}
+	if err := p.parseEntries(root, false); err != nil {
+		return nil, fmt.Errorf("line %d: %v", p.line, err)
+	}
+	return root, nil
+}
+
+type parser struct {
+	data []byte
+	pos  int
+	line int
+}
+
+// parseEntries parses entries into block until its closing brace, if nested,
+// or the end of the data.
+func (p *parser) parseEntries(block *Block, nested bool) error {
+	for {
+		p.skipSpace()
+		if p.pos == len(p.data) {
+			if nested {
+				return fmt.Errorf("block %s is not closed", block.Name)
+			}
+			return nil
+		}
+
+		switch c := p.data[p.pos]; {
+		case c == '#':
+			block.Entries = append(block.Entries, &Comment{Text: p.restOfLine()})
+		case c == '%':
+			block.Entries = append(block.Entries, &Directive{Text: p.restOfLine()})
+		case c == ';':
+			// Stray separators, e.g. after a block's closing brace
+			p.pos++
+		case c == '}':
+			if !nested {
+				return fmt.Errorf("unexpected '}'")
+			}
+			p.pos++
+			return nil
+		case isNameChar(c):
+			name := p.name()
+			p.skipSpace()
+			if p.pos == len(p.data) {
+				return fmt.Errorf("expected '{' or '=' after %s", name)
+			}
+			switch p.data[p.pos] {
+			case '{':
+				p.pos++
+				child := &Block{Name: name}
+				if err := p.parseEntries(child, true); err != nil {
+					return err
+				}
+				block.Entries = append(block.Entries, child)
+			case '=':
+				p.pos++
+				value, err := p.value()
+				if err != nil {
+					return fmt.Errorf("param %s: %v", name, err)
+				}
+				block.Entries = append(block.Entries, &Param{Key: name, Value: value})
+			default:
+				return fmt.Errorf("expected '{' or '=' after %s but got %q", name, p.data[p.pos])
+			}
+		default:
+			return fmt.Errorf("unexpected %q", c)
+		}
+	}
+}
+
+// skipSpace skips whitespace, counting lines.
+func (p *parser) skipSpace() {
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case '\n':
+			p.line++
+		case ' ', '\t', '\r':
+		default:
+			return
+		}
+		p.pos++
+	}
+}
+
+// restOfLine returns the rest of the current line after its first character,
+// without trailing whitespace, and moves to the next line.
+func (p *parser) restOfLine() string {
+	start := p.pos + 1
+	for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+		p.pos++
+	}
+	return strings.TrimRight(string(p.data[start:p.pos]), " \t\r")
+}
+
+func (p *parser) name() string {
+	start := p.pos
+	for p.pos < len(p.data) && isNameChar(p.data[p.pos]) {
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+// value returns the value of a param, everything up to the ';' ending it
+// outside of quotes, trimmed.
+func (p *parser) value() (string, error) {
+	start := p.pos
+	quoted := false
+	for ; p.pos < len(p.data); p.pos++ {
+		switch p.data[p.pos] {
+		case '"':
+			quoted = !quoted
+		case '\n':
+			p.line++
+		case ';':
+			if quoted {
+				continue
+			}
+			value := strings.TrimSpace(string(p.data[start:p.pos]))
+			p.pos++
+			if value == "" {
+				return "", fmt.Errorf("empty value")
+			}
+			return value, nil
+		case '{', '}', '#':
+			if !quoted {
+				return "", fmt.Errorf("expected ';' but got %q", p.data[p.pos])
+			}
+		}
+	}
+	if quoted {
+		return "", fmt.Errorf("quote is not closed")
+	}
+	return "", fmt.Errorf("expected ';' but reached the end")
+}
+
+func isNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.' || c == ':'
+}
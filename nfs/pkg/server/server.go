@@ -17,12 +17,18 @@ limitations under the License.
 package server
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"regexp"
-	"strings"
+	"strconv"
+
+	"github.com/guelfey/go.dbus"
+	"github.com/kubernetes-incubator/external-storage/nfs/pkg/ganesha"
+	"github.com/kubernetes-incubator/external-storage/nfs/pkg/util"
 )
 
 var defaultGaneshaConfigContents = []byte(`
@@ -69,8 +75,10 @@ NFSV4
 }
 `)
 
-// Start starts the NFS server. If an error is encountered at any point it returns it instantly
-func Start(ganeshaConfig string, gracePeriod uint) error {
+// Start starts the NFS server. If an error is encountered at any point it returns it instantly.
+// If krb5Principal is set, the server accepts Kerberos security flavors using
+// the keys for service krb5Principal in krb5Keytab.
+func Start(ganeshaConfig string, gracePeriod uint, krb5Principal, krb5Keytab string) error {
 	// Start rpcbind if it is not started yet
 	cmd := exec.Command("/usr/sbin/rpcinfo", "127.0.0.1")
 	if err := cmd.Run(); err != nil {
@@ -93,7 +101,7 @@ func Start(ganeshaConfig string, gracePeriod uint) error {
 
 	// Use defaultGaneshaConfigContents if the ganeshaConfig doesn't exist yet
 	if _, err := os.Stat(ganeshaConfig); os.IsNotExist(err) {
-		err = ioutil.WriteFile(ganeshaConfig, defaultGaneshaConfigContents, 0600)
+		err = util.WriteFileAtomic(ganeshaConfig, defaultGaneshaConfigContents, 0600)
 		if err != nil {
 			return fmt.Errorf("error writing ganesha config %s: %v", ganeshaConfig, err)
 		}
@@ -106,6 +114,14 @@ func Start(ganeshaConfig string, gracePeriod uint) error {
 	if err != nil {
 		return fmt.Errorf("error setting fsid device to ganesha config: %v", err)
 	}
+	if krb5Principal != "" {
+		if err := validateKeytab(krb5Keytab, krb5Principal); err != nil {
+			return fmt.Errorf("error validating keytab: %v", err)
+		}
+		if err := setKrb5(ganeshaConfig, krb5Principal, krb5Keytab); err != nil {
+			return fmt.Errorf("error setting krb5 to ganesha config: %v", err)
+		}
+	}
 	// Start ganesha.nfsd
 	cmd = exec.Command("ganesha.nfsd", "-L", "/var/log/ganesha.log", "-f", ganeshaConfig)
 	if out, err := cmd.CombinedOutput(); err != nil {
@@ -116,41 +132,9 @@ func Start(ganeshaConfig string, gracePeriod uint) error {
 }
 
 func setFsidDevice(ganeshaConfig string, fsidDevice bool) error {
-	newLine := fmt.Sprintf("fsid_device = %t;", fsidDevice)
-
-	re := regexp.MustCompile("fsid_device = (true|false);")
-
-	read, err := ioutil.ReadFile(ganeshaConfig)
-	if err != nil {
-		return err
-	}
-
-	oldLine := re.Find(read)
-
-	if oldLine == nil {
-		// fsid_device line not there, append it after MNT_Port
-		re := regexp.MustCompile("MNT_Port = 20048;")
-
-		mntPort := re.Find(read)
-
-		block := "MNT_Port = 20048;\n" +
-			"\t" + newLine
-
-		replaced := strings.Replace(string(read), string(mntPort), block, -1)
-		err = ioutil.WriteFile(ganeshaConfig, []byte(replaced), 0)
-		if err != nil {
-			return err
-		}
-	} else {
-		// fsid_device there, just replace it
-		replaced := strings.Replace(string(read), string(oldLine), newLine, -1)
-		err = ioutil.WriteFile(ganeshaConfig, []byte(replaced), 0)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return editConfig(ganeshaConfig, func(config *ganesha.Block) {
+		config.EnsureBlock("NFS_Core_Param").Set("fsid_device", strconv.FormatBool(fsidDevice))
+	})
 }
 
 func setGracePeriod(ganeshaConfig string, gracePeriod uint) error {
@@ -158,46 +142,132 @@ func setGracePeriod(ganeshaConfig string, gracePeriod uint) error {
 		return fmt.Errorf("grace period cannot be greater than 180")
 	}
 
-	newLine := fmt.Sprintf("Grace_Period = %d;", gracePeriod)
+	return editConfig(ganeshaConfig, func(config *ganesha.Block) {
+		config.EnsureBlock("NFSV4").Set("Grace_Period", strconv.FormatUint(uint64(gracePeriod), 10))
+	})
+}
 
-	re := regexp.MustCompile("Grace_Period = [0-9]+;")
+// setKrb5 sets the params of the NFS_KRB5 block of the ganesha config, adding
+// the block if it doesn't exist.
+func setKrb5(ganeshaConfig, principal, keytab string) error {
+	return editConfig(ganeshaConfig, func(config *ganesha.Block) {
+		block := config.EnsureBlock("NFS_KRB5")
+		block.Set("PrincipalName", principal)
+		block.Set("KeytabPath", keytab)
+		block.Set("Active_krb5", "true")
+	})
+}
 
-	read, err := ioutil.ReadFile(ganeshaConfig)
+// editConfig parses the ganesha config, edits it and writes it back.
+func editConfig(ganeshaConfig string, edit func(*ganesha.Block)) error {
+	config, err := ganesha.ReadFile(ganeshaConfig)
 	if err != nil {
 		return err
 	}
+	edit(config)
+	return config.WriteFile(ganeshaConfig)
+}
 
-	oldLine := re.Find(read)
+// validateKeytab checks that the keytab, in the MIT format written by kadmin's
+// ktadd, has a key for the given service, e.g. nfs/server.example.com@REALM
+// for service nfs, so that the server fails to start rather than to
+// authenticate its clients.
+func validateKeytab(keytab, service string) error {
+	read, err := ioutil.ReadFile(keytab)
+	if err != nil {
+		return err
+	}
+	r := bytes.NewReader(read)
+
+	var version uint16
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return fmt.Errorf("error reading keytab %s version: %v", keytab, err)
+	}
+	if version != 0x0502 {
+		return fmt.Errorf("keytab %s has unsupported version %#04x, must be 0x0502", keytab, version)
+	}
 
-	if oldLine == nil {
-		// Grace_Period line not there, append the whole NFSV4 block.
-		file, err := os.OpenFile(ganeshaConfig, os.O_APPEND|os.O_WRONLY, 0600)
+	for {
+		var size int32
+		if err := binary.Read(r, binary.BigEndian, &size); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("error reading keytab %s entry: %v", keytab, err)
+		}
+		entry := make([]byte, abs(size))
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return fmt.Errorf("error reading keytab %s entry: %v", keytab, err)
+		}
+		// A negative size marks a deleted entry
+		if size <= 0 {
+			continue
+		}
+		components, err := readPrincipal(bytes.NewReader(entry))
 		if err != nil {
-			return err
+			return fmt.Errorf("error reading keytab %s entry: %v", keytab, err)
 		}
-		defer file.Close()
+		if len(components) == 2 && components[0] == service {
+			return nil
+		}
+	}
 
-		block := "\nNFSV4\n{\n" +
-			"\t" + newLine + "\n" +
-			"}\n"
+	return fmt.Errorf("keytab %s has no key for service %s, i.e. principal %s/<hostname>@<REALM>", keytab, service, service)
+}
 
-		if _, err = file.WriteString(block); err != nil {
-			return err
-		}
-		file.Sync()
-	} else {
-		// Grace_Period line there, just replace it
-		replaced := strings.Replace(string(read), string(oldLine), newLine, -1)
-		err = ioutil.WriteFile(ganeshaConfig, []byte(replaced), 0)
+// readPrincipal reads the name components of the principal at the start of a
+// keytab entry.
+func readPrincipal(r io.Reader) ([]string, error) {
+	var count uint16
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	// The realm, then the components
+	if _, err := readCountedString(r); err != nil {
+		return nil, err
+	}
+	components := make([]string, 0, count)
+	for i := uint16(0); i < count; i++ {
+		component, err := readCountedString(r)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		components = append(components, component)
 	}
+	return components, nil
+}
 
-	return nil
+func readCountedString(r io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	s := make([]byte, length)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+func abs(i int32) int32 {
+	if i < 0 {
+		return -i
+	}
+	return i
 }
 
-// Stop stops the NFS server.
-func Stop() {
-	// /bin/dbus-send --system   --dest=org.ganesha.nfsd --type=method_call /org/ganesha/nfsd/admin org.ganesha.nfsd.admin.shutdown
+// Stop stops the NFS server by asking NFS Ganesha to shut down over D-Bus, the
+// equivalent of:
+// /bin/dbus-send --system   --dest=org.ganesha.nfsd --type=method_call /org/ganesha/nfsd/admin org.ganesha.nfsd.admin.shutdown
+func Stop() error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return fmt.Errorf("error getting dbus session bus: %v", err)
+	}
+	obj := conn.Object("org.ganesha.nfsd", "/org/ganesha/nfsd/admin")
+	call := obj.Call("org.ganesha.nfsd.admin.shutdown", 0)
+	if call.Err != nil {
+		return fmt.Errorf("error calling org.ganesha.nfsd.admin.shutdown: %v", call.Err)
+	}
+
+	return nil
 }
@@ -0,0 +1,201 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestValidateKeytab(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "server-test")
+	if err != nil {
+		t.Fatalf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name        string
+		keytab      []byte
+		service     string
+		expectError bool
+	}{
+		{
+			name:        "service key",
+			keytab:      newKeytab(t, []string{"host", "server.example.com"}, []string{"nfs", "server.example.com"}),
+			service:     "nfs",
+			expectError: false,
+		},
+		{
+			name:        "deleted entry skipped",
+			keytab:      append(newKeytab(t), append(deletedEntry(12), newKeytab(t, []string{"nfs", "server.example.com"})[2:]...)...),
+			service:     "nfs",
+			expectError: false,
+		},
+		{
+			name:        "no service key",
+			keytab:      newKeytab(t, []string{"host", "server.example.com"}, []string{"nfs"}),
+			service:     "nfs",
+			expectError: true,
+		},
+		{
+			name:        "empty",
+			keytab:      newKeytab(t),
+			service:     "nfs",
+			expectError: true,
+		},
+		{
+			name:        "bad version",
+			keytab:      []byte{0x05, 0x01},
+			service:     "nfs",
+			expectError: true,
+		},
+		{
+			name:        "truncated",
+			keytab:      newKeytab(t, []string{"nfs", "server.example.com"})[:10],
+			service:     "nfs",
+			expectError: true,
+		},
+	}
+	for i, test := range tests {
+		keytab := path.Join(tmpDir, string(rune('a'+i)))
+		if err := ioutil.WriteFile(keytab, test.keytab, 0600); err != nil {
+			t.Fatalf("error writing keytab: %v", err)
+		}
+		err := validateKeytab(keytab, test.service)
+		if test.expectError != (err != nil) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected error %v but got %v", test.expectError, err)
+		}
+	}
+}
+
+func TestEditConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "server-test")
+	if err != nil {
+		t.Fatalf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{
+			name:     "default config",
+			contents: string(defaultGaneshaConfigContents),
+			expected: "NFS_Core_Param\n{\n\tMNT_Port = 20048;\n\tfsid_device = true;\n}\n\nNFSV4\n{\n\tGrace_Period = 0;\n}\n\nNFS_KRB5\n{\n\tPrincipalName = nfs-server;\n\tKeytabPath = /etc/nfs.keytab;\n\tActive_krb5 = true;\n}\n",
+		},
+		{
+			name:     "user edited config",
+			contents: "NFS_CORE_PARAM {MNT_Port=20048;fsid_device=false;}\nnfsv4 {\n  grace_period   =   90 ; # seconds\n}\nNFS_KRB5 { PrincipalName = nfs; Active_krb5 = false; }\n",
+			expected: "NFS_CORE_PARAM\n{\n\tMNT_Port = 20048;\n\tfsid_device = true;\n}\n\nnfsv4\n{\n\tgrace_period = 0;\n\t# seconds\n}\n\nNFS_KRB5\n{\n\tPrincipalName = nfs-server;\n\tActive_krb5 = true;\n\tKeytabPath = /etc/nfs.keytab;\n}\n",
+		},
+		{
+			name:     "empty config",
+			contents: "",
+			expected: "NFSV4\n{\n\tGrace_Period = 0;\n}\n\nNFS_Core_Param\n{\n\tfsid_device = true;\n}\n\nNFS_KRB5\n{\n\tPrincipalName = nfs-server;\n\tKeytabPath = /etc/nfs.keytab;\n\tActive_krb5 = true;\n}\n",
+		},
+	}
+	for i, test := range tests {
+		config := path.Join(tmpDir, string(rune('a'+i)))
+		if err := ioutil.WriteFile(config, []byte(test.contents), 0600); err != nil {
+			t.Fatalf("error writing config: %v", err)
+		}
+
+		if err := setGracePeriod(config, 0); err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error setting grace period: %v", err)
+		}
+		if err := setFsidDevice(config, true); err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error setting fsid device: %v", err)
+		}
+		// Twice, the second time replacing the first
+		if err := setKrb5(config, "nfs", "/etc/krb5.keytab"); err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error setting krb5: %v", err)
+		}
+		if err := setKrb5(config, "nfs-server", "/etc/nfs.keytab"); err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error setting krb5: %v", err)
+		}
+
+		read, err := ioutil.ReadFile(config)
+		if err != nil {
+			t.Fatalf("error reading config: %v", err)
+		}
+		if !strings.HasSuffix(string(read), test.expected) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected config to end with %q but got %q", test.expected, string(read))
+		}
+	}
+
+	if err := setGracePeriod(path.Join(tmpDir, "a"), 181); err == nil {
+		t.Errorf("expected error setting grace period 181")
+	}
+}
+
+// newKeytab returns a keytab, as a KDC's kadmin ktadd would write it, with an
+// entry for each of the given principals in realm EXAMPLE.COM.
+func newKeytab(t *testing.T, principals ...[]string) []byte {
+	buf := &bytes.Buffer{}
+	write := func(data interface{}) {
+		if err := binary.Write(buf, binary.BigEndian, data); err != nil {
+			t.Fatalf("error writing keytab: %v", err)
+		}
+	}
+	writeString := func(s string) {
+		write(uint16(len(s)))
+		buf.WriteString(s)
+	}
+
+	write(uint16(0x0502))
+	for _, components := range principals {
+		entry := &bytes.Buffer{}
+		buf, entry = entry, buf
+		write(uint16(len(components)))
+		writeString("EXAMPLE.COM")
+		for _, component := range components {
+			writeString(component)
+		}
+		// name type, timestamp, kvno, key type and key
+		write(uint32(1))
+		write(uint32(0))
+		write(uint8(1))
+		write(uint16(18))
+		writeString(strings.Repeat("k", 32))
+		buf, entry = entry, buf
+		write(int32(entry.Len()))
+		buf.Write(entry.Bytes())
+	}
+	return buf.Bytes()
+}
+
+// deletedEntry returns a keytab entry of the given size marked deleted.
+func deletedEntry(size int32) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, -size)
+	buf.Write(make([]byte, size))
+	return buf.Bytes()
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "util-test")
+	if err != nil {
+		t.Fatalf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name         string
+		existing     *os.FileMode
+		data         string
+		perm         os.FileMode
+		expectedMode os.FileMode
+	}{
+		{
+			name:         "new file",
+			data:         "new",
+			perm:         0600,
+			expectedMode: 0600,
+		},
+		{
+			name:         "existing file keeps its mode",
+			existing:     fileMode(0644),
+			data:         "replaced",
+			perm:         0600,
+			expectedMode: 0644,
+		},
+		{
+			name:         "existing file emptied",
+			existing:     fileMode(0640),
+			data:         "",
+			perm:         0,
+			expectedMode: 0640,
+		},
+	}
+	for i, test := range tests {
+		file := path.Join(tmpDir, string(rune('a'+i)))
+		if test.existing != nil {
+			if err := ioutil.WriteFile(file, []byte("old contents"), *test.existing); err != nil {
+				t.Fatalf("error writing file: %v", err)
+			}
+			os.Chmod(file, *test.existing)
+		}
+
+		if err := WriteFileAtomic(file, []byte(test.data), test.perm); err != nil {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("unexpected error writing file: %v", err)
+			continue
+		}
+
+		read, err := ioutil.ReadFile(file)
+		if err != nil || string(read) != test.data {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected contents %q but got %q, %v", test.data, string(read), err)
+		}
+		info, err := os.Stat(file)
+		if err != nil || info.Mode().Perm() != test.expectedMode {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected mode %v but got %v, %v", test.expectedMode, info.Mode().Perm(), err)
+		}
+	}
+
+	// No temporary files are left behind
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("error reading temp directory: %v", err)
+	}
+	if len(entries) != len(tests) {
+		t.Errorf("expected %d files but got %d", len(tests), len(entries))
+	}
+
+	if err := WriteFileAtomic(path.Join(tmpDir, "nonexistent", "a"), []byte("a"), 0600); err == nil {
+		t.Errorf("expected error writing file in nonexistent directory")
+	}
+}
+
+func fileMode(mode os.FileMode) *os.FileMode {
+	return &mode
+}
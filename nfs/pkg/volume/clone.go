@@ -0,0 +1,93 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// validateCloneSource checks that the claim the claim's AnnCloneSource
+// annotation names, if any, is bound to a volume this provisioner provisioned
+// that is no bigger than the claim requests. If another provisioner
+// provisioned it, the claim is ignored so that that one may provision it.
+func (p *nfsProvisioner) validateCloneSource(options controller.VolumeOptions) error {
+	if _, ok := options.PVC.Annotations[controller.AnnCloneSource]; !ok {
+		return nil
+	}
+	volume, err := p.getCloneSourceVolume(options.PVC)
+	if err != nil {
+		return err
+	}
+
+	provisioned, err := p.provisioned(volume)
+	if err != nil {
+		return fmt.Errorf("error determining if this provisioner was the one to provision clone source volume %q: %v", volume.Name, err)
+	}
+	if !provisioned {
+		return &controller.IgnoredError{Reason: fmt.Sprintf("this provisioner id %s didn't provision clone source volume %q; id %s did & can clone it", p.identity, volume.Name, volume.Annotations[annProvisionerID])}
+	}
+
+	requested := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	capacity := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	if requested.Cmp(capacity) < 0 {
+		return fmt.Errorf("requested capacity %s is less than clone source volume %q capacity %s", requested.String(), volume.Name, capacity.String())
+	}
+
+	return nil
+}
+
+// cloneVolume populates the directory with the contents of the directory
+// backing the volume of the claim the claim's AnnCloneSource annotation names.
+func (p *nfsProvisioner) cloneVolume(claim *v1.PersistentVolumeClaim, directory string) error {
+	volume, err := p.getCloneSourceVolume(claim)
+	if err != nil {
+		return err
+	}
+
+	if err := copyContents(path.Join(p.exportDir, volume.Name), path.Join(p.exportDir, directory)); err != nil {
+		return fmt.Errorf("error copying clone source volume %q: %v", volume.Name, err)
+	}
+
+	return nil
+}
+
+// getCloneSourceVolume returns the volume bound to the claim the given claim's
+// AnnCloneSource annotation names.
+func (p *nfsProvisioner) getCloneSourceVolume(claim *v1.PersistentVolumeClaim) (*v1.PersistentVolume, error) {
+	sourceName := claim.Annotations[controller.AnnCloneSource]
+	source, err := p.client.Core().PersistentVolumeClaims(claim.Namespace).Get(sourceName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting clone source claim %s/%s: %v", claim.Namespace, sourceName, err)
+	}
+	if source.Spec.VolumeName == "" || source.Status.Phase != v1.ClaimBound {
+		return nil, fmt.Errorf("clone source claim %s/%s is not bound", claim.Namespace, sourceName)
+	}
+
+	volume, err := p.client.Core().PersistentVolumes().Get(source.Spec.VolumeName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting clone source volume %q: %v", source.Spec.VolumeName, err)
+	}
+	if volume.Spec.ClaimRef == nil || volume.Spec.ClaimRef.UID != source.UID {
+		return nil, fmt.Errorf("clone source volume %q is not bound to clone source claim %s/%s", volume.Name, claim.Namespace, sourceName)
+	}
+
+	return volume, nil
+}
@@ -20,7 +20,6 @@ import (
 	"fmt"
 	"os"
 	"path"
-	"strconv"
 
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
 	"k8s.io/client-go/pkg/api/v1"
@@ -41,21 +40,55 @@ func (p *nfsProvisioner) Delete(volume *v1.PersistentVolume) error {
 		return &controller.IgnoredError{Reason: strerr}
 	}
 
+	// Never remove the backing directory of a volume whose data is meant to
+	// survive the release of its claim
+	if volume.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimDelete {
+		strerr := fmt.Sprintf("volume %q has reclaim policy %q, not %q", volume.Name, volume.Spec.PersistentVolumeReclaimPolicy, v1.PersistentVolumeReclaimDelete)
+		return &controller.IgnoredError{Reason: strerr}
+	}
+
+	state, err := p.getVolumeState(volume)
+	if err != nil {
+		return fmt.Errorf("error getting state of volume: %v", err)
+	}
+
+	// Journal the delete so that a crash part way through it is rolled forward
+	// on startup. The entry is left in place if the delete fails, since the
+	// controller retries it.
+	if err := p.beginIntent(operationDelete, volume.Name); err != nil {
+		return fmt.Errorf("error journaling delete of volume: %v", err)
+	}
+
 	err = p.deleteDirectory(volume)
 	if err != nil {
 		return fmt.Errorf("error deleting volume's backing path: %v", err)
 	}
 
-	err = p.deleteExport(volume)
+	err = p.deleteExport(volume, state)
 	if err != nil {
 		return fmt.Errorf("deleted the volume's backing path but error deleting export: %v", err)
 	}
 
-	err = p.deleteQuota(volume)
+	err = p.deleteQuota(volume, state)
 	if err != nil {
 		return fmt.Errorf("deleted the volume's backing path & export but error deleting quota: %v", err)
 	}
 
+	key, err := getStateKey(volume)
+	if err == nil {
+		err = p.state.Delete(key)
+	}
+	if err != nil {
+		return fmt.Errorf("deleted the volume's backing path, export & quota but error deleting its state: %v", err)
+	}
+
+	err = p.deleteSnapshots(volume.Name)
+	if err != nil {
+		return fmt.Errorf("deleted the volume's backing path, export, quota & state but error deleting its snapshots: %v", err)
+	}
+
+	p.endIntent(volume.Name)
+
 	return nil
 }
 
@@ -80,30 +113,20 @@ func (p *nfsProvisioner) deleteDirectory(volume *v1.PersistentVolume) error {
 	return nil
 }
 
-func (p *nfsProvisioner) deleteExport(volume *v1.PersistentVolume) error {
-	block, exportID, err := getBlockAndID(volume, annExportBlock, annExportID)
-	if err != nil {
-		return fmt.Errorf("error getting block &/or id from annotations: %v", err)
-	}
-
-	if err := p.exporter.RemoveExportBlock(block, uint16(exportID)); err != nil {
+func (p *nfsProvisioner) deleteExport(volume *v1.PersistentVolume, state *volumeState) error {
+	if err := p.exporter.RemoveExportBlock(state.ExportBlock, state.ExportID); err != nil {
 		return fmt.Errorf("error removing the export from the config file: %v", err)
 	}
 
-	if err := p.exporter.Unexport(volume); err != nil {
+	if err := p.exporter.Unexport(state.ExportID); err != nil {
 		return fmt.Errorf("removed export from the config file but error unexporting it: %v", err)
 	}
 
 	return nil
 }
 
-func (p *nfsProvisioner) deleteQuota(volume *v1.PersistentVolume) error {
-	block, projectID, err := getBlockAndID(volume, annProjectBlock, annProjectID)
-	if err != nil {
-		return fmt.Errorf("error getting block &/or id from annotations: %v", err)
-	}
-
-	if err := p.quotaer.RemoveProject(block, uint16(projectID)); err != nil {
+func (p *nfsProvisioner) deleteQuota(volume *v1.PersistentVolume, state *volumeState) error {
+	if err := p.quotaer.RemoveProject(state.ProjectBlock, state.ProjectID); err != nil {
 		return fmt.Errorf("error removing the quota project from the projects file: %v", err)
 	}
 
@@ -113,18 +136,3 @@ func (p *nfsProvisioner) deleteQuota(volume *v1.PersistentVolume) error {
 
 	return nil
 }
-
-func getBlockAndID(volume *v1.PersistentVolume, annBlock, annID string) (string, uint16, error) {
-	block, ok := volume.Annotations[annBlock]
-	if !ok {
-		return "", 0, fmt.Errorf("PV doesn't have an annotation with key %s", annBlock)
-	}
-
-	idStr, ok := volume.Annotations[annID]
-	if !ok {
-		return "", 0, fmt.Errorf("PV doesn't have an annotation %s", annID)
-	}
-	id, _ := strconv.ParseUint(idStr, 10, 16)
-
-	return block, uint16(id), nil
-}
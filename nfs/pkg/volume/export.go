@@ -18,42 +18,206 @@ package volume
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/golang/glog"
 	"github.com/guelfey/go.dbus"
-	"k8s.io/client-go/pkg/api/v1"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"github.com/kubernetes-incubator/external-storage/nfs/pkg/ganesha"
+	"k8s.io/client-go/pkg/util/validation"
 )
 
 type exporter interface {
-	AddExportBlock(string) (string, uint16, error)
+	AddExportBlock(string, exportOptions) (string, uint16, error)
 	RemoveExportBlock(string, uint16) error
 	Export(string) error
-	Unexport(*v1.PersistentVolume) error
+	Unexport(uint16) error
+	GetExportBlocks() ([]configBlock, error)
+	SetRootSquash(bool)
 }
 
 type exportBlockCreator interface {
-	CreateExportBlock(string, string) string
+	CreateExportBlock(string, string, exportOptions) string
+	SetRootSquash(bool)
+}
+
+const (
+	squashAll  = "all"
+	squashRoot = "root"
+	squashNone = "none"
+)
+
+// exportOptions are the access options of a single export, set by the
+// parameters of the volume's StorageClass. The zero value exports RW to all
+// clients, squashing root according to the exporter's rootSquash.
+type exportOptions struct {
+	// Client CIDRs, IPs or hostnames allowed to mount the export. If empty,
+	// all clients are.
+	clients []string
+	// Whether to export RO, not RW
+	readOnly bool
+	// squashAll, squashRoot or squashNone. If empty, the exporter's rootSquash
+	// decides between squashRoot and squashNone.
+	squash string
+	// The uid and gid squashed users are mapped to, if non-empty
+	anonUID string
+	anonGID string
+	// Security flavors clients may use, in order of preference. If empty, only
+	// sys is.
+	secTypes []string
+	// NFS protocol versions clients may use, ascending. If empty, all are.
+	protocols []string
+}
+
+// mountOptions returns the options clients should mount the export with: the
+// given ones from the StorageClass plus, if the export restricts the NFS
+// versions and they don't choose one, the highest it allows.
+func (o exportOptions) mountOptions(classOptions []string) []string {
+	if len(o.protocols) == 0 || nfsVersion(classOptions) != "" {
+		return classOptions
+	}
+	return append(append([]string{}, classOptions...), "nfsvers="+o.protocols[len(o.protocols)-1])
+}
+
+// validateMountOptions checks that the NFS version the given mount options
+// choose, if any, is one the export allows.
+func (o exportOptions) validateMountOptions(classOptions []string) error {
+	for _, option := range classOptions {
+		switch name := controller.MountOptionName(option); name {
+		case "nfsvers", "vers":
+			if parts := strings.SplitN(option, "=", 2); len(parts) != 2 || parts[1] == "" {
+				return fmt.Errorf("mount option %s must have a value", name)
+			}
+		}
+	}
+	version := nfsVersion(classOptions)
+	if version == "" || len(o.protocols) == 0 {
+		return nil
+	}
+	major := strings.SplitN(version, ".", 2)[0]
+	for _, protocol := range o.protocols {
+		if protocol == major {
+			return nil
+		}
+	}
+	return fmt.Errorf("mount options choose NFS version %s, but the export only allows %s", version, strings.Join(o.protocols, ","))
+}
+
+// nfsVersion returns the NFS version the mount options choose with nfsvers or
+// vers, if any.
+func nfsVersion(mountOptions []string) string {
+	for _, option := range mountOptions {
+		switch controller.MountOptionName(option) {
+		case "nfsvers", "vers":
+			if parts := strings.SplitN(option, "=", 2); len(parts) == 2 {
+				return parts[1]
+			}
+		}
+	}
+	return ""
+}
+
+// parseClients parses a comma separated list of client CIDRs, IPs and
+// hostnames, which may start with a "*." wildcard.
+func parseClients(value string) ([]string, error) {
+	clients := []string{}
+	for _, client := range strings.Split(value, ",") {
+		client = strings.TrimSpace(client)
+		if _, _, err := net.ParseCIDR(client); err == nil {
+			clients = append(clients, client)
+			continue
+		}
+		if ip := net.ParseIP(client); ip != nil {
+			clients = append(clients, client)
+			continue
+		}
+		if errs := validation.IsDNS1123Subdomain(strings.TrimPrefix(client, "*.")); len(errs) != 0 {
+			return nil, fmt.Errorf("%q is not a CIDR, IP or hostname: %v", client, errs)
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// parseSquash parses a squash mode, 'all', 'root' or 'none'.
+func parseSquash(value string) (string, error) {
+	switch squash := strings.ToLower(value); squash {
+	case squashAll, squashRoot, squashNone:
+		return squash, nil
+	}
+	return "", fmt.Errorf("valid values are: 'all', 'root' or 'none'")
+}
+
+// parseSecTypes parses a comma separated list of security flavors, 'sys',
+// 'krb5', 'krb5i' or 'krb5p'.
+func parseSecTypes(value string) ([]string, error) {
+	secTypes := []string{}
+	for _, secType := range strings.Split(value, ",") {
+		secType = strings.ToLower(strings.TrimSpace(secType))
+		switch secType {
+		case "sys", "krb5", "krb5i", "krb5p":
+			secTypes = append(secTypes, secType)
+		default:
+			return nil, fmt.Errorf("valid values are comma separated lists of: 'sys', 'krb5', 'krb5i' or 'krb5p'")
+		}
+	}
+	return secTypes, nil
+}
+
+// parseProtocols parses a comma separated list of NFS protocol versions, '3'
+// or '4'.
+func parseProtocols(value string) ([]string, error) {
+	versions := map[string]bool{}
+	for _, protocol := range strings.Split(value, ",") {
+		protocol = strings.TrimSpace(protocol)
+		switch protocol {
+		case "3", "4":
+			versions[protocol] = true
+		default:
+			return nil, fmt.Errorf("valid values are comma separated lists of: '3' or '4'")
+		}
+	}
+	protocols := []string{}
+	for _, protocol := range []string{"3", "4"} {
+		if versions[protocol] {
+			protocols = append(protocols, protocol)
+		}
+	}
+	return protocols, nil
+}
+
+// parseAnonID parses the uid or gid to map squashed users to.
+func parseAnonID(value string) (string, error) {
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return "", fmt.Errorf("valid values are: integers from 0 to %d", uint32(1<<32-1))
+	}
+	return strconv.FormatUint(id, 10), nil
 }
 
 type genericExporter struct {
 	ebc    exportBlockCreator
 	config string
 
-	// Map to track used exportIDs. Each ganesha export needs a unique fsid and
-	// Export_Id, each kernel a unique fsid. Assign each export an exportID and
-	// use it as both fsid and Export_Id.
-	exportIDs map[uint16]bool
+	// Regexp matching the blocks created by ebc, with "id" and "path" submatches
+	blockRe *regexp.Regexp
+
+	// Allocator to track used exportIDs. Each ganesha export needs a unique fsid
+	// and Export_Id, each kernel a unique fsid. Assign each export an exportID
+	// and use it as both fsid and Export_Id.
+	exportIDs *idAllocator
 
-	mapMutex  *sync.Mutex
 	fileMutex *sync.Mutex
+	ebcMutex  *sync.Mutex
 }
 
-func newGenericExporter(ebc exportBlockCreator, config string, re *regexp.Regexp) *genericExporter {
+func newGenericExporter(ebc exportBlockCreator, config string, re *regexp.Regexp, blockRe *regexp.Regexp, idRange IDRange) *genericExporter {
 	if _, err := os.Stat(config); os.IsNotExist(err) {
 		glog.Fatalf("config %s does not exist!", config)
 	}
@@ -62,44 +226,180 @@ func newGenericExporter(ebc exportBlockCreator, config string, re *regexp.Regexp
 	if err != nil {
 		glog.Errorf("error while populating exportIDs map, there may be errors exporting later if exportIDs are reused: %v", err)
 	}
+	return newGenericExporterWithIDs(ebc, config, newIDAllocator(idRange, exportIDs), blockRe)
+}
+
+func newGenericExporterWithIDs(ebc exportBlockCreator, config string, exportIDs *idAllocator, blockRe *regexp.Regexp) *genericExporter {
 	return &genericExporter{
 		ebc:       ebc,
 		config:    config,
+		blockRe:   blockRe,
 		exportIDs: exportIDs,
-		mapMutex:  &sync.Mutex{},
 		fileMutex: &sync.Mutex{},
+		ebcMutex:  &sync.Mutex{},
 	}
 }
 
-func (e *genericExporter) AddExportBlock(path string) (string, uint16, error) {
-	exportID := generateID(e.mapMutex, e.exportIDs)
+func (e *genericExporter) AddExportBlock(path string, options exportOptions) (string, uint16, error) {
+	exportID, err := e.exportIDs.Allocate()
+	if err != nil {
+		return "", 0, err
+	}
 	exportIDStr := strconv.FormatUint(uint64(exportID), 10)
 
-	block := e.ebc.CreateExportBlock(exportIDStr, path)
+	e.ebcMutex.Lock()
+	block := e.ebc.CreateExportBlock(exportIDStr, path, options)
+	e.ebcMutex.Unlock()
 
 	// Add the export block to the config file
 	if err := addToFile(e.fileMutex, e.config, block); err != nil {
-		deleteID(e.mapMutex, e.exportIDs, exportID)
+		e.exportIDs.Release(exportID)
 		return "", 0, fmt.Errorf("error adding export block %s to config %s: %v", block, e.config, err)
 	}
 	return block, exportID, nil
 }
 
 func (e *genericExporter) RemoveExportBlock(block string, exportID uint16) error {
-	deleteID(e.mapMutex, e.exportIDs, exportID)
+	e.exportIDs.Release(exportID)
 	return removeFromFile(e.fileMutex, e.config, block)
 }
 
+// GetExportBlocks returns the export blocks found in the config file.
+func (e *genericExporter) GetExportBlocks() ([]configBlock, error) {
+	return getConfigBlocks(e.fileMutex, e.config, e.blockRe)
+}
+
+// SetRootSquash sets whether the export blocks added from now on squash root.
+// Existing exports are left as they are.
+func (e *genericExporter) SetRootSquash(rootSquash bool) {
+	e.ebcMutex.Lock()
+	defer e.ebcMutex.Unlock()
+	e.ebc.SetRootSquash(rootSquash)
+}
+
+// ganeshaExporter edits the ganesha config as a tree, rather than as text like
+// genericExporter, so that exports are found by Export_Id however the config
+// is formatted.
 type ganeshaExporter struct {
 	genericExporter
 }
 
 var _ exporter = &ganeshaExporter{}
 
-func newGaneshaExporter(ganeshaConfig string, rootSquash bool) exporter {
+func newGaneshaExporter(ganeshaConfig string, rootSquash bool, idRange IDRange) exporter {
+	if _, err := os.Stat(ganeshaConfig); os.IsNotExist(err) {
+		glog.Fatalf("config %s does not exist!", ganeshaConfig)
+	}
+
+	exportIDs := map[uint16]bool{}
+	blocks, err := getGaneshaExportBlocks(ganeshaConfig)
+	if err != nil {
+		glog.Errorf("error while populating exportIDs map, there may be errors exporting later if exportIDs are reused: %v", err)
+	}
+	for _, block := range blocks {
+		exportIDs[block.id] = true
+	}
 	return &ganeshaExporter{
-		genericExporter: *newGenericExporter(&ganeshaExportBlockCreator{rootSquash}, ganeshaConfig, regexp.MustCompile("Export_Id = ([0-9]+);")),
+		genericExporter: *newGenericExporterWithIDs(&ganeshaExportBlockCreator{rootSquash}, ganeshaConfig, newIDAllocator(idRange, exportIDs), nil),
+	}
+}
+
+// AddExportBlock adds an EXPORT block for the given path to the config.
+func (e *ganeshaExporter) AddExportBlock(path string, options exportOptions) (string, uint16, error) {
+	exportID, err := e.exportIDs.Allocate()
+	if err != nil {
+		return "", 0, err
+	}
+	exportIDStr := strconv.FormatUint(uint64(exportID), 10)
+
+	e.ebcMutex.Lock()
+	block := e.ebc.CreateExportBlock(exportIDStr, path, options)
+	e.ebcMutex.Unlock()
+
+	err = e.editConfig(func(config *ganesha.Block) error {
+		parsed, err := ganesha.Parse([]byte(block))
+		if err != nil {
+			return err
+		}
+		config.Add(parsed.Entries...)
+		return nil
+	})
+	if err != nil {
+		e.exportIDs.Release(exportID)
+		return "", 0, fmt.Errorf("error adding export block %s to config %s: %v", block, e.config, err)
+	}
+	return block, exportID, nil
+}
+
+// RemoveExportBlock removes the EXPORT block with the given Export_Id from the
+// config, if it's there.
+func (e *ganeshaExporter) RemoveExportBlock(block string, exportID uint16) error {
+	e.exportIDs.Release(exportID)
+	return e.editConfig(func(config *ganesha.Block) error {
+		config.RemoveBlocks(func(export *ganesha.Block) bool {
+			id, ok := getExportID(export)
+			return strings.EqualFold(export.Name, "EXPORT") && ok && id == exportID
+		})
+		return nil
+	})
+}
+
+// GetExportBlocks returns the EXPORT blocks found in the config.
+func (e *ganeshaExporter) GetExportBlocks() ([]configBlock, error) {
+	e.fileMutex.Lock()
+	defer e.fileMutex.Unlock()
+	return getGaneshaExportBlocks(e.config)
+}
+
+// editConfig parses the config, edits it and writes it back.
+func (e *ganeshaExporter) editConfig(edit func(*ganesha.Block) error) error {
+	e.fileMutex.Lock()
+	defer e.fileMutex.Unlock()
+
+	config, err := ganesha.ReadFile(e.config)
+	if err != nil {
+		return err
+	}
+	if err := edit(config); err != nil {
+		return err
+	}
+	return config.WriteFile(e.config)
+}
+
+// getGaneshaExportBlocks returns the EXPORT blocks with an Export_Id and Path
+// found in the config.
+func getGaneshaExportBlocks(ganeshaConfig string) ([]configBlock, error) {
+	config, err := ganesha.ReadFile(ganeshaConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []configBlock{}
+	for _, export := range config.Blocks("EXPORT") {
+		id, ok := getExportID(export)
+		if !ok {
+			continue
+		}
+		path, ok := export.Get("Path")
+		if !ok {
+			continue
+		}
+		blocks = append(blocks, configBlock{
+			block: "\n" + export.String(),
+			path:  strings.Trim(path, "\""),
+			id:    id,
+		})
+	}
+	return blocks, nil
+}
+
+func getExportID(export *ganesha.Block) (uint16, bool) {
+	value, ok := export.Get("Export_Id")
+	if !ok {
+		return 0, false
 	}
+	id, err := strconv.ParseUint(value, 10, 16)
+	return uint16(id), err == nil
 }
 
 // Export exports the given directory using NFS Ganesha, assuming it is running
@@ -119,20 +419,15 @@ func (e *ganeshaExporter) Export(path string) error {
 	return nil
 }
 
-func (e *ganeshaExporter) Unexport(volume *v1.PersistentVolume) error {
-	ann, ok := volume.Annotations[annExportID]
-	if !ok {
-		return fmt.Errorf("PV doesn't have an annotation %s, can't remove the export from the server", annExportID)
-	}
-	exportID, _ := strconv.ParseUint(ann, 10, 16)
-
+// Unexport removes the export with the given Export_Id from the server.
+func (e *ganeshaExporter) Unexport(exportID uint16) error {
 	// Call RemoveExport using dbus
 	conn, err := dbus.SystemBus()
 	if err != nil {
 		return fmt.Errorf("error getting dbus session bus: %v", err)
 	}
 	obj := conn.Object("org.ganesha.nfsd", "/org/ganesha/nfsd/ExportMgr")
-	call := obj.Call("org.ganesha.nfsd.exportmgr.RemoveExport", 0, uint16(exportID))
+	call := obj.Call("org.ganesha.nfsd.exportmgr.RemoveExport", 0, exportID)
 	if call.Err != nil {
 		return fmt.Errorf("error calling org.ganesha.nfsd.exportmgr.RemoveExport: %v", call.Err)
 	}
@@ -147,21 +442,63 @@ type ganeshaExportBlockCreator struct {
 
 var _ exportBlockCreator = &ganeshaExportBlockCreator{}
 
-// CreateBlock creates the text block to add to the ganesha config file.
-func (e *ganeshaExportBlockCreator) CreateExportBlock(exportID, path string) string {
+// CreateBlock creates the text block to add to the ganesha config file. If
+// options restricts the clients, the export itself allows no access and a
+// CLIENT block grants it to them.
+func (e *ganeshaExportBlockCreator) CreateExportBlock(exportID, path string, options exportOptions) string {
 	squash := "no_root_squash"
-	if e.rootSquash {
+	switch options.squash {
+	case squashAll:
+		squash = "all_squash"
+	case squashRoot:
 		squash = "root_id_squash"
+	case "":
+		if e.rootSquash {
+			squash = "root_id_squash"
+		}
+	}
+	accessType := "RW"
+	if options.readOnly {
+		accessType = "RO"
+	}
+	secType := "sys"
+	if len(options.secTypes) != 0 {
+		secType = strings.Join(options.secTypes, ", ")
+	}
+
+	block := ganesha.NewBlock("EXPORT",
+		"Export_Id", exportID,
+		"Path", path,
+		"Pseudo", path)
+	if len(options.protocols) != 0 {
+		block.Set("Protocols", strings.Join(options.protocols, ", "))
+	}
+	if len(options.clients) != 0 {
+		block.Set("Access_Type", "None")
+	} else {
+		block.Set("Access_Type", accessType)
+	}
+	block.Set("Squash", squash)
+	if options.anonUID != "" {
+		block.Set("Anonymous_Uid", options.anonUID)
+	}
+	if options.anonGID != "" {
+		block.Set("Anonymous_Gid", options.anonGID)
+	}
+	block.Set("SecType", secType)
+	block.Set("Filesystem_id", exportID+"."+exportID)
+	if len(options.clients) != 0 {
+		block.Add(ganesha.NewBlock("CLIENT",
+			"Clients", strings.Join(options.clients, ", "),
+			"Access_Type", accessType))
 	}
-	return "\nEXPORT\n{\n" +
-		"\tExport_Id = " + exportID + ";\n" +
-		"\tPath = " + path + ";\n" +
-		"\tPseudo = " + path + ";\n" +
-		"\tAccess_Type = RW;\n" +
-		"\tSquash = " + squash + ";\n" +
-		"\tSecType = sys;\n" +
-		"\tFilesystem_id = " + exportID + "." + exportID + ";\n" +
-		"\tFSAL {\n\t\tName = VFS;\n\t}\n}\n"
+	block.Add(ganesha.NewBlock("FSAL", "Name", "VFS"))
+	return "\n" + block.String()
+}
+
+// SetRootSquash sets whether the blocks created from now on squash root.
+func (e *ganeshaExportBlockCreator) SetRootSquash(rootSquash bool) {
+	e.rootSquash = rootSquash
 }
 
 type kernelExporter struct {
@@ -170,9 +507,9 @@ type kernelExporter struct {
 
 var _ exporter = &kernelExporter{}
 
-func newKernelExporter(rootSquash bool) exporter {
+func newKernelExporter(rootSquash bool, idRange IDRange) exporter {
 	return &kernelExporter{
-		genericExporter: *newGenericExporter(&kernelExportBlockCreator{rootSquash}, "/etc/exports", regexp.MustCompile("fsid=([0-9]+)")),
+		genericExporter: *newGenericExporter(&kernelExportBlockCreator{rootSquash}, "/etc/exports", regexp.MustCompile("fsid=([0-9]+)"), kernelExportBlockRe, idRange),
 	}
 }
 
@@ -188,7 +525,7 @@ func (e *kernelExporter) Export(_ string) error {
 	return nil
 }
 
-func (e *kernelExporter) Unexport(volume *v1.PersistentVolume) error {
+func (e *kernelExporter) Unexport(_ uint16) error {
 	// Execute exportfs
 	cmd := exec.Command("exportfs", "-r")
 	out, err := cmd.CombinedOutput()
@@ -206,11 +543,55 @@ type kernelExportBlockCreator struct {
 
 var _ exportBlockCreator = &kernelExportBlockCreator{}
 
-// CreateBlock creates the text block to add to the /etc/exports file.
-func (e *kernelExportBlockCreator) CreateExportBlock(exportID, path string) string {
+// kernelExportBlockRe matches the blocks created by kernelExportBlockCreator
+var kernelExportBlockRe = regexp.MustCompile("\n(?P<path>[^ \n]+) [^ \n]+\\([^\n]*,fsid=(?P<id>[0-9]+)\\)\n")
+
+// CreateBlock creates the text block to add to the /etc/exports file, a line
+// exporting path to each of the clients in options or to all, "*". The NFS
+// versions the kernel server allows are set server-wide, e.g. with rpc.nfsd
+// --no-nfs-version, so options.protocols is always empty, validateOptions
+// having rejected the protocols parameter.
+func (e *kernelExportBlockCreator) CreateExportBlock(exportID, path string, options exportOptions) string {
 	squash := "no_root_squash"
-	if e.rootSquash {
+	switch options.squash {
+	case squashAll:
+		squash = "all_squash"
+	case squashRoot:
 		squash = "root_squash"
+	case "":
+		if e.rootSquash {
+			squash = "root_squash"
+		}
+	}
+	access := "rw"
+	if options.readOnly {
+		access = "ro"
+	}
+	opts := access + ",insecure," + squash
+	if len(options.secTypes) != 0 {
+		// Options after sec= apply to its flavors, so it must come first
+		opts = "sec=" + strings.Join(options.secTypes, ":") + "," + opts
+	}
+	if options.anonUID != "" {
+		opts += ",anonuid=" + options.anonUID
 	}
-	return "\n" + path + " *(rw,insecure," + squash + ",fsid=" + exportID + ")\n"
+	if options.anonGID != "" {
+		opts += ",anongid=" + options.anonGID
+	}
+	opts += ",fsid=" + exportID
+
+	clients := options.clients
+	if len(clients) == 0 {
+		clients = []string{"*"}
+	}
+	line := path
+	for _, client := range clients {
+		line += " " + client + "(" + opts + ")"
+	}
+	return "\n" + line + "\n"
+}
+
+// SetRootSquash sets whether the blocks created from now on squash root.
+func (e *kernelExportBlockCreator) SetRootSquash(rootSquash bool) {
+	e.rootSquash = rootSquash
 }
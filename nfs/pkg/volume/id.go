@@ -0,0 +1,167 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IDRange is the range of export and quota project IDs a provisioner assigns,
+// inclusive. Provisioners sharing a ganesha config, /etc/exports or an xfs
+// filesystem must be given ranges that don't overlap.
+type IDRange struct {
+	Min uint16
+	Max uint16
+}
+
+// DefaultIDRange is every ID. 0 is left out: it is the fsid of the root export
+// and the Export_Id of ganesha's pseudo root.
+var DefaultIDRange = IDRange{Min: 1, Max: math.MaxUint16}
+
+// ParseIDRange parses a range of the form "min-max", e.g. "1-65535".
+func ParseIDRange(s string) (IDRange, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return IDRange{}, fmt.Errorf("invalid ID range %q, must be of the form min-max", s)
+	}
+	min, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+	if err != nil {
+		return IDRange{}, fmt.Errorf("invalid ID range %q: %v", s, err)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16)
+	if err != nil {
+		return IDRange{}, fmt.Errorf("invalid ID range %q: %v", s, err)
+	}
+	if min == 0 || min > max {
+		return IDRange{}, fmt.Errorf("invalid ID range %q, min must be at least 1 and at most max", s)
+	}
+	return IDRange{Min: uint16(min), Max: uint16(max)}, nil
+}
+
+func (r IDRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// idAllocator assigns unique IDs from a range, tracking which are in use with
+// a bitmap of every uint16. It is not persisted itself: it is rebuilt on
+// startup from the IDs found in the files the IDs are recorded in. IDs outside
+// the range, e.g. those of another provisioner sharing the files, are tracked
+// but never assigned.
+type idAllocator struct {
+	mutex   sync.Mutex
+	idRange IDRange
+	used    [(math.MaxUint16 + 1) / 64]uint64
+	// Number of IDs in the range that are free
+	free int
+}
+
+func newIDAllocator(idRange IDRange, existing map[uint16]bool) *idAllocator {
+	a := &idAllocator{
+		idRange: idRange,
+		free:    int(idRange.Max) - int(idRange.Min) + 1,
+	}
+	for id := range existing {
+		a.reserve(id)
+	}
+	return a
+}
+
+// Allocate assigns the lowest free ID in the range.
+func (a *idAllocator) Allocate() (uint16, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.free == 0 {
+		return 0, fmt.Errorf("ID space %s exhausted", a.idRange)
+	}
+	for i := int(a.idRange.Min) / 64; i <= int(a.idRange.Max)/64; i++ {
+		// Treat the bits of the first and last words that are outside the range
+		// as used
+		word := a.used[i]
+		if i == int(a.idRange.Min)/64 {
+			word |= 1<<(uint(a.idRange.Min)%64) - 1
+		}
+		if i == int(a.idRange.Max)/64 && a.idRange.Max%64 != 63 {
+			word |= ^uint64(0) << (uint(a.idRange.Max)%64 + 1)
+		}
+		if word == math.MaxUint64 {
+			continue
+		}
+		id := uint16(i*64 + lowestZeroBit(word))
+		a.reserve(id)
+		return id, nil
+	}
+	// Unreachable as long as free is accurate
+	return 0, fmt.Errorf("ID space %s exhausted", a.idRange)
+}
+
+// lowestZeroBit returns the index of the lowest zero bit in the given word,
+// which must have one.
+func lowestZeroBit(word uint64) int {
+	i := 0
+	for word&1 != 0 {
+		word >>= 1
+		i++
+	}
+	return i
+}
+
+// Reserve marks the given ID as in use.
+func (a *idAllocator) Reserve(id uint16) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.reserve(id)
+}
+
+func (a *idAllocator) reserve(id uint16) {
+	if a.used[id/64]&(1<<(id%64)) != 0 {
+		return
+	}
+	a.used[id/64] |= 1 << (id % 64)
+	if a.inRange(id) {
+		a.free--
+	}
+}
+
+// Release marks the given ID as free.
+func (a *idAllocator) Release(id uint16) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.used[id/64]&(1<<(id%64)) == 0 {
+		return
+	}
+	a.used[id/64] &^= 1 << (id % 64)
+	if a.inRange(id) {
+		a.free++
+	}
+}
+
+// InUse returns whether the given ID is in use.
+func (a *idAllocator) InUse(id uint16) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.used[id/64]&(1<<(id%64)) != 0
+}
+
+func (a *idAllocator) inRange(id uint16) bool {
+	return id >= a.idRange.Min && id <= a.idRange.Max
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/nfs/pkg/util"
+	"k8s.io/client-go/pkg/api/errors"
+)
+
+const (
+	operationProvision = "provision"
+	operationDelete    = "delete"
+)
+
+// intent is a journal entry recording that a volume's directory, export and
+// quota are being created or removed. If the provisioner crashes before the
+// entry is removed, the operation is completed or undone on startup.
+type intent struct {
+	Operation string `json:"operation"`
+	Path      string `json:"path"`
+}
+
+// beginIntent records that the given operation on the given volume has begun.
+func (p *nfsProvisioner) beginIntent(operation, volumeName string) error {
+	data, err := json.Marshal(intent{Operation: operation, Path: path.Join(p.exportDir, volumeName)})
+	if err != nil {
+		return err
+	}
+	p.journalMutex.Lock()
+	defer p.journalMutex.Unlock()
+	return util.WriteFileAtomic(p.getIntentPath(volumeName), data, 0600)
+}
+
+// endIntent records that the operation on the given volume has finished,
+// successfully or not.
+func (p *nfsProvisioner) endIntent(volumeName string) {
+	p.journalMutex.Lock()
+	defer p.journalMutex.Unlock()
+	p.removeIntent(volumeName)
+}
+
+func (p *nfsProvisioner) removeIntent(volumeName string) {
+	if err := os.Remove(p.getIntentPath(volumeName)); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("Error removing journal entry for volume %q: %v", volumeName, err)
+	}
+}
+
+func (p *nfsProvisioner) readIntent(volumeName string) (*intent, error) {
+	read, err := ioutil.ReadFile(p.getIntentPath(volumeName))
+	if err != nil {
+		return nil, err
+	}
+	var in intent
+	if err := json.Unmarshal(read, &in); err != nil {
+		return nil, err
+	}
+	return &in, nil
+}
+
+func (p *nfsProvisioner) getIntentPath(volumeName string) string {
+	return path.Join(p.exportDir, journalDir, volumeName)
+}
+
+// recoverIntents finishes the operations left in the journal by a crash.
+// Provisions are rolled back, since the controller retries them under the same
+// PV name, unless the PV exists, in which case they are complete. Deletes are
+// rolled forward, since the controller retries them and they must not find a
+// half-removed volume. In a dry run they are only logged and the journal is
+// left as is.
+func (p *nfsProvisioner) recoverIntents() error {
+	entries, err := ioutil.ReadDir(path.Join(p.exportDir, journalDir))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		volumeName := entry.Name()
+		read, err := ioutil.ReadFile(p.getIntentPath(volumeName))
+		if err != nil {
+			return err
+		}
+		var in intent
+		if err := json.Unmarshal(read, &in); err != nil {
+			glog.Errorf("Error parsing journal entry for volume %q, ignoring it: %v", volumeName, err)
+			continue
+		}
+		if in.Path != path.Join(p.exportDir, volumeName) {
+			glog.Errorf("Journal entry for volume %q has unexpected path %s, ignoring it", volumeName, in.Path)
+			continue
+		}
+
+		switch in.Operation {
+		case operationProvision:
+			_, err := p.client.Core().PersistentVolumes().Get(volumeName)
+			if err == nil {
+				glog.Infof("Volume %q has been provisioned, keeping it", volumeName)
+				break
+			}
+			if !errors.IsNotFound(err) {
+				return fmt.Errorf("error getting PV %q: %v", volumeName, err)
+			}
+			if p.dryRun {
+				glog.Infof("Would roll back incomplete provision of volume %q", volumeName)
+				continue
+			}
+			glog.Infof("Rolling back incomplete provision of volume %q", volumeName)
+			if err := p.removeVolume(in.Path); err != nil {
+				return fmt.Errorf("error rolling back provision of volume %q: %v", volumeName, err)
+			}
+		case operationDelete:
+			if p.dryRun {
+				glog.Infof("Would roll forward incomplete delete of volume %q", volumeName)
+				continue
+			}
+			glog.Infof("Rolling forward incomplete delete of volume %q", volumeName)
+			if err := p.removeVolume(in.Path); err != nil {
+				return fmt.Errorf("error rolling forward delete of volume %q: %v", volumeName, err)
+			}
+		default:
+			glog.Errorf("Journal entry for volume %q has unknown operation %q, ignoring it", volumeName, in.Operation)
+			continue
+		}
+
+		if p.dryRun {
+			continue
+		}
+		p.endIntent(volumeName)
+	}
+
+	return nil
+}
+
+// removeVolume removes whatever exists of the export blocks, quota projects,
+// state, snapshots and directory for the given path. Blocks are found in the
+// config files rather than PV annotations since a crash may leave them without
+// a PV.
+func (p *nfsProvisioner) removeVolume(volumePath string) error {
+	exportBlocks, err := p.exporter.GetExportBlocks()
+	if err != nil {
+		return fmt.Errorf("error getting export blocks: %v", err)
+	}
+	for _, block := range exportBlocks {
+		if path.Clean(block.path) != volumePath {
+			continue
+		}
+		if err := p.exporter.RemoveExportBlock(block.block, block.id); err != nil {
+			return fmt.Errorf("error removing export block: %v", err)
+		}
+		p.unexportBlock(block)
+	}
+
+	projectBlocks, err := p.quotaer.GetProjectBlocks()
+	if err != nil {
+		return fmt.Errorf("error getting project blocks: %v", err)
+	}
+	removedProject := false
+	for _, block := range projectBlocks {
+		if path.Clean(block.path) != volumePath {
+			continue
+		}
+		if err := p.quotaer.RemoveProject(block.block, block.id); err != nil {
+			return fmt.Errorf("error removing quota project: %v", err)
+		}
+		removedProject = true
+	}
+	if removedProject {
+		if err := p.quotaer.UnsetQuota(); err != nil {
+			return fmt.Errorf("error unsetting quota: %v", err)
+		}
+	}
+
+	if err := p.state.Delete(path.Base(volumePath)); err != nil {
+		return fmt.Errorf("error deleting state: %v", err)
+	}
+
+	if err := p.deleteSnapshots(path.Base(volumePath)); err != nil {
+		return fmt.Errorf("error deleting snapshots: %v", err)
+	}
+
+	return os.RemoveAll(volumePath)
+}
+
+// unexportBlock unexports the export of the given block, which may or may not
+// still be live, so errors are only logged.
+func (p *nfsProvisioner) unexportBlock(block configBlock) {
+	if err := p.exporter.Unexport(block.id); err != nil {
+		glog.V(4).Infof("Error unexporting export for path %s: %v", block.path, err)
+	}
+}
+
+// clearProvisionIntents removes the journal entries of the provisions whose
+// PVs now exist. A provision's entry is only removed once the controller has
+// created its PV, so that a crash in between is still rolled back on startup.
+func (p *nfsProvisioner) clearProvisionIntents() error {
+	entries, err := ioutil.ReadDir(path.Join(p.exportDir, journalDir))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		volumeName := entry.Name()
+		in, err := p.readIntent(volumeName)
+		if err != nil || in.Operation != operationProvision {
+			continue
+		}
+		_, err = p.client.Core().PersistentVolumes().Get(volumeName)
+		if errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error getting PV %q: %v", volumeName, err)
+		}
+
+		// Check the entry again under the lock, since the volume may have
+		// started being deleted in the meantime
+		p.journalMutex.Lock()
+		if in, err := p.readIntent(volumeName); err == nil && in.Operation == operationProvision {
+			glog.V(4).Infof("Volume %q has been provisioned, removing its journal entry", volumeName)
+			p.removeIntent(volumeName)
+		}
+		p.journalMutex.Unlock()
+	}
+
+	return nil
+}
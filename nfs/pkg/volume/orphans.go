@@ -0,0 +1,341 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/util/wait"
+)
+
+// OrphanPolicy is what the orphan collector does with the orphans it finds:
+// directories, snapshots, export blocks, quota projects and state entries left
+// behind without a PV, e.g. by a crash in the middle of provisioning or by a
+// failed delete.
+type OrphanPolicy string
+
+const (
+	// OrphanPolicyReport only reports orphans.
+	OrphanPolicyReport OrphanPolicy = "Report"
+	// OrphanPolicyRemoveBlocks reports orphans and removes orphaned export
+	// blocks, quota projects and state entries, but never directories or
+	// snapshots, which hold data.
+	OrphanPolicyRemoveBlocks OrphanPolicy = "RemoveBlocks"
+	// OrphanPolicyRemoveAll reports orphans and removes all of them, including
+	// directories and snapshots.
+	OrphanPolicyRemoveAll OrphanPolicy = "RemoveAll"
+)
+
+// provisionedPrefix is the prefix of the names of the PVs the controller
+// provisions and so of the directories this provisioner creates. Anything
+// else in the export directory, e.g. lost+found, is never an orphan.
+const provisionedPrefix = "pvc-"
+
+// OrphanCollector is implemented by provisioners that can look for & remove
+// the pieces of volumes left behind without a PV.
+type OrphanCollector interface {
+	// RunOrphanCollector looks for orphans every period until stopCh is closed,
+	// dealing with them according to policy. Orphans are only removed once they
+	// have been orphans for at least gracePeriod, so that the pieces of volumes
+	// in the middle of being provisioned or deleted are left alone.
+	RunOrphanCollector(policy OrphanPolicy, period, gracePeriod time.Duration, stopCh <-chan struct{})
+}
+
+var _ OrphanCollector = &nfsProvisioner{}
+
+// ValidateOrphanPolicy returns an error if the given policy is not one of the
+// OrphanPolicy constants.
+func ValidateOrphanPolicy(policy OrphanPolicy) error {
+	switch policy {
+	case OrphanPolicyReport, OrphanPolicyRemoveBlocks, OrphanPolicyRemoveAll:
+		return nil
+	}
+	return fmt.Errorf("invalid orphan policy %q, must be %q, %q or %q", policy, OrphanPolicyReport, OrphanPolicyRemoveBlocks, OrphanPolicyRemoveAll)
+}
+
+// orphans are the pieces of volumes found without a PV, and the PVs found
+// without all of their pieces.
+type orphans struct {
+	directories   []string
+	snapshots     []string
+	exportBlocks  []configBlock
+	projectBlocks []configBlock
+	// Keys of stateStore entries
+	states []string
+
+	// Map of the names of this provisioner's PVs to descriptions of the pieces
+	// they are missing
+	incomplete map[string][]string
+}
+
+func (p *nfsProvisioner) RunOrphanCollector(policy OrphanPolicy, period, gracePeriod time.Duration, stopCh <-chan struct{}) {
+	// Map of orphans to when they were first found
+	firstFound := map[string]time.Time{}
+	wait.Until(func() {
+		if !p.dryRun {
+			if err := p.clearProvisionIntents(); err != nil {
+				glog.Errorf("Error clearing journal entries of provisioned volumes: %v", err)
+			}
+		}
+		o, err := p.findOrphans()
+		if err != nil {
+			glog.Errorf("Error looking for orphans: %v", err)
+			return
+		}
+		p.reportOrphans(o)
+		if policy != OrphanPolicyReport {
+			p.removeOrphans(o, policy, gracePeriod, firstFound, time.Now())
+		}
+	}, period, stopCh)
+}
+
+// findOrphans compares the directories in the export directory and its snapshot
+// directory, the blocks in the export config and projects files and the entries
+// in the stateStore with this provisioner's PVs.
+func (p *nfsProvisioner) findOrphans() (*orphans, error) {
+	exportBlocks, err := p.exporter.GetExportBlocks()
+	if err != nil {
+		return nil, fmt.Errorf("error getting export blocks: %v", err)
+	}
+	projectBlocks, err := p.quotaer.GetProjectBlocks()
+	if err != nil {
+		return nil, fmt.Errorf("error getting project blocks: %v", err)
+	}
+	entries, err := ioutil.ReadDir(p.exportDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading export directory %s: %v", p.exportDir, err)
+	}
+	snapshotEntries, err := ioutil.ReadDir(path.Join(p.exportDir, snapshotDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading snapshot directory %s: %v", path.Join(p.exportDir, snapshotDir), err)
+	}
+	stateEntries, err := ioutil.ReadDir(p.state.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading state directory %s: %v", p.state.dir, err)
+	}
+	// List PVs last so that pieces of volumes provisioned in the meantime are
+	// not mistaken for orphans
+	volumes, err := p.client.Core().PersistentVolumes().List(v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing PVs: %v", err)
+	}
+
+	// A directory is taken if any PV has its name, even one provisioned by a
+	// previous identity of this provisioner, but only this provisioner's PVs
+	// can be incomplete
+	taken := map[string]bool{}
+	takenStates := map[string]bool{}
+	mine := []v1.PersistentVolume{}
+	for _, volume := range volumes.Items {
+		taken[path.Join(p.exportDir, volume.Name)] = true
+		if key, err := getStateKey(&volume); err == nil {
+			takenStates[key] = true
+		}
+		if provisioned, err := p.provisioned(&volume); err == nil && provisioned {
+			mine = append(mine, volume)
+		}
+	}
+
+	o := &orphans{incomplete: map[string][]string{}}
+
+	directories := map[string]bool{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), provisionedPrefix) {
+			continue
+		}
+		directory := path.Join(p.exportDir, entry.Name())
+		directories[directory] = true
+		if !taken[directory] {
+			o.directories = append(o.directories, directory)
+		}
+	}
+
+	// A volume's snapshots are kept in a directory named after its PV
+	for _, entry := range snapshotEntries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), provisionedPrefix) {
+			continue
+		}
+		if !taken[path.Join(p.exportDir, entry.Name())] {
+			o.snapshots = append(o.snapshots, path.Join(p.exportDir, snapshotDir, entry.Name()))
+		}
+	}
+
+	// Skip the temporary files of entries being written
+	for _, entry := range stateEntries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), provisionedPrefix) {
+			continue
+		}
+		if !takenStates[entry.Name()] {
+			o.states = append(o.states, entry.Name())
+		}
+	}
+
+	exported := map[string]bool{}
+	for _, block := range exportBlocks {
+		if !p.isProvisionedPath(block.path) {
+			continue
+		}
+		exported[block.path] = true
+		if !taken[block.path] {
+			o.exportBlocks = append(o.exportBlocks, block)
+		}
+	}
+
+	projects := map[string]bool{}
+	for _, block := range projectBlocks {
+		if !p.isProvisionedPath(block.path) {
+			continue
+		}
+		projects[block.path] = true
+		if !taken[block.path] {
+			o.projectBlocks = append(o.projectBlocks, block)
+		}
+	}
+
+	for _, volume := range mine {
+		directory := path.Join(p.exportDir, volume.Name)
+		missing := []string{}
+		if !directories[directory] {
+			missing = append(missing, "directory "+directory)
+		}
+		if !exported[directory] {
+			missing = append(missing, "export block")
+		}
+		// Volumes provisioned without a quota have an empty project block
+		if state, err := p.getVolumeState(&volume); err != nil {
+			missing = append(missing, "state")
+		} else if state.ProjectBlock != "" && !projects[directory] {
+			missing = append(missing, "quota project")
+		}
+		if len(missing) != 0 {
+			o.incomplete[volume.Name] = missing
+		}
+	}
+
+	return o, nil
+}
+
+// isProvisionedPath returns whether the given path could be the path of a
+// volume created by this provisioner.
+func (p *nfsProvisioner) isProvisionedPath(blockPath string) bool {
+	return path.Dir(path.Clean(blockPath)) == path.Clean(p.exportDir) && strings.HasPrefix(path.Base(blockPath), provisionedPrefix)
+}
+
+func (p *nfsProvisioner) reportOrphans(o *orphans) {
+	for _, directory := range o.directories {
+		glog.Warningf("Found orphaned directory %s without a PV", directory)
+	}
+	for _, directory := range o.snapshots {
+		glog.Warningf("Found orphaned snapshots %s without a PV", directory)
+	}
+	for _, block := range o.exportBlocks {
+		glog.Warningf("Found orphaned export block with id %d for path %s without a PV", block.id, block.path)
+	}
+	for _, block := range o.projectBlocks {
+		glog.Warningf("Found orphaned quota project with id %d for path %s without a PV", block.id, block.path)
+	}
+	for _, key := range o.states {
+		glog.Warningf("Found orphaned state entry %q without a PV", key)
+	}
+	for name, missing := range o.incomplete {
+		glog.Warningf("Found PV %q missing its %s", name, strings.Join(missing, ", "))
+	}
+}
+
+// removeOrphans removes the orphans that policy allows and that have been
+// orphans for at least gracePeriod as of now. firstFound is updated with the
+// orphans found and forgets the ones that no longer are.
+func (p *nfsProvisioner) removeOrphans(o *orphans, policy OrphanPolicy, gracePeriod time.Duration, firstFound map[string]time.Time, now time.Time) {
+	found := map[string]bool{}
+	expired := func(key string) bool {
+		found[key] = true
+		if _, ok := firstFound[key]; !ok {
+			firstFound[key] = now
+		}
+		return now.Sub(firstFound[key]) >= gracePeriod
+	}
+
+	for _, block := range o.exportBlocks {
+		if !expired("export:" + block.block) {
+			continue
+		}
+		if err := p.exporter.RemoveExportBlock(block.block, block.id); err != nil {
+			glog.Errorf("Error removing orphaned export block for path %s: %v", block.path, err)
+			continue
+		}
+		p.unexportBlock(block)
+		glog.Infof("Removed orphaned export block for path %s", block.path)
+	}
+
+	for _, block := range o.projectBlocks {
+		if !expired("project:" + block.block) {
+			continue
+		}
+		if err := p.quotaer.RemoveProject(block.block, block.id); err != nil {
+			glog.Errorf("Error removing orphaned quota project for path %s: %v", block.path, err)
+			continue
+		}
+		glog.Infof("Removed orphaned quota project for path %s", block.path)
+	}
+
+	for _, key := range o.states {
+		if !expired("state:" + key) {
+			continue
+		}
+		if err := p.state.Delete(key); err != nil {
+			glog.Errorf("Error removing orphaned state entry %q: %v", key, err)
+			continue
+		}
+		glog.Infof("Removed orphaned state entry %q", key)
+	}
+
+	if policy == OrphanPolicyRemoveAll {
+		for _, directory := range o.directories {
+			if !expired("directory:" + directory) {
+				continue
+			}
+			if err := os.RemoveAll(directory); err != nil {
+				glog.Errorf("Error removing orphaned directory %s: %v", directory, err)
+				continue
+			}
+			glog.Infof("Removed orphaned directory %s", directory)
+		}
+		for _, directory := range o.snapshots {
+			if !expired("snapshots:" + directory) {
+				continue
+			}
+			if err := os.RemoveAll(directory); err != nil {
+				glog.Errorf("Error removing orphaned snapshots %s: %v", directory, err)
+				continue
+			}
+			glog.Infof("Removed orphaned snapshots %s", directory)
+		}
+	}
+
+	for key := range firstFound {
+		if !found[key] {
+			delete(firstFound, key)
+		}
+	}
+}
@@ -25,13 +25,17 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"github.com/kubernetes-incubator/external-storage/nfs/pkg/util"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/api/resource"
+	"k8s.io/client-go/pkg/api/unversioned"
 	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/labels"
 	"k8s.io/client-go/pkg/types"
 	"k8s.io/client-go/pkg/util/uuid"
 )
@@ -44,19 +48,17 @@ const (
 	annCreatedBy = "kubernetes.io/createdby"
 	createdBy    = "nfs-dynamic-provisioner"
 
-	// A PV annotation for the entire ganesha EXPORT block or /etc/exports
-	// block, needed for deletion.
-	annExportBlock = "EXPORT_block"
-	// A PV annotation for the exportID of this PV's backing ganesha/kernel export
-	// , needed for ganesha deletion and used for deleting the entry in exportIDs
-	// map so the id can be reassigned.
-	annExportID = "Export_Id"
+	// A PV annotation for the key of the PV's entry in the stateStore
+	annStateKey = "State_Key"
 
-	// A PV annotation for the project quota info block, needed for quota
-	// deletion.
+	// PV annotations for the entire ganesha EXPORT block or /etc/exports block
+	// and its exportID, and the project quota info block and its id, set by
+	// provisioners that didn't have a stateStore. Migrated to the stateStore on
+	// startup.
+	annExportBlock  = "EXPORT_block"
+	annExportID     = "Export_Id"
 	annProjectBlock = "Project_block"
-	// A PV annotation for the project quota id, needed for quota deletion
-	annProjectID = "Project_Id"
+	annProjectID    = "Project_Id"
 
 	// VolumeGidAnnotationKey is the key of the annotation on the PersistentVolume
 	// object that specifies a supplemental GID.
@@ -71,29 +73,47 @@ const (
 	nodeEnv      = "NODE_NAME"
 )
 
+// The directories under exportDir that the provisioner keeps its own data in.
+// Volume directories can't clash with them since PV names can't start with a
+// dot.
+const (
+	// Contains a directory per snapshotted volume, which contains a directory
+	// per snapshot
+	snapshotDir = ".snapshots"
+	// Contains a file per volume being provisioned or deleted, journaling the
+	// operation
+	journalDir = ".journal"
+	// Contains a file per provisioned volume, named after its PV, holding its
+	// state
+	stateDir = ".state"
+)
+
 // NewNFSProvisioner creates a Provisioner that provisions NFS PVs backed by
-// the given directory.
-func NewNFSProvisioner(exportDir string, client kubernetes.Interface, outOfCluster bool, useGanesha bool, ganeshaConfig string, rootSquash bool, enableXfsQuota bool, serverHostname string) controller.Provisioner {
+// the given directory. Claims with a selector are only provisioned for if it
+// matches the given labels, which are then put on the provisioned PVs. Export
+// and quota project IDs are assigned from the given range. In a dry run,
+// state left by older versions is not migrated, only logged.
+func NewNFSProvisioner(exportDir string, client kubernetes.Interface, outOfCluster bool, useGanesha bool, ganeshaConfig string, rootSquash bool, enableQuota bool, serverHostname string, labels map[string]string, idRange IDRange, dryRun bool) controller.Provisioner {
 	var exporter exporter
 	if useGanesha {
-		exporter = newGaneshaExporter(ganeshaConfig, rootSquash)
+		exporter = newGaneshaExporter(ganeshaConfig, rootSquash, idRange)
 	} else {
-		exporter = newKernelExporter(rootSquash)
+		exporter = newKernelExporter(rootSquash, idRange)
 	}
 	var quotaer quotaer
 	var err error
-	if enableXfsQuota {
-		quotaer, err = newXfsQuotaer(exportDir)
+	if enableQuota {
+		quotaer, err = newQuotaer(exportDir, idRange)
 		if err != nil {
-			glog.Fatalf("Error creating xfs quotaer! %v", err)
+			glog.Fatalf("Error creating quotaer! %v", err)
 		}
 	} else {
 		quotaer = newDummyQuotaer()
 	}
-	return newNFSProvisionerInternal(exportDir, client, outOfCluster, exporter, quotaer, serverHostname)
+	return newNFSProvisionerInternal(exportDir, client, outOfCluster, exporter, quotaer, serverHostname, labels, dryRun)
 }
 
-func newNFSProvisionerInternal(exportDir string, client kubernetes.Interface, outOfCluster bool, exporter exporter, quotaer quotaer, serverHostname string) *nfsProvisioner {
+func newNFSProvisionerInternal(exportDir string, client kubernetes.Interface, outOfCluster bool, exporter exporter, quotaer quotaer, serverHostname string, labels map[string]string, dryRun bool) *nfsProvisioner {
 	if _, err := os.Stat(exportDir); os.IsNotExist(err) {
 		glog.Fatalf("exportDir %s does not exist!", exportDir)
 	}
@@ -102,7 +122,7 @@ func newNFSProvisionerInternal(exportDir string, client kubernetes.Interface, ou
 	identityPath := path.Join(exportDir, identityFile)
 	if _, err := os.Stat(identityPath); os.IsNotExist(err) {
 		identity = uuid.NewUUID()
-		err := ioutil.WriteFile(identityPath, []byte(identity), 0600)
+		err := util.WriteFileAtomic(identityPath, []byte(identity), 0600)
 		if err != nil {
 			glog.Fatalf("Error writing identity file %s! %v", identityPath, err)
 		}
@@ -114,6 +134,11 @@ func newNFSProvisionerInternal(exportDir string, client kubernetes.Interface, ou
 		identity = types.UID(strings.TrimSpace(string(read)))
 	}
 
+	state, err := newStateStore(path.Join(exportDir, stateDir))
+	if err != nil {
+		glog.Fatalf("Error creating state directory %s! %v", path.Join(exportDir, stateDir), err)
+	}
+
 	provisioner := &nfsProvisioner{
 		exportDir:      exportDir,
 		client:         client,
@@ -121,13 +146,28 @@ func newNFSProvisionerInternal(exportDir string, client kubernetes.Interface, ou
 		exporter:       exporter,
 		quotaer:        quotaer,
 		serverHostname: serverHostname,
+		labels:         labels,
 		identity:       identity,
+		state:          state,
+		journalMutex:   &sync.Mutex{},
+		dryRun:         dryRun,
 		podIPEnv:       podIPEnv,
 		serviceEnv:     serviceEnv,
 		namespaceEnv:   namespaceEnv,
 		nodeEnv:        nodeEnv,
 	}
 
+	journalPath := path.Join(exportDir, journalDir)
+	if err := os.MkdirAll(journalPath, 0700); err != nil {
+		glog.Fatalf("Error creating journal directory %s! %v", journalPath, err)
+	}
+	if err := provisioner.recoverIntents(); err != nil {
+		glog.Fatalf("Error recovering from journal %s! %v", journalPath, err)
+	}
+	if err := provisioner.migrateAnnotations(); err != nil {
+		glog.Errorf("Error migrating state from PV annotations, will use the annotations: %v", err)
+	}
+
 	return provisioner
 }
 
@@ -153,10 +193,25 @@ type nfsProvisioner struct {
 	// running as a Docker container
 	serverHostname string
 
+	// The labels this provisioner advertises. Claims with a selector are only
+	// provisioned for if it matches them & provisioned PVs are labeled with them
+	labels map[string]string
+
 	// Identity of this nfsProvisioner, generated & persisted to exportDir or
 	// recovered from there. Used to mark provisioned PVs
 	identity types.UID
 
+	// The state of provisioned volumes, persisted to exportDir
+	state *stateStore
+
+	// Guards the journal, so that the entry of a volume being deleted is never
+	// mistaken for the provision entry it replaced
+	journalMutex *sync.Mutex
+
+	// Whether the provisioner is only doing a dry run, in which case it must
+	// not change PVs or its state on startup, only log what it would do
+	dryRun bool
+
 	// Environment variables the provisioner pod needs valid values for in order to
 	// put a service cluster IP as the server of provisioned NFS PVs, passed in
 	// via downward API. If serviceEnv is set, namespaceEnv must be too.
@@ -167,30 +222,75 @@ type nfsProvisioner struct {
 }
 
 var _ controller.Provisioner = &nfsProvisioner{}
+var _ controller.Qualifier = &nfsProvisioner{}
+var _ Reconfigurable = &nfsProvisioner{}
+
+// Reconfigurable is the interface of the provisioner settings that can be
+// changed while it is running, e.g. on reload of its config file.
+type Reconfigurable interface {
+	// SetRootSquash sets whether volumes provisioned from now on squash root
+	SetRootSquash(bool)
+}
+
+// SetRootSquash sets whether volumes provisioned from now on are exported with
+// root squashed. Volumes already provisioned keep their exports.
+func (p *nfsProvisioner) SetRootSquash(rootSquash bool) {
+	p.exporter.SetRootSquash(rootSquash)
+}
+
+// ShouldProvision returns whether this provisioner in particular can provision
+// a volume with the given options, i.e. whether the claim's selector matches
+// its labels, it has the snapshot or volume to restore or clone, if any, and
+// it has enough available space. Problems common to all provisioners, like
+// invalid parameters, are left for Provision to report.
+func (p *nfsProvisioner) ShouldProvision(options controller.VolumeOptions) bool {
+	if err, ok := p.validateSelector(options).(*controller.IgnoredError); ok {
+		glog.V(4).Infof("Declining to provision volume %q: %v", options.PVName, err)
+		return false
+	}
+	if err, ok := p.validateSnapshotSource(options).(*controller.IgnoredError); ok {
+		glog.V(4).Infof("Declining to provision volume %q: %v", options.PVName, err)
+		return false
+	}
+	if err, ok := p.validateCloneSource(options).(*controller.IgnoredError); ok {
+		glog.V(4).Infof("Declining to provision volume %q: %v", options.PVName, err)
+		return false
+	}
+	if err := p.validateCapacity(options); err != nil {
+		glog.V(4).Infof("Declining to provision volume %q: %v", options.PVName, err)
+		return false
+	}
+	return true
+}
 
 // Provision creates a volume i.e. the storage asset and returns a PV object for
 // the volume.
 func (p *nfsProvisioner) Provision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
-	server, path, supGroup, exportBlock, exportID, projectBlock, projectID, err := p.createVolume(options)
+	volume, err := p.createVolume(options)
 	if err != nil {
 		return nil, err
 	}
 
 	annotations := make(map[string]string)
 	annotations[annCreatedBy] = createdBy
-	annotations[annExportBlock] = exportBlock
-	annotations[annExportID] = strconv.FormatUint(uint64(exportID), 10)
-	annotations[annProjectBlock] = projectBlock
-	annotations[annProjectID] = strconv.FormatUint(uint64(projectID), 10)
-	if supGroup != 0 {
-		annotations[VolumeGidAnnotationKey] = strconv.FormatUint(supGroup, 10)
+	annotations[annStateKey] = options.PVName
+	if volume.supGroup != 0 {
+		annotations[VolumeGidAnnotationKey] = strconv.FormatUint(volume.supGroup, 10)
+	}
+	if len(volume.mountOptions) != 0 {
+		annotations[controller.AnnMountOptions] = strings.Join(volume.mountOptions, ",")
 	}
 	annotations[annProvisionerID] = string(p.identity)
 
+	labels := make(map[string]string)
+	for k, v := range p.labels {
+		labels[k] = v
+	}
+
 	pv := &v1.PersistentVolume{
 		ObjectMeta: v1.ObjectMeta{
 			Name:        options.PVName,
-			Labels:      map[string]string{},
+			Labels:      labels,
 			Annotations: annotations,
 		},
 		Spec: v1.PersistentVolumeSpec{
@@ -201,9 +301,9 @@ func (p *nfsProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 			},
 			PersistentVolumeSource: v1.PersistentVolumeSource{
 				NFS: &v1.NFSVolumeSource{
-					Server:   server,
-					Path:     path,
-					ReadOnly: false,
+					Server:   volume.server,
+					Path:     volume.path,
+					ReadOnly: volume.readOnly,
 				},
 			},
 		},
@@ -212,47 +312,129 @@ func (p *nfsProvisioner) Provision(options controller.VolumeOptions) (*v1.Persis
 	return pv, nil
 }
 
+// volume is a volume created by createVolume, i.e. what its PV needs
+type volume struct {
+	// The server IP and the path of the directory exported
+	server string
+	path   string
+	// Zero or the supplemental group the directory is owned by
+	supGroup uint64
+	// The block added to either the ganesha config or /etc/exports, and the
+	// exportID
+	exportBlock string
+	exportID    uint16
+	// The block added to the projects file, and the projectID
+	projectBlock string
+	projectID    uint16
+	// The options clients should mount the export with
+	mountOptions []string
+	// Whether the export is read-only
+	readOnly bool
+}
+
 // createVolume creates a volume i.e. the storage asset. It creates a unique
-// directory under /export and exports it. Returns the server IP, the path, a
-// zero/non-zero supplemental group, the block it added to either the ganesha
-// config or /etc/exports, and the exportID
-// TODO return values
-func (p *nfsProvisioner) createVolume(options controller.VolumeOptions) (string, string, uint64, string, uint16, string, uint16, error) {
-	gid, err := p.validateOptions(options)
+// directory under /export and exports it.
+func (p *nfsProvisioner) createVolume(options controller.VolumeOptions) (*volume, error) {
+	gid, export, err := p.validateOptions(options)
 	if err != nil {
-		return "", "", 0, "", 0, "", 0, fmt.Errorf("error validating options for volume: %v", err)
+		if _, ok := err.(*controller.IgnoredError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error validating options for volume: %v", err)
 	}
 
 	server, err := p.getServer()
 	if err != nil {
-		return "", "", 0, "", 0, "", 0, fmt.Errorf("error getting NFS server IP for volume: %v", err)
+		return nil, fmt.Errorf("error getting NFS server IP for volume: %v", err)
 	}
 
 	path := path.Join(p.exportDir, options.PVName)
 
 	err = p.createDirectory(options.PVName, gid)
 	if err != nil {
-		return "", "", 0, "", 0, "", 0, fmt.Errorf("error creating directory for volume: %v", err)
+		return nil, fmt.Errorf("error creating directory for volume: %v", err)
 	}
 
-	exportBlock, exportID, err := p.createExport(options.PVName)
-	if err != nil {
+	// Journal the provision only once the directory is known to be this
+	// provision's own, so that recovery never removes a directory it didn't
+	// create. On success the entry is left until the controller has created
+	// the PV, which the orphan collector and recovery check for, since a crash
+	// before then leaves a volume that no PV will ever refer to.
+	if err := p.beginIntent(operationProvision, options.PVName); err != nil {
 		os.RemoveAll(path)
-		return "", "", 0, "", 0, "", 0, fmt.Errorf("error creating export for volume: %v", err)
+		return nil, fmt.Errorf("error journaling provision of volume: %v", err)
 	}
 
+	if source, ok := options.PVC.Annotations[controller.AnnSnapshotSource]; ok {
+		err = p.restoreSnapshot(source, options.PVName)
+		if err != nil {
+			os.RemoveAll(path)
+			p.endIntent(options.PVName)
+			return nil, fmt.Errorf("error restoring snapshot for volume: %v", err)
+		}
+	}
+
+	if _, ok := options.PVC.Annotations[controller.AnnCloneSource]; ok {
+		err = p.cloneVolume(options.PVC, options.PVName)
+		if err != nil {
+			os.RemoveAll(path)
+			p.endIntent(options.PVName)
+			return nil, fmt.Errorf("error cloning volume: %v", err)
+		}
+	}
+
+	// Set the quota before exporting so that the share is never available
+	// without one
 	projectBlock, projectID, err := p.createQuota(options.PVName, options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)])
 	if err != nil {
 		os.RemoveAll(path)
-		return "", "", 0, "", 0, "", 0, fmt.Errorf("error creating quota for volume: %v", err)
+		p.endIntent(options.PVName)
+		return nil, fmt.Errorf("error creating quota for volume: %v", err)
+	}
+
+	exportBlock, exportID, err := p.createExport(options.PVName, export)
+	if err != nil {
+		p.quotaer.RemoveProject(projectBlock, projectID)
+		os.RemoveAll(path)
+		p.endIntent(options.PVName)
+		return nil, fmt.Errorf("error creating export for volume: %v", err)
 	}
 
-	return server, path, 0, exportBlock, exportID, projectBlock, projectID, nil
+	state := &volumeState{
+		ExportBlock:  exportBlock,
+		ExportID:     exportID,
+		ProjectBlock: projectBlock,
+		ProjectID:    projectID,
+		Parameters:   options.Parameters,
+	}
+	if err := p.state.Put(options.PVName, state); err != nil {
+		p.exporter.RemoveExportBlock(exportBlock, exportID)
+		p.exporter.Unexport(exportID)
+		p.quotaer.RemoveProject(projectBlock, projectID)
+		os.RemoveAll(path)
+		p.endIntent(options.PVName)
+		return nil, fmt.Errorf("error saving state of volume: %v", err)
+	}
+
+	return &volume{
+		server:       server,
+		path:         path,
+		exportBlock:  exportBlock,
+		exportID:     exportID,
+		projectBlock: projectBlock,
+		projectID:    projectID,
+		mountOptions: export.mountOptions(options.MountOptions),
+		readOnly:     export.readOnly,
+	}, nil
 }
 
-func (p *nfsProvisioner) validateOptions(options controller.VolumeOptions) (string, error) {
+// validateOptions validates the StorageClass parameters and the claim. It
+// returns the gid parameter string and the export options.
+func (p *nfsProvisioner) validateOptions(options controller.VolumeOptions) (string, exportOptions, error) {
 	gid := "none"
+	export := exportOptions{}
 	for k, v := range options.Parameters {
+		var err error
 		switch strings.ToLower(k) {
 		case "gid":
 			if strings.ToLower(v) == "none" {
@@ -260,32 +442,116 @@ func (p *nfsProvisioner) validateOptions(options controller.VolumeOptions) (stri
 			} else if i, err := strconv.ParseUint(v, 10, 64); err == nil && i != 0 {
 				gid = v
 			} else {
-				return "", fmt.Errorf("invalid value for parameter gid: %v. valid values are: 'none' or a non-zero integer", v)
+				return "", exportOptions{}, fmt.Errorf("invalid value for parameter gid: %v. valid values are: 'none' or a non-zero integer", v)
+			}
+		case "clients":
+			export.clients, err = parseClients(v)
+		case "accesstype":
+			switch strings.ToUpper(v) {
+			case "RW":
+				export.readOnly = false
+			case "RO":
+				export.readOnly = true
+			default:
+				err = fmt.Errorf("valid values are: 'RW' or 'RO'")
 			}
+		case "squash":
+			export.squash, err = parseSquash(v)
+		case "anonuid":
+			export.anonUID, err = parseAnonID(v)
+		case "anongid":
+			export.anonGID, err = parseAnonID(v)
+		case "sectype":
+			export.secTypes, err = parseSecTypes(v)
+		case "protocols":
+			export.protocols, err = parseProtocols(v)
 		default:
-			return "", fmt.Errorf("invalid parameter: %q", k)
+			return "", exportOptions{}, fmt.Errorf("invalid parameter: %q", k)
 		}
+		if err != nil {
+			return "", exportOptions{}, fmt.Errorf("invalid value for parameter %s: %v. %v", k, v, err)
+		}
+	}
+
+	// The kernel NFS server can't allow versions per export, only server-wide
+	if _, ok := p.exporter.(*kernelExporter); ok && len(export.protocols) != 0 {
+		return "", exportOptions{}, fmt.Errorf("invalid parameter: %q, the kernel NFS server's versions can only be set server-wide, e.g. with rpc.nfsd --no-nfs-version", "protocols")
+	}
+
+	if err := export.validateMountOptions(options.MountOptions); err != nil {
+		return "", exportOptions{}, err
+	}
+
+	// Pods would mount a read-only export writable, then fail every write
+	if export.readOnly {
+		for _, mode := range options.PVC.Spec.AccessModes {
+			if mode != v1.ReadOnlyMany {
+				return "", exportOptions{}, fmt.Errorf("claim access mode %s is invalid for parameter accessType: RO, only %s is", mode, v1.ReadOnlyMany)
+			}
+		}
+	}
+
+	if err := p.validateSelector(options); err != nil {
+		return "", exportOptions{}, err
+	}
+
+	_, snapshot := options.PVC.Annotations[controller.AnnSnapshotSource]
+	_, clone := options.PVC.Annotations[controller.AnnCloneSource]
+	if snapshot && clone {
+		return "", exportOptions{}, fmt.Errorf("only one of annotations %s and %s may be set", controller.AnnSnapshotSource, controller.AnnCloneSource)
 	}
 
-	// TODO implement options.ProvisionerSelector parsing
-	// pv.Labels MUST be set to match claim.spec.selector
-	// gid selector? with or without pv annotation?
-	if options.PVC.Spec.Selector != nil {
-		return "", fmt.Errorf("claim.Spec.Selector is not supported")
+	if err := p.validateSnapshotSource(options); err != nil {
+		return "", exportOptions{}, err
 	}
 
+	if err := p.validateCloneSource(options); err != nil {
+		return "", exportOptions{}, err
+	}
+
+	if err := p.validateCapacity(options); err != nil {
+		return "", exportOptions{}, err
+	}
+
+	return gid, export, nil
+}
+
+// validateSelector checks that the claim's selector, if any, matches this
+// provisioner's labels, which pv.Labels will be set to. If it doesn't, the
+// claim is ignored so that another provisioner may provision it.
+func (p *nfsProvisioner) validateSelector(options controller.VolumeOptions) error {
+	if options.PVC.Spec.Selector == nil {
+		return nil
+	}
+	selector, err := unversioned.LabelSelectorAsSelector(options.PVC.Spec.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid claim.Spec.Selector: %v", err)
+	}
+	if !selector.Matches(labels.Set(p.labels)) {
+		return &controller.IgnoredError{Reason: fmt.Sprintf("claim.Spec.Selector %q doesn't match labels %q", selector.String(), labels.Set(p.labels).String())}
+	}
+	return nil
+}
+
+// validateCapacity checks that there is enough available space in exportDir
+// to satisfy the claim.
+func (p *nfsProvisioner) validateCapacity(options controller.VolumeOptions) error {
+	capacity := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	return p.validateAvailable(capacity.Value())
+}
+
+// validateAvailable checks that there is at least requestBytes of available
+// space in exportDir.
+func (p *nfsProvisioner) validateAvailable(requestBytes int64) error {
 	var stat syscall.Statfs_t
 	if err := syscall.Statfs(p.exportDir, &stat); err != nil {
-		return "", fmt.Errorf("error calling statfs on %v: %v", p.exportDir, err)
+		return fmt.Errorf("error calling statfs on %v: %v", p.exportDir, err)
 	}
-	capacity := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
-	requestBytes := capacity.Value()
 	available := int64(stat.Bavail) * int64(stat.Bsize)
 	if requestBytes > available {
-		return "", fmt.Errorf("insufficient available space %v bytes to satisfy claim for %v bytes", available, requestBytes)
+		return fmt.Errorf("insufficient available space %v bytes to satisfy claim for %v bytes", available, requestBytes)
 	}
-
-	return gid, nil
+	return nil
 }
 
 // getServer gets the server IP to put in a provisioned PV's spec.
@@ -414,10 +680,10 @@ func (p *nfsProvisioner) createDirectory(directory, gid string) error {
 
 // createExport creates the export by adding a block to the appropriate config
 // file and exporting it
-func (p *nfsProvisioner) createExport(directory string) (string, uint16, error) {
+func (p *nfsProvisioner) createExport(directory string, options exportOptions) (string, uint16, error) {
 	path := path.Join(p.exportDir, directory)
 
-	block, exportID, err := p.exporter.AddExportBlock(path)
+	block, exportID, err := p.exporter.AddExportBlock(path, options)
 	if err != nil {
 		return "", 0, fmt.Errorf("error adding export block for path %s: %v", path, err)
 	}
@@ -19,7 +19,9 @@ package volume
 import (
 	"errors"
 	"io/ioutil"
+	"math"
 	"os"
+	"path"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -27,6 +29,8 @@ import (
 	"sync"
 	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
 	"k8s.io/client-go/kubernetes/fake"
@@ -34,6 +38,7 @@ import (
 	"k8s.io/client-go/pkg/api/unversioned"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/runtime"
+	"k8s.io/client-go/pkg/types"
 	utiltesting "k8s.io/client-go/pkg/util/testing"
 )
 
@@ -50,6 +55,8 @@ func TestCreateVolume(t *testing.T) {
 		expectedGroup    uint64
 		expectedBlock    string
 		expectedExportID uint16
+		expectedMount    []string
+		expectedReadOnly bool
 		expectError      bool
 	}{
 		{
@@ -84,6 +91,75 @@ func TestCreateVolume(t *testing.T) {
 			expectedExportID: 0,
 			expectError:      false,
 		},
+		{
+			name: "succeed creating volume with protocols",
+			options: controller.VolumeOptions{
+				PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				PVName:     "pvc-5",
+				PVC:        newClaim(resource.MustParse("1Ki"), []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany}, nil),
+				Parameters: map[string]string{"protocols": "4,3"},
+			},
+			envKey:           podIPEnv,
+			expectedServer:   "1.1.1.1",
+			expectedPath:     tmpDir + "/pvc-5",
+			expectedGroup:    0,
+			expectedBlock:    "\nExport_Id = 0;\n",
+			expectedExportID: 0,
+			expectedMount:    []string{"nfsvers=4"},
+			expectError:      false,
+		},
+		{
+			name: "succeed creating volume with protocols and mount options",
+			options: controller.VolumeOptions{
+				PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				PVName:       "pvc-6",
+				PVC:          newClaim(resource.MustParse("1Ki"), []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany}, nil),
+				Parameters:   map[string]string{"protocols": "3,4"},
+				MountOptions: []string{"hard", "vers=3"},
+			},
+			envKey:           podIPEnv,
+			expectedServer:   "1.1.1.1",
+			expectedPath:     tmpDir + "/pvc-6",
+			expectedGroup:    0,
+			expectedBlock:    "\nExport_Id = 0;\n",
+			expectedExportID: 0,
+			expectedMount:    []string{"hard", "vers=3"},
+			expectError:      false,
+		},
+		{
+			name: "mount options choose a version protocols don't allow",
+			options: controller.VolumeOptions{
+				PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				PVName:       "pvc-7",
+				PVC:          newClaim(resource.MustParse("1Ki"), []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany}, nil),
+				Parameters:   map[string]string{"protocols": "4"},
+				MountOptions: []string{"nfsvers=3"},
+			},
+			envKey:           podIPEnv,
+			expectedServer:   "",
+			expectedPath:     "",
+			expectedGroup:    0,
+			expectedBlock:    "",
+			expectedExportID: 0,
+			expectError:      true,
+		},
+		{
+			name: "mount options choose no version",
+			options: controller.VolumeOptions{
+				PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				PVName:       "pvc-7",
+				PVC:          newClaim(resource.MustParse("1Ki"), []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany}, nil),
+				Parameters:   map[string]string{"protocols": "4"},
+				MountOptions: []string{"hard", "nfsvers"},
+			},
+			envKey:           podIPEnv,
+			expectedServer:   "",
+			expectedPath:     "",
+			expectedGroup:    0,
+			expectedBlock:    "",
+			expectedExportID: 0,
+			expectError:      true,
+		},
 		{
 			name: "bad parameter",
 			options: controller.VolumeOptions{
@@ -148,6 +224,23 @@ func TestCreateVolume(t *testing.T) {
 			expectedExportID: 0,
 			expectError:      true,
 		},
+		{
+			name: "succeed creating read-only volume",
+			options: controller.VolumeOptions{
+				PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				PVName:     "pvc-8",
+				PVC:        newClaim(resource.MustParse("1Ki"), []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany}, nil),
+				Parameters: map[string]string{"accessType": "RO"},
+			},
+			envKey:           podIPEnv,
+			expectedServer:   "1.1.1.1",
+			expectedPath:     tmpDir + "/pvc-8",
+			expectedGroup:    0,
+			expectedBlock:    "\nExport_Id = 0;\n",
+			expectedExportID: 0,
+			expectedReadOnly: true,
+			expectError:      false,
+		},
 	}
 
 	client := fake.NewSimpleClientset()
@@ -156,18 +249,33 @@ func TestCreateVolume(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error creating file %s: %v", conf, err)
 	}
-	p := newNFSProvisionerInternal(tmpDir+"/", client, false, &testExporter{config: conf}, newDummyQuotaer(), "")
+	p := newNFSProvisionerInternal(tmpDir+"/", client, false, &testExporter{config: conf}, newDummyQuotaer(), "", nil, false)
 
 	for _, test := range tests {
 		os.Setenv(test.envKey, "1.1.1.1")
 
-		server, path, supGroup, block, exportID, _, _, err := p.createVolume(test.options)
+		created, err := p.createVolume(test.options)
+		if created == nil {
+			created = &volume{}
+		}
+
+		evaluate(t, test.name, test.expectError, err, test.expectedServer, created.server, "server")
+		evaluate(t, test.name, test.expectError, err, test.expectedPath, created.path, "path")
+		evaluate(t, test.name, test.expectError, err, test.expectedGroup, created.supGroup, "group")
+		evaluate(t, test.name, test.expectError, err, test.expectedBlock, created.exportBlock, "block")
+		evaluate(t, test.name, test.expectError, err, test.expectedExportID, created.exportID, "export id")
+		evaluate(t, test.name, test.expectError, err, test.expectedMount, created.mountOptions, "mount options")
+		evaluate(t, test.name, test.expectError, err, test.expectedReadOnly, created.readOnly, "read-only")
 
-		evaluate(t, test.name, test.expectError, err, test.expectedServer, server, "server")
-		evaluate(t, test.name, test.expectError, err, test.expectedPath, path, "path")
-		evaluate(t, test.name, test.expectError, err, test.expectedGroup, supGroup, "group")
-		evaluate(t, test.name, test.expectError, err, test.expectedBlock, block, "block")
-		evaluate(t, test.name, test.expectError, err, test.expectedExportID, exportID, "export id")
+		if !test.expectError {
+			state, err := p.state.Get(test.options.PVName)
+			expectedState := &volumeState{ExportBlock: test.expectedBlock, ExportID: test.expectedExportID, Parameters: test.options.Parameters}
+			evaluate(t, test.name, false, err, expectedState, state, "state")
+
+			// The journal entry is kept until the PV exists
+			_, err = os.Stat(p.getIntentPath(test.options.PVName))
+			evaluate(t, test.name, false, nil, false, os.IsNotExist(err), "intent removed")
+		}
 
 		os.Unsetenv(test.envKey)
 	}
@@ -178,10 +286,12 @@ func TestValidateOptions(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 
 	tests := []struct {
-		name        string
-		options     controller.VolumeOptions
-		expectedGid string
-		expectError bool
+		name           string
+		options        controller.VolumeOptions
+		expectedGid    string
+		expectedExport exportOptions
+		expectError    bool
+		expectIgnored  bool
 	}{
 		{
 			name: "empty parameters",
@@ -217,49 +327,978 @@ func TestValidateOptions(t *testing.T) {
 			expectError: true,
 		},
 		{
-			name:        "bad gid parameter value string",
-			options:     controller.VolumeOptions{Parameters: map[string]string{"gid": "foo"}},
-			expectedGid: "",
-			expectError: true,
+			name:        "bad gid parameter value string",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"gid": "foo"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "bad gid parameter value zero",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"gid": "0"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "bad gid parameter value negative",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"gid": "-1"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name: "export parameters",
+			options: controller.VolumeOptions{
+				Parameters: map[string]string{"clients": "10.0.0.0/8, 192.168.1.1,*.example.com", "accessType": "ro", "squash": "All", "anonUID": "65534", "anonGID": "0"},
+				PVC:        newClaim(resource.MustParse("1Ki"), nil, nil),
+			},
+			expectedGid: "none",
+			expectedExport: exportOptions{
+				clients:  []string{"10.0.0.0/8", "192.168.1.1", "*.example.com"},
+				readOnly: true,
+				squash:   squashAll,
+				anonUID:  "65534",
+				anonGID:  "0",
+			},
+			expectError: false,
+		},
+		{
+			name:        "bad clients parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"clients": "10.0.0.0/8,bad host"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "empty clients parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"clients": ""}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name: "read-only class with read-only claim",
+			options: controller.VolumeOptions{
+				Parameters: map[string]string{"accessType": "RO"},
+				PVC:        newClaim(resource.MustParse("1Ki"), []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany}, nil),
+			},
+			expectedGid:    "none",
+			expectedExport: exportOptions{readOnly: true},
+			expectError:    false,
+		},
+		{
+			name: "read-only class with writable claim",
+			options: controller.VolumeOptions{
+				Parameters: map[string]string{"accessType": "RO"},
+				PVC:        newClaim(resource.MustParse("1Ki"), []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany}, nil),
+			},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "bad accessType parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"accessType": "wo"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "bad squash parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"squash": "some"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name: "secType parameter",
+			options: controller.VolumeOptions{
+				Parameters: map[string]string{"secType": "krb5p, KRB5i"},
+				PVC:        newClaim(resource.MustParse("1Ki"), nil, nil),
+			},
+			expectedGid:    "none",
+			expectedExport: exportOptions{secTypes: []string{"krb5p", "krb5i"}},
+			expectError:    false,
+		},
+		{
+			name: "protocols parameter",
+			options: controller.VolumeOptions{
+				Parameters: map[string]string{"protocols": "4, 3"},
+				PVC:        newClaim(resource.MustParse("1Ki"), nil, nil),
+			},
+			expectedGid:    "none",
+			expectedExport: exportOptions{protocols: []string{"3", "4"}},
+			expectError:    false,
+		},
+		{
+			name:        "bad protocols parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"protocols": "4.1"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "bad secType parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"secType": "krb5,ntlm"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name:        "bad anonUID parameter value",
+			options:     controller.VolumeOptions{Parameters: map[string]string{"anonUID": "-2"}},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name: "empty selector",
+			options: controller.VolumeOptions{
+				PVC: newClaim(resource.MustParse("1Ki"), nil, &unversioned.LabelSelector{MatchLabels: nil}),
+			},
+			expectedGid: "none",
+			expectError: false,
+		},
+		{
+			name: "matching selector labels",
+			options: controller.VolumeOptions{
+				PVC: newClaim(resource.MustParse("1Ki"), nil, &unversioned.LabelSelector{MatchLabels: map[string]string{"tier": "gold"}}),
+			},
+			expectedGid: "none",
+			expectError: false,
+		},
+		{
+			name: "matching selector expressions",
+			options: controller.VolumeOptions{
+				PVC: newClaim(resource.MustParse("1Ki"), nil, &unversioned.LabelSelector{
+					MatchExpressions: []unversioned.LabelSelectorRequirement{
+						{Key: "pool", Operator: unversioned.LabelSelectorOpIn, Values: []string{"ssd", "nvme"}},
+						{Key: "zone", Operator: unversioned.LabelSelectorOpDoesNotExist},
+					},
+				}),
+			},
+			expectedGid: "none",
+			expectError: false,
+		},
+		{
+			name: "non-matching selector labels",
+			options: controller.VolumeOptions{
+				PVC: newClaim(resource.MustParse("1Ki"), nil, &unversioned.LabelSelector{MatchLabels: map[string]string{"tier": "silver"}}),
+			},
+			expectedGid:   "",
+			expectError:   true,
+			expectIgnored: true,
+		},
+		{
+			name: "non-matching selector expressions",
+			options: controller.VolumeOptions{
+				PVC: newClaim(resource.MustParse("1Ki"), nil, &unversioned.LabelSelector{
+					MatchExpressions: []unversioned.LabelSelectorRequirement{
+						{Key: "pool", Operator: unversioned.LabelSelectorOpNotIn, Values: []string{"ssd"}},
+					},
+				}),
+			},
+			expectedGid:   "",
+			expectError:   true,
+			expectIgnored: true,
+		},
+		{
+			name: "bad selector operator",
+			options: controller.VolumeOptions{
+				PVC: newClaim(resource.MustParse("1Ki"), nil, &unversioned.LabelSelector{
+					MatchExpressions: []unversioned.LabelSelectorRequirement{
+						{Key: "pool", Operator: "foo", Values: []string{"ssd"}},
+					},
+				}),
+			},
+			expectedGid: "",
+			expectError: true,
+		},
+		{
+			name: "bad capacity",
+			options: controller.VolumeOptions{
+				PVC: newClaim(resource.MustParse("1Ei"), nil, nil),
+			},
+			expectedGid: "",
+			expectError: true,
+		},
+	}
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, false, &testExporter{}, newDummyQuotaer(), "", map[string]string{"tier": "gold", "pool": "ssd"}, false)
+
+	for _, test := range tests {
+		gid, export, err := p.validateOptions(test.options)
+
+		evaluate(t, test.name, test.expectError, err, test.expectedGid, gid, "gid")
+		evaluate(t, test.name, test.expectError, err, test.expectedExport, export, "export options")
+		if _, ok := err.(*controller.IgnoredError); ok != test.expectIgnored {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected ignored error %v but got %v", test.expectIgnored, err)
+		}
+	}
+
+	// The kernel NFS server can't allow versions per export
+	p.exporter = &kernelExporter{}
+	options := controller.VolumeOptions{
+		PVC:        newClaim(resource.MustParse("1Ki"), nil, nil),
+		Parameters: map[string]string{"protocols": "4"},
+	}
+	_, _, err := p.validateOptions(options)
+	evaluate(t, "protocols with kernel exporter", true, err, nil, nil, "protocols")
+}
+
+func TestShouldProvision(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name           string
+		options        controller.VolumeOptions
+		expectedShould bool
+	}{
+		{
+			name: "no selector",
+			options: controller.VolumeOptions{
+				PVC: newClaim(resource.MustParse("1Ki"), nil, nil),
+			},
+			expectedShould: true,
+		},
+		{
+			name: "matching selector",
+			options: controller.VolumeOptions{
+				PVC: newClaim(resource.MustParse("1Ki"), nil, &unversioned.LabelSelector{MatchLabels: map[string]string{"tier": "gold"}}),
+			},
+			expectedShould: true,
+		},
+		{
+			name: "non-matching selector",
+			options: controller.VolumeOptions{
+				PVC: newClaim(resource.MustParse("1Ki"), nil, &unversioned.LabelSelector{MatchLabels: map[string]string{"tier": "silver"}}),
+			},
+			expectedShould: false,
+		},
+		{
+			name: "bad selector operator, left for Provision to report",
+			options: controller.VolumeOptions{
+				PVC: newClaim(resource.MustParse("1Ki"), nil, &unversioned.LabelSelector{
+					MatchExpressions: []unversioned.LabelSelectorRequirement{
+						{Key: "pool", Operator: "foo", Values: []string{"ssd"}},
+					},
+				}),
+			},
+			expectedShould: true,
+		},
+		{
+			name: "bad parameter, left for Provision to report",
+			options: controller.VolumeOptions{
+				Parameters: map[string]string{"foo": "bar"},
+				PVC:        newClaim(resource.MustParse("1Ki"), nil, nil),
+			},
+			expectedShould: true,
+		},
+		{
+			name: "bad capacity",
+			options: controller.VolumeOptions{
+				PVC: newClaim(resource.MustParse("1Ei"), nil, nil),
+			},
+			expectedShould: false,
+		},
+	}
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, false, &testExporter{}, newDummyQuotaer(), "", map[string]string{"tier": "gold"}, false)
+
+	for _, test := range tests {
+		should := p.ShouldProvision(test.options)
+		if test.expectedShould != should {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected should provision %v but got %v", test.expectedShould, should)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, false, &testExporter{}, newDummyQuotaer(), "", nil, false)
+	if err := p.state.Put("pvc-1", &volumeState{}); err != nil {
+		t.Fatalf("Error saving state: %v", err)
+	}
+
+	tests := []struct {
+		name             string
+		provisionerID    string
+		capacity         resource.Quantity
+		expectedCapacity resource.Quantity
+		expectError      bool
+		expectIgnored    bool
+	}{
+		{
+			name:             "grow",
+			provisionerID:    string(p.identity),
+			capacity:         resource.MustParse("2Ki"),
+			expectedCapacity: resource.MustParse("2Ki"),
+		},
+		{
+			name:          "shrink",
+			provisionerID: string(p.identity),
+			capacity:      resource.MustParse("512"),
+			expectError:   true,
+		},
+		{
+			name:          "insufficient available space",
+			provisionerID: string(p.identity),
+			capacity:      resource.MustParse("1Ei"),
+			expectError:   true,
+		},
+		{
+			name:          "another provisioner's volume",
+			provisionerID: "foo",
+			capacity:      resource.MustParse("2Ki"),
+			expectError:   true,
+			expectIgnored: true,
+		},
+	}
+
+	for _, test := range tests {
+		volume := &v1.PersistentVolume{
+			ObjectMeta: v1.ObjectMeta{
+				Name: "pvc-1",
+				Annotations: map[string]string{
+					annProvisionerID: test.provisionerID,
+					annStateKey:      "pvc-1",
+				},
+			},
+			Spec: v1.PersistentVolumeSpec{
+				Capacity: v1.ResourceList{
+					v1.ResourceName(v1.ResourceStorage): resource.MustParse("1Ki"),
+				},
+			},
+		}
+
+		newVolume, err := p.Resize(volume, test.capacity)
+		if _, ok := err.(*controller.IgnoredError); ok != test.expectIgnored {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected ignored error %v but got %v", test.expectIgnored, err)
+		}
+		var capacity resource.Quantity
+		if newVolume != nil {
+			capacity = newVolume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+		}
+		evaluate(t, test.name, test.expectError, err, test.expectedCapacity.Value(), capacity.Value(), "capacity")
+
+		original := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+		if original.Cmp(resource.MustParse("1Ki")) != 0 {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected given volume to be unmodified but its capacity is %s", original.String())
+		}
+	}
+
+	// A volume provisioned without a quota only has its capacity resized, even
+	// if quotas have since been enabled
+	if err := os.Mkdir(path.Join(tmpDir, "pvc-2"), 0777); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	projects := "\n5:" + path.Join(tmpDir, "pvc-2") + ":1024\n"
+	if err := ioutil.WriteFile(path.Join(tmpDir, "projects"), []byte(projects), 0600); err != nil {
+		t.Fatalf("Error writing projects file: %v", err)
+	}
+	q, err := newProjectQuotaer(tmpDir, DefaultIDRange, &testProjectSetter{projects: map[string]uint16{}, limits: map[uint16]string{}})
+	if err != nil {
+		t.Fatalf("Error creating quotaer: %v", err)
+	}
+	p.quotaer = q
+	volume := newProvisionedVolume("pvc-1", string(p.identity))
+	volume.Spec.Capacity = v1.ResourceList{v1.ResourceName(v1.ResourceStorage): resource.MustParse("1Ki")}
+	newVolume, err := p.Resize(volume, resource.MustParse("2Ki"))
+	var capacity resource.Quantity
+	if newVolume != nil {
+		capacity = newVolume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	}
+	evaluate(t, "no quota project", false, err, int64(2048), capacity.Value(), "capacity")
+	read, _ := ioutil.ReadFile(path.Join(tmpDir, "projects"))
+	evaluate(t, "no quota project", false, nil, projects, string(read), "projects file")
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	client := fake.NewSimpleClientset()
+	p := newNFSProvisionerInternal(tmpDir+"/", client, false, &testExporter{}, newDummyQuotaer(), "", nil, false)
+	p.client = fake.NewSimpleClientset(newCloneSourceVolume("pvc-1", string(p.identity), newBoundClaim("source-1", "uid-1", "pvc-1")))
+
+	if err := p.createDirectory("pvc-1", "none"); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(tmpDir, "pvc-1", "data"), []byte("foo"), 0600); err != nil {
+		t.Fatalf("Error writing data: %v", err)
+	}
+	volume := &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "pvc-1",
+			Annotations: map[string]string{annProvisionerID: string(p.identity)},
+		},
+	}
+
+	// Taking the same snapshot again, e.g. because recording it failed, succeeds
+	for i := 0; i < 2; i++ {
+		if err := p.Snapshot(volume, "snap-1"); err != nil {
+			t.Errorf("Unexpected error taking snapshot: %v", err)
+		}
+	}
+	// Changes after the snapshot is taken aren't in it
+	ioutil.WriteFile(path.Join(tmpDir, "pvc-1", "data"), []byte("bar"), 0600)
+
+	volume.Annotations[annProvisionerID] = "foo"
+	if err := p.Snapshot(volume, "snap-2"); err == nil {
+		t.Errorf("Expected ignored error taking snapshot of another provisioner's volume but got none")
+	} else if _, ok := err.(*controller.IgnoredError); !ok {
+		t.Errorf("Expected ignored error taking snapshot of another provisioner's volume but got %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		source        string
+		namespace     string
+		capacity      resource.Quantity
+		expectError   bool
+		expectIgnored bool
+	}{
+		{
+			name:      "existing snapshot",
+			source:    "pvc-1/snap-1",
+			namespace: v1.NamespaceDefault,
+			capacity:  resource.MustParse("1Ki"),
+		},
+		{
+			name:          "missing snapshot",
+			source:        "pvc-1/snap-2",
+			namespace:     v1.NamespaceDefault,
+			capacity:      resource.MustParse("1Ki"),
+			expectError:   true,
+			expectIgnored: true,
+		},
+		{
+			name:        "bad source",
+			source:      "../pvc-1/snap-1",
+			namespace:   v1.NamespaceDefault,
+			capacity:    resource.MustParse("1Ki"),
+			expectError: true,
+		},
+		{
+			name:        "source volume in another namespace",
+			source:      "pvc-1/snap-1",
+			namespace:   "other",
+			capacity:    resource.MustParse("1Ki"),
+			expectError: true,
+		},
+		{
+			name:        "less than source volume capacity",
+			source:      "pvc-1/snap-1",
+			namespace:   v1.NamespaceDefault,
+			capacity:    resource.MustParse("512"),
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		claim := newClaim(test.capacity, nil, nil)
+		claim.Namespace = test.namespace
+		claim.Annotations = map[string]string{controller.AnnSnapshotSource: test.source}
+		_, _, err := p.validateOptions(controller.VolumeOptions{PVC: claim})
+		evaluate(t, test.name, test.expectError, err, nil, nil, "source")
+		if _, ok := err.(*controller.IgnoredError); ok != test.expectIgnored {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected ignored error %v but got %v", test.expectIgnored, err)
+		}
+	}
+
+	if err := p.createDirectory("pvc-2", "none"); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	if err := p.restoreSnapshot("pvc-1/snap-1", "pvc-2"); err != nil {
+		t.Errorf("Unexpected error restoring snapshot: %v", err)
+	}
+	read, _ := ioutil.ReadFile(path.Join(tmpDir, "pvc-2", "data"))
+	if "foo" != string(read) {
+		t.Errorf("Expected restored data %s but got %s", "foo", string(read))
+	}
+	fi, _ := os.Stat(path.Join(tmpDir, "pvc-2"))
+	if fi.Mode().Perm() != os.FileMode(0777) {
+		t.Errorf("Expected restored directory permission bits %v but got %v", os.FileMode(0777), fi.Mode().Perm())
+	}
+}
+
+func TestClone(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), false, &testExporter{}, newDummyQuotaer(), "", nil, false)
+	p.client = fake.NewSimpleClientset(
+		newBoundClaim("source-1", "uid-1", "pvc-1"),
+		newCloneSourceVolume("pvc-1", string(p.identity), newBoundClaim("source-1", "uid-1", "pvc-1")),
+		newBoundClaim("source-2", "uid-2", "pvc-2"),
+		newCloneSourceVolume("pvc-2", "foo", newBoundClaim("source-2", "uid-2", "pvc-2")),
+		newBoundClaim("source-3", "uid-3", ""),
+	)
+
+	if err := p.createDirectory("pvc-1", "none"); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(tmpDir, "pvc-1", "data"), []byte("foo"), 0640); err != nil {
+		t.Fatalf("Error writing data: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		annotations   map[string]string
+		capacity      resource.Quantity
+		expectError   bool
+		expectIgnored bool
+	}{
+		{
+			name:        "own source",
+			annotations: map[string]string{controller.AnnCloneSource: "source-1"},
+			capacity:    resource.MustParse("1Ki"),
+		},
+		{
+			name:          "another provisioner's source",
+			annotations:   map[string]string{controller.AnnCloneSource: "source-2"},
+			capacity:      resource.MustParse("1Ki"),
+			expectError:   true,
+			expectIgnored: true,
+		},
+		{
+			name:        "unbound source",
+			annotations: map[string]string{controller.AnnCloneSource: "source-3"},
+			capacity:    resource.MustParse("1Ki"),
+			expectError: true,
+		},
+		{
+			name:        "missing source",
+			annotations: map[string]string{controller.AnnCloneSource: "source-4"},
+			capacity:    resource.MustParse("1Ki"),
+			expectError: true,
+		},
+		{
+			name:        "capacity less than source's",
+			annotations: map[string]string{controller.AnnCloneSource: "source-1"},
+			capacity:    resource.MustParse("512"),
+			expectError: true,
+		},
+		{
+			name:        "snapshot source as well",
+			annotations: map[string]string{controller.AnnCloneSource: "source-1", controller.AnnSnapshotSource: "pvc-1/snap-1"},
+			capacity:    resource.MustParse("1Ki"),
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		claim := newClaim(test.capacity, nil, nil)
+		claim.Namespace = v1.NamespaceDefault
+		claim.Annotations = test.annotations
+		_, _, err := p.validateOptions(controller.VolumeOptions{PVC: claim})
+		evaluate(t, test.name, test.expectError, err, nil, nil, "source")
+		if _, ok := err.(*controller.IgnoredError); ok != test.expectIgnored {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected ignored error %v but got %v", test.expectIgnored, err)
+		}
+	}
+
+	if err := p.createDirectory("pvc-3", "none"); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	claim := newClaim(resource.MustParse("1Ki"), nil, nil)
+	claim.Namespace = v1.NamespaceDefault
+	claim.Annotations = map[string]string{controller.AnnCloneSource: "source-1"}
+	if err := p.cloneVolume(claim, "pvc-3"); err != nil {
+		t.Errorf("Unexpected error cloning volume: %v", err)
+	}
+	read, _ := ioutil.ReadFile(path.Join(tmpDir, "pvc-3", "data"))
+	if "foo" != string(read) {
+		t.Errorf("Expected cloned data %s but got %s", "foo", string(read))
+	}
+	fi, _ := os.Stat(path.Join(tmpDir, "pvc-3", "data"))
+	if fi.Mode().Perm() != os.FileMode(0640) {
+		t.Errorf("Expected cloned data permission bits %v but got %v", os.FileMode(0640), fi.Mode().Perm())
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exporter := &testExporter{}
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), false, exporter, newDummyQuotaer(), "", nil, false)
+	p.client = fake.NewSimpleClientset(
+		newProvisionedVolume("pvc-1", string(p.identity)),
+		newProvisionedVolume("pvc-3", string(p.identity)),
+		newProvisionedVolume("pvc-5", "other-identity"),
+	)
+	for _, volumeName := range []string{"pvc-1", "pvc-3", "pvc-4"} {
+		if err := p.state.Put(volumeName, &volumeState{}); err != nil {
+			t.Fatalf("Error saving state: %v", err)
+		}
+	}
+	for _, directory := range []string{"pvc-1", "pvc-2", "pvc-5", "lost+found", ".snapshots/pvc-1/snap-1", ".snapshots/pvc-7/snap-1"} {
+		if err := os.MkdirAll(path.Join(tmpDir, directory), 0777); err != nil {
+			t.Fatalf("Error creating directory: %v", err)
+		}
+	}
+	exporter.blocks = []configBlock{
+		{block: "1", path: path.Join(tmpDir, "pvc-1"), id: 1},
+		{block: "4", path: path.Join(tmpDir, "pvc-4"), id: 4},
+		{block: "6", path: "/elsewhere/pvc-6", id: 6},
+	}
+
+	o, err := p.findOrphans()
+	if err != nil {
+		t.Fatalf("Error finding orphans: %v", err)
+	}
+	expected := &orphans{
+		directories:  []string{path.Join(tmpDir, "pvc-2")},
+		snapshots:    []string{path.Join(tmpDir, snapshotDir, "pvc-7")},
+		exportBlocks: []configBlock{exporter.blocks[1]},
+		states:       []string{"pvc-4"},
+		incomplete: map[string][]string{
+			"pvc-3": {"directory " + path.Join(tmpDir, "pvc-3"), "export block"},
+		},
+	}
+	if !reflect.DeepEqual(expected, o) {
+		t.Errorf("expected orphans %+v but got %+v", expected, o)
+	}
+
+	tests := []struct {
+		name            string
+		policy          OrphanPolicy
+		gracePeriod     time.Duration
+		expectedRemoved bool
+	}{
+		{
+			name:            "keep directory with policy RemoveBlocks",
+			policy:          OrphanPolicyRemoveBlocks,
+			gracePeriod:     0,
+			expectedRemoved: false,
+		},
+		{
+			name:            "keep directory orphaned for less than grace period",
+			policy:          OrphanPolicyRemoveAll,
+			gracePeriod:     time.Hour,
+			expectedRemoved: false,
+		},
+		{
+			name:            "remove directory with policy RemoveAll",
+			policy:          OrphanPolicyRemoveAll,
+			gracePeriod:     0,
+			expectedRemoved: true,
+		},
+	}
+	for _, test := range tests {
+		p.removeOrphans(o, test.policy, test.gracePeriod, map[string]time.Time{}, time.Now())
+		_, err := os.Stat(path.Join(tmpDir, "pvc-2"))
+		removed := os.IsNotExist(err)
+		evaluate(t, test.name, false, nil, test.expectedRemoved, removed, "directory removed")
+		_, err = os.Stat(path.Join(tmpDir, snapshotDir, "pvc-7"))
+		removed = os.IsNotExist(err)
+		evaluate(t, test.name, false, nil, test.expectedRemoved, removed, "snapshots removed")
+	}
+	if _, err := os.Stat(path.Join(tmpDir, snapshotDir, "pvc-1")); err != nil {
+		t.Errorf("Expected snapshots of volume with a PV to be kept but got %v", err)
+	}
+	if _, err := p.state.Get("pvc-4"); !os.IsNotExist(err) {
+		t.Errorf("Expected orphaned state entry to be removed but got %v", err)
+	}
+	if _, err := p.state.Get("pvc-1"); err != nil {
+		t.Errorf("Expected state entry of volume with a PV to be kept but got %v", err)
+	}
+}
+
+func TestRecoverIntents(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	exporter := &testExporter{}
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), false, exporter, newDummyQuotaer(), "", nil, false)
+	p.client = fake.NewSimpleClientset(
+		newProvisionedVolume("pvc-2", string(p.identity)),
+		newProvisionedVolume("pvc-3", string(p.identity)),
+	)
+	for _, directory := range []string{"pvc-1", "pvc-2", "pvc-3", "pvc-4", ".snapshots/pvc-3/snap-1"} {
+		if err := os.MkdirAll(path.Join(tmpDir, directory), 0777); err != nil {
+			t.Fatalf("Error creating directory: %v", err)
+		}
+	}
+	exporter.blocks = []configBlock{
+		{block: "1", path: path.Join(tmpDir, "pvc-1"), id: 1},
+		{block: "2", path: path.Join(tmpDir, "pvc-2"), id: 2},
+		{block: "3", path: path.Join(tmpDir, "pvc-3"), id: 3},
+		{block: "4", path: path.Join(tmpDir, "pvc-4"), id: 4},
+	}
+	intents := map[string]string{
+		"pvc-1": operationProvision,
+		"pvc-2": operationProvision,
+		"pvc-3": operationDelete,
+	}
+	for volumeName, operation := range intents {
+		if err := p.beginIntent(operation, volumeName); err != nil {
+			t.Fatalf("Error beginning intent: %v", err)
+		}
+	}
+
+	// A dry run removes neither volumes nor journal entries
+	p.dryRun = true
+	if err := p.recoverIntents(); err != nil {
+		t.Fatalf("Error recovering intents: %v", err)
+	}
+	for volumeName := range intents {
+		_, err := os.Stat(path.Join(tmpDir, volumeName))
+		evaluate(t, "dry run", false, nil, false, os.IsNotExist(err), "directory removed")
+		_, err = os.Stat(p.getIntentPath(volumeName))
+		evaluate(t, "dry run", false, nil, false, os.IsNotExist(err), "intent removed")
+	}
+	evaluate(t, "dry run", false, nil, 4, len(exporter.blocks), "export blocks")
+
+	p.dryRun = false
+	if err := p.recoverIntents(); err != nil {
+		t.Fatalf("Error recovering intents: %v", err)
+	}
+
+	tests := []struct {
+		name            string
+		volumeName      string
+		expectedRemoved bool
+	}{
+		{
+			name:            "roll back provision without a PV",
+			volumeName:      "pvc-1",
+			expectedRemoved: true,
+		},
+		{
+			name:            "keep provision with a PV",
+			volumeName:      "pvc-2",
+			expectedRemoved: false,
+		},
+		{
+			name:            "roll forward delete",
+			volumeName:      "pvc-3",
+			expectedRemoved: true,
+		},
+		{
+			name:            "ignore volume without an intent",
+			volumeName:      "pvc-4",
+			expectedRemoved: false,
+		},
+	}
+	for _, test := range tests {
+		_, err := os.Stat(path.Join(tmpDir, test.volumeName))
+		evaluate(t, test.name, false, nil, test.expectedRemoved, os.IsNotExist(err), "directory removed")
+
+		exported := false
+		for _, block := range exporter.blocks {
+			if block.path == path.Join(tmpDir, test.volumeName) {
+				exported = true
+			}
+		}
+		evaluate(t, test.name, false, nil, test.expectedRemoved, !exported, "export block removed")
+
+		_, err = os.Stat(p.getIntentPath(test.volumeName))
+		evaluate(t, test.name, false, nil, true, os.IsNotExist(err), "intent removed")
+	}
+	if _, err := os.Stat(path.Join(tmpDir, snapshotDir, "pvc-3")); !os.IsNotExist(err) {
+		t.Errorf("Expected snapshots of deleted volume to be removed but got %v", err)
+	}
+}
+
+func TestClearProvisionIntents(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), false, &testExporter{}, newDummyQuotaer(), "", nil, false)
+	p.client = fake.NewSimpleClientset(
+		newProvisionedVolume("pvc-1", string(p.identity)),
+		newProvisionedVolume("pvc-3", string(p.identity)),
+	)
+	intents := map[string]string{
+		"pvc-1": operationProvision,
+		"pvc-2": operationProvision,
+		"pvc-3": operationDelete,
+	}
+	for volumeName, operation := range intents {
+		if err := p.beginIntent(operation, volumeName); err != nil {
+			t.Fatalf("Error beginning intent: %v", err)
+		}
+	}
+
+	if err := p.clearProvisionIntents(); err != nil {
+		t.Fatalf("Error clearing intents: %v", err)
+	}
+
+	tests := []struct {
+		name            string
+		volumeName      string
+		expectedRemoved bool
+	}{
+		{
+			name:            "provision with a PV",
+			volumeName:      "pvc-1",
+			expectedRemoved: true,
+		},
+		{
+			name:            "provision without a PV",
+			volumeName:      "pvc-2",
+			expectedRemoved: false,
+		},
+		{
+			name:            "delete",
+			volumeName:      "pvc-3",
+			expectedRemoved: false,
+		},
+	}
+	for _, test := range tests {
+		_, err := os.Stat(p.getIntentPath(test.volumeName))
+		evaluate(t, test.name, false, nil, test.expectedRemoved, os.IsNotExist(err), "intent removed")
+	}
+}
+
+func TestMigrateAnnotations(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), false, &testExporter{}, newDummyQuotaer(), "", nil, false)
+	annotated := func(name, provisionerID string) *v1.PersistentVolume {
+		volume := newProvisionedVolume(name, provisionerID)
+		delete(volume.Annotations, annStateKey)
+		volume.Annotations[annExportBlock] = "export " + name
+		volume.Annotations[annExportID] = "1"
+		volume.Annotations[annProjectBlock] = "project " + name
+		volume.Annotations[annProjectID] = "2"
+		return volume
+	}
+	p.client = fake.NewSimpleClientset(
+		annotated("pvc-1", string(p.identity)),
+		annotated("pvc-2", string(p.identity)),
+		annotated("pvc-3", "other-identity"),
+		newProvisionedVolume("pvc-4", string(p.identity)),
+	)
+	// pvc-2 was resized after its state was saved but before its annotations
+	// were removed
+	resized := &volumeState{ExportBlock: "export pvc-2", ExportID: 1, ProjectBlock: "resized pvc-2", ProjectID: 2}
+	if err := p.state.Put("pvc-2", resized); err != nil {
+		t.Fatalf("Error saving state: %v", err)
+	}
+
+	// A dry run changes neither the PVs nor the state
+	p.dryRun = true
+	if err := p.migrateAnnotations(); err != nil {
+		t.Fatalf("Error migrating annotations: %v", err)
+	}
+	volume, err := p.client.Core().PersistentVolumes().Get("pvc-1")
+	if err != nil {
+		t.Fatalf("Error getting PV: %v", err)
+	}
+	evaluate(t, "dry run", false, nil, annotated("pvc-1", string(p.identity)).Annotations, volume.Annotations, "annotations")
+	_, err = p.state.Get("pvc-1")
+	evaluate(t, "dry run", false, nil, true, os.IsNotExist(err), "state missing")
+
+	p.dryRun = false
+	if err := p.migrateAnnotations(); err != nil {
+		t.Fatalf("Error migrating annotations: %v", err)
+	}
+
+	tests := []struct {
+		name                string
+		volumeName          string
+		expectedState       *volumeState
+		expectedAnnotations map[string]string
+	}{
+		{
+			name:                "migrated",
+			volumeName:          "pvc-1",
+			expectedState:       &volumeState{ExportBlock: "export pvc-1", ExportID: 1, ProjectBlock: "project pvc-1", ProjectID: 2},
+			expectedAnnotations: map[string]string{annProvisionerID: string(p.identity), annStateKey: "pvc-1"},
+		},
+		{
+			name:                "existing state kept",
+			volumeName:          "pvc-2",
+			expectedState:       resized,
+			expectedAnnotations: map[string]string{annProvisionerID: string(p.identity), annStateKey: "pvc-2"},
+		},
+		{
+			name:                "another provisioner's volume",
+			volumeName:          "pvc-3",
+			expectedAnnotations: annotated("pvc-3", "other-identity").Annotations,
+		},
+		{
+			name:                "already migrated",
+			volumeName:          "pvc-4",
+			expectedAnnotations: map[string]string{annProvisionerID: string(p.identity), annStateKey: "pvc-4"},
 		},
+	}
+	for _, test := range tests {
+		volume, err := p.client.Core().PersistentVolumes().Get(test.volumeName)
+		if err != nil {
+			t.Fatalf("Error getting PV: %v", err)
+		}
+		evaluate(t, test.name, false, nil, test.expectedAnnotations, volume.Annotations, "annotations")
+
+		state, err := p.state.Get(test.volumeName)
+		if test.expectedState == nil {
+			evaluate(t, test.name, false, nil, true, os.IsNotExist(err), "state missing")
+			continue
+		}
+		evaluate(t, test.name, false, err, test.expectedState, state, "state")
+	}
+}
+
+func TestGetVolumeState(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	p := newNFSProvisionerInternal(tmpDir+"/", fake.NewSimpleClientset(), false, &testExporter{}, newDummyQuotaer(), "", nil, false)
+	byKey := &volumeState{ExportBlock: "by key", ExportID: 1}
+	byName := &volumeState{ExportBlock: "by name", ExportID: 2}
+	if err := p.state.Put("key-1", byKey); err != nil {
+		t.Fatalf("Error saving state: %v", err)
+	}
+	if err := p.state.Put("pvc-1", byName); err != nil {
+		t.Fatalf("Error saving state: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		key           string
+		expectedState *volumeState
+		expectError   bool
+	}{
 		{
-			name:        "bad gid parameter value zero",
-			options:     controller.VolumeOptions{Parameters: map[string]string{"gid": "0"}},
-			expectedGid: "",
-			expectError: true,
+			name:          "entry named by annotation",
+			key:           "key-1",
+			expectedState: byKey,
 		},
 		{
-			name:        "bad gid parameter value negative",
-			options:     controller.VolumeOptions{Parameters: map[string]string{"gid": "-1"}},
-			expectedGid: "",
-			expectError: true,
+			name:          "no annotation",
+			key:           "",
+			expectedState: byName,
 		},
-		// TODO implement options.ProvisionerSelector parsing
 		{
-			name: "non-nil selector",
-			options: controller.VolumeOptions{
-				PVC: newClaim(resource.MustParse("1Ki"), nil, &unversioned.LabelSelector{MatchLabels: nil}),
-			},
-			expectedGid: "",
+			name:        "annotation leading out of the store",
+			key:         "../pvc-1",
 			expectError: true,
 		},
 		{
-			name: "bad capacity",
-			options: controller.VolumeOptions{
-				PVC: newClaim(resource.MustParse("1Ei"), nil, nil),
-			},
-			expectedGid: "",
+			name:        "missing entry",
+			key:         "key-2",
 			expectError: true,
 		},
 	}
-
-	client := fake.NewSimpleClientset()
-	p := newNFSProvisionerInternal(tmpDir+"/", client, false, &testExporter{}, newDummyQuotaer(), "")
-
 	for _, test := range tests {
-		gid, err := p.validateOptions(test.options)
-
-		evaluate(t, test.name, test.expectError, err, test.expectedGid, gid, "gid")
+		volume := newProvisionedVolume("pvc-1", string(p.identity))
+		if test.key == "" {
+			delete(volume.Annotations, annStateKey)
+		} else {
+			volume.Annotations[annStateKey] = test.key
+		}
+		state, err := p.getVolumeState(volume)
+		if state == nil {
+			state = &volumeState{}
+		}
+		if test.expectedState == nil {
+			test.expectedState = &volumeState{}
+		}
+		evaluate(t, test.name, test.expectError, err, test.expectedState, state, "state")
 	}
 }
 
@@ -313,7 +1352,7 @@ func TestCreateDirectory(t *testing.T) {
 	}
 
 	client := fake.NewSimpleClientset()
-	p := newNFSProvisionerInternal(tmpDir+"/", client, false, &testExporter{}, newDummyQuotaer(), "")
+	p := newNFSProvisionerInternal(tmpDir+"/", client, false, &testExporter{}, newDummyQuotaer(), "", nil, false)
 
 	for _, test := range tests {
 		path := p.exportDir + test.directory
@@ -366,6 +1405,39 @@ func TestAddToRemoveFromFile(t *testing.T) {
 	}
 }
 
+func TestReplaceInFile(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	conf := tmpDir + "/test"
+	if err := ioutil.WriteFile(conf, []byte("abc\n1:/foo:1024\nxyz\n"), 0600); err != nil {
+		t.Errorf("Error writing file %s: %v", conf, err)
+	}
+
+	expected := "abc\n1:/foo:2048\nxyz\n"
+	for i := 0; i < 2; i++ {
+		if err := replaceInFile(&sync.Mutex{}, conf, "\n1:/foo:1024\n", "\n1:/foo:2048\n"); err != nil {
+			t.Errorf("Unexpected error replacing in file: %v", err)
+		}
+		read, _ := ioutil.ReadFile(conf)
+		if expected != string(read) {
+			t.Errorf("Expected %s but got %s", expected, string(read))
+		}
+	}
+
+	if err := replaceInFile(&sync.Mutex{}, conf, "\n2:/bar:1024\n", "\n2:/bar:2048\n"); err == nil {
+		t.Errorf("Expected error replacing missing block but got none")
+	}
+
+	if err := replaceInFile(&sync.Mutex{}, conf, "", "\n2:/bar:2048\n"); err == nil {
+		t.Errorf("Expected error replacing empty block but got none")
+	}
+	read, _ := ioutil.ReadFile(conf)
+	if expected != string(read) {
+		t.Errorf("Expected %s but got %s", expected, string(read))
+	}
+}
+
 func TestGetExistingIDs(t *testing.T) {
 	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
 	defer os.RemoveAll(tmpDir)
@@ -424,6 +1496,405 @@ func TestGetExistingIDs(t *testing.T) {
 	}
 }
 
+func TestIDAllocator(t *testing.T) {
+	tests := []struct {
+		name        string
+		idRange     IDRange
+		existing    map[uint16]bool
+		release     []uint16
+		allocations int
+		expectError bool
+		expectedIDs []uint16
+	}{
+		{
+			name:        "lowest free ids",
+			idRange:     DefaultIDRange,
+			existing:    map[uint16]bool{1: true, 3: true},
+			allocations: 3,
+			expectedIDs: []uint16{2, 4, 5},
+		},
+		{
+			name:        "released id reassigned",
+			idRange:     DefaultIDRange,
+			existing:    map[uint16]bool{1: true, 2: true, 3: true},
+			release:     []uint16{2},
+			allocations: 2,
+			expectedIDs: []uint16{2, 4},
+		},
+		{
+			name:        "ids outside range ignored",
+			idRange:     IDRange{Min: 100, Max: 200},
+			existing:    map[uint16]bool{1: true, 100: true, 300: true},
+			allocations: 1,
+			expectedIDs: []uint16{101},
+		},
+		{
+			name:        "range across words",
+			idRange:     IDRange{Min: 62, Max: 65},
+			existing:    map[uint16]bool{62: true, 63: true},
+			allocations: 2,
+			expectedIDs: []uint16{64, 65},
+		},
+		{
+			name:        "range exhausted",
+			idRange:     IDRange{Min: 10, Max: 12},
+			existing:    map[uint16]bool{11: true},
+			allocations: 3,
+			expectError: true,
+			expectedIDs: []uint16{10, 12},
+		},
+		{
+			name:        "last id",
+			idRange:     IDRange{Min: math.MaxUint16, Max: math.MaxUint16},
+			allocations: 2,
+			expectError: true,
+			expectedIDs: []uint16{math.MaxUint16},
+		},
+	}
+	for _, test := range tests {
+		a := newIDAllocator(test.idRange, test.existing)
+		for _, id := range test.release {
+			a.Release(id)
+		}
+		ids := []uint16{}
+		var err error
+		for i := 0; i < test.allocations; i++ {
+			var id uint16
+			id, err = a.Allocate()
+			if err != nil {
+				break
+			}
+			ids = append(ids, id)
+		}
+		evaluate(t, test.name, test.expectError, err, test.expectedIDs, ids, "ids")
+		for _, id := range ids {
+			if !a.InUse(id) {
+				t.Logf("test case: %s", test.name)
+				t.Errorf("expected id %d to be in use", id)
+			}
+		}
+	}
+
+	// Every id is assigned once before the space is exhausted
+	a := newIDAllocator(DefaultIDRange, nil)
+	for i := 0; i < math.MaxUint16; i++ {
+		if _, err := a.Allocate(); err != nil {
+			t.Fatalf("unexpected error allocating id %d: %v", i+1, err)
+		}
+	}
+	if _, err := a.Allocate(); err == nil {
+		t.Errorf("expected error allocating from exhausted id space")
+	}
+}
+
+func TestParseIDRange(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		expectError   bool
+		expectedRange IDRange
+	}{
+		{
+			name:          "default",
+			value:         "1-65535",
+			expectedRange: DefaultIDRange,
+		},
+		{
+			name:          "single id",
+			value:         "100-100",
+			expectedRange: IDRange{Min: 100, Max: 100},
+		},
+		{
+			name:        "zero min",
+			value:       "0-100",
+			expectError: true,
+		},
+		{
+			name:        "min greater than max",
+			value:       "200-100",
+			expectError: true,
+		},
+		{
+			name:        "out of bounds",
+			value:       "1-65536",
+			expectError: true,
+		},
+		{
+			name:        "not a range",
+			value:       "100",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		idRange, err := ParseIDRange(test.value)
+		evaluate(t, test.name, test.expectError, err, test.expectedRange, idRange, "id range")
+	}
+}
+
+func TestGetConfigBlocks(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name     string
+		blocks   []string
+		re       *regexp.Regexp
+		expected []configBlock
+	}{
+		{
+			name:   "kernel",
+			blocks: []string{(&kernelExportBlockCreator{}).CreateExportBlock("1", "/export/pvc-1", exportOptions{}), (&kernelExportBlockCreator{true}).CreateExportBlock("2", "/export/pvc-2", exportOptions{}), (&kernelExportBlockCreator{}).CreateExportBlock("3", "/export/pvc-3", exportOptions{clients: []string{"10.0.0.0/8", "host"}})},
+			re:     kernelExportBlockRe,
+			expected: []configBlock{
+				{path: "/export/pvc-1", id: 1},
+				{path: "/export/pvc-2", id: 2},
+				{path: "/export/pvc-3", id: 3},
+			},
+		},
+		{
+			name:   "projects",
+			blocks: []string{"\n1:/export/pvc-1:1048576\n", "\n2:/export/pvc-2:2097152\n"},
+			re:     projectBlockRe,
+			expected: []configBlock{
+				{path: "/export/pvc-1", id: 1},
+				{path: "/export/pvc-2", id: 2},
+			},
+		},
+	}
+	for _, test := range tests {
+		conf := tmpDir + "/test"
+		err := ioutil.WriteFile(conf, []byte("EXPORT\n{\n\tExport_Id = 0;\n\tPath = /nonexistent;\n}\n"+strings.Join(test.blocks, "")), 0755)
+		if err != nil {
+			t.Errorf("Error writing file %s: %v", conf, err)
+		}
+		for i := range test.expected {
+			test.expected[i].block = test.blocks[i]
+		}
+
+		blocks, err := getConfigBlocks(&sync.Mutex{}, conf, test.re)
+
+		evaluate(t, test.name, false, err, test.expected, blocks, "config blocks")
+	}
+}
+
+func TestGaneshaExporter(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	// A config edited by hand, formatted unlike the provisioner would
+	conf := tmpDir + "/vfs.conf"
+	contents := "# Placeholder\nEXPORT{Export_Id=0;Path=/nonexistent;Pseudo=/nonexistent;FSAL{Name=VFS;}}\n" +
+		"export {\n    export_id = 7 ;\n    path = \"/export/pvc-7\";\n}\n" +
+		"NFSV4 { Grace_Period = 90; }\n"
+	if err := ioutil.WriteFile(conf, []byte(contents), 0600); err != nil {
+		t.Fatalf("Error writing file %s: %v", conf, err)
+	}
+
+	e := newGaneshaExporter(conf, false, DefaultIDRange)
+
+	block1, id1, err := e.AddExportBlock("/export/pvc-1", exportOptions{})
+	evaluate(t, "add first", false, err, uint16(1), id1, "export id")
+	block2, id2, err := e.AddExportBlock("/export/pvc-2", exportOptions{clients: []string{"10.0.0.0/8", "host"}})
+	evaluate(t, "add second", false, err, uint16(2), id2, "export id")
+	_, id3, err := e.AddExportBlock("/export/pvc-3", exportOptions{})
+	evaluate(t, "add third", false, err, uint16(3), id3, "export id")
+
+	blocks, err := e.GetExportBlocks()
+	expected := []configBlock{
+		{block: "\nEXPORT\n{\n\tExport_Id = 0;\n\tPath = /nonexistent;\n\tPseudo = /nonexistent;\n\tFSAL {\n\t\tName = VFS;\n\t}\n}\n", path: "/nonexistent", id: 0},
+		{block: "\nexport\n{\n\texport_id = 7;\n\tpath = \"/export/pvc-7\";\n}\n", path: "/export/pvc-7", id: 7},
+		{block: block1, path: "/export/pvc-1", id: 1},
+		{block: block2, path: "/export/pvc-2", id: 2},
+		{block: (&ganeshaExportBlockCreator{}).CreateExportBlock("3", "/export/pvc-3", exportOptions{}), path: "/export/pvc-3", id: 3},
+	}
+	evaluate(t, "get", false, err, expected, blocks, "export blocks")
+
+	// Removal finds blocks by id, whatever text they are given as
+	if err := e.RemoveExportBlock("", 7); err != nil {
+		t.Errorf("unexpected error removing export block 7: %v", err)
+	}
+	if err := e.RemoveExportBlock(block2, 2); err != nil {
+		t.Errorf("unexpected error removing export block 2: %v", err)
+	}
+	if err := e.RemoveExportBlock(block2, 2); err != nil {
+		t.Errorf("unexpected error removing export block 2 again: %v", err)
+	}
+
+	blocks, err = e.GetExportBlocks()
+	evaluate(t, "get after remove", false, err, []configBlock{expected[0], expected[2], expected[4]}, blocks, "export blocks")
+
+	read, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatalf("Error reading file %s: %v", conf, err)
+	}
+	if !strings.HasPrefix(string(read), "# Placeholder\nEXPORT\n{") || !strings.Contains(string(read), "\nNFSV4\n{\n\tGrace_Period = 90;\n}\n") {
+		t.Errorf("expected the comment and NFSV4 block to be kept but got config %q", string(read))
+	}
+
+	// Ids are reused after removal
+	_, id, err := e.AddExportBlock("/export/pvc-4", exportOptions{})
+	evaluate(t, "add after remove", false, err, uint16(2), id, "export id")
+}
+
+func TestProjectQuotaer(t *testing.T) {
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+
+	for _, directory := range []string{"pvc-1", "pvc-2"} {
+		if err := os.Mkdir(path.Join(tmpDir, directory), 0777); err != nil {
+			t.Fatalf("Error creating directory: %v", err)
+		}
+	}
+	dir1, dir2 := path.Join(tmpDir, "pvc-1"), path.Join(tmpDir, "pvc-2")
+	projects := "\n5:" + dir1 + ":1024\n\n6:" + path.Join(tmpDir, "pvc-3") + ":2048\n"
+	if err := ioutil.WriteFile(path.Join(tmpDir, "projects"), []byte(projects), 0600); err != nil {
+		t.Fatalf("Error writing projects file: %v", err)
+	}
+
+	setter := &testProjectSetter{projects: map[string]uint16{}, limits: map[uint16]string{}}
+	q, err := newProjectQuotaer(tmpDir, DefaultIDRange, setter)
+	if err != nil {
+		t.Fatalf("Error creating quotaer: %v", err)
+	}
+	// The quota of the existing directory is restored and the project of the
+	// missing one removed
+	evaluate(t, "restore", false, nil, map[uint16]string{5: "1024"}, setter.limits, "limits")
+
+	block, projectID, err := q.AddProject(dir2, "4096")
+	evaluate(t, "add", false, err, uint16(1), projectID, "project id")
+	evaluate(t, "add", false, err, map[string]uint16{dir2: 1}, setter.projects, "projects")
+	err = q.SetQuota(projectID, dir2, "4096")
+	evaluate(t, "set", false, err, "4096", setter.limits[1], "limit")
+
+	block, err = q.ResizeProject(block, projectID, dir2, "8192")
+	evaluate(t, "resize", false, err, "\n1:"+dir2+":8192\n", block, "block")
+	evaluate(t, "resize", false, err, "8192", setter.limits[1], "limit")
+
+	blocks, err := q.GetProjectBlocks()
+	expected := []configBlock{
+		{block: "\n5:" + dir1 + ":1024\n", path: dir1, id: 5},
+		{block: block, path: dir2, id: 1},
+	}
+	evaluate(t, "get", false, err, expected, blocks, "blocks")
+
+	err = q.RemoveProject(block, projectID)
+	blocks, _ = q.GetProjectBlocks()
+	evaluate(t, "remove", false, err, expected[:1], blocks, "blocks")
+	evaluate(t, "remove", false, nil, false, q.projectIDs.InUse(projectID), "id in use")
+}
+
+func TestQuotactl(t *testing.T) {
+	// The structs must be the size of the kernel's, which is encoded in the
+	// ioctl numbers & copied by quotactl
+	evaluate(t, "fsxattr", false, nil, uintptr(28), unsafe.Sizeof(fsxattr{}), "size")
+	evaluate(t, "if_dqblk", false, nil, uintptr(72), unsafe.Sizeof(ifDqblk{}), "size")
+
+	tests := []struct {
+		name           string
+		bytes          string
+		expectError    bool
+		expectedBlocks uint64
+	}{
+		{
+			name:           "exact",
+			bytes:          "2048",
+			expectedBlocks: 2,
+		},
+		{
+			name:           "round up",
+			bytes:          "2049",
+			expectedBlocks: 3,
+		},
+		{
+			name:           "zero",
+			bytes:          "0",
+			expectedBlocks: 0,
+		},
+		{
+			name:        "invalid",
+			bytes:       "1Ki",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		blocks, err := bytesToQuotaBlocks(test.bytes)
+		evaluate(t, test.name, test.expectError, err, test.expectedBlocks, blocks, "blocks")
+	}
+
+	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
+	defer os.RemoveAll(tmpDir)
+	isXfs, err := isXfs(tmpDir)
+	if err != nil {
+		t.Errorf("unexpected error checking filesystem: %v", err)
+	}
+	magic, _ := getFilesystemMagic(tmpDir)
+	evaluate(t, "is xfs", false, err, magic == xfsSuperMagic, isXfs, "is xfs")
+}
+
+func TestCreateExportBlock(t *testing.T) {
+	tests := []struct {
+		name            string
+		rootSquash      bool
+		options         exportOptions
+		expectedGanesha string
+		expectedKernel  string
+	}{
+		{
+			name:            "default",
+			options:         exportOptions{},
+			expectedGanesha: "\tAccess_Type = RW;\n\tSquash = no_root_squash;\n\tSecType = sys;\n\tFilesystem_id = 1.1;\n\tFSAL",
+			expectedKernel:  "\n/export/pvc-1 *(rw,insecure,no_root_squash,fsid=1)\n",
+		},
+		{
+			name:            "root squash flag",
+			rootSquash:      true,
+			options:         exportOptions{},
+			expectedGanesha: "\tAccess_Type = RW;\n\tSquash = root_id_squash;\n\tSecType = sys;\n",
+			expectedKernel:  "\n/export/pvc-1 *(rw,insecure,root_squash,fsid=1)\n",
+		},
+		{
+			name:            "squash none overrides root squash flag",
+			rootSquash:      true,
+			options:         exportOptions{squash: squashNone},
+			expectedGanesha: "\tSquash = no_root_squash;\n",
+			expectedKernel:  "\n/export/pvc-1 *(rw,insecure,no_root_squash,fsid=1)\n",
+		},
+		{
+			name:            "read only all squash anon ids",
+			options:         exportOptions{readOnly: true, squash: squashAll, anonUID: "65534", anonGID: "100"},
+			expectedGanesha: "\tAccess_Type = RO;\n\tSquash = all_squash;\n\tAnonymous_Uid = 65534;\n\tAnonymous_Gid = 100;\n\tSecType = sys;\n",
+			expectedKernel:  "\n/export/pvc-1 *(ro,insecure,all_squash,anonuid=65534,anongid=100,fsid=1)\n",
+		},
+		{
+			name:            "protocols",
+			options:         exportOptions{protocols: []string{"4"}},
+			expectedGanesha: "\tPseudo = /export/pvc-1;\n\tProtocols = 4;\n\tAccess_Type = RW;\n",
+			expectedKernel:  "\n/export/pvc-1 *(rw,insecure,no_root_squash,fsid=1)\n",
+		},
+		{
+			name:            "kerberos",
+			options:         exportOptions{secTypes: []string{"krb5p", "krb5i"}},
+			expectedGanesha: "\tSecType = krb5p, krb5i;\n",
+			expectedKernel:  "\n/export/pvc-1 *(sec=krb5p:krb5i,rw,insecure,no_root_squash,fsid=1)\n",
+		},
+		{
+			name:            "clients",
+			options:         exportOptions{clients: []string{"10.0.0.0/8", "*.example.com"}, readOnly: true},
+			expectedGanesha: "\tAccess_Type = None;\n\tSquash = no_root_squash;\n\tSecType = sys;\n\tFilesystem_id = 1.1;\n\tCLIENT {\n\t\tClients = 10.0.0.0/8, *.example.com;\n\t\tAccess_Type = RO;\n\t}\n\tFSAL",
+			expectedKernel:  "\n/export/pvc-1 10.0.0.0/8(ro,insecure,no_root_squash,fsid=1) *.example.com(ro,insecure,no_root_squash,fsid=1)\n",
+		},
+	}
+	for _, test := range tests {
+		ganesha := (&ganeshaExportBlockCreator{test.rootSquash}).CreateExportBlock("1", "/export/pvc-1", test.options)
+		if !strings.Contains(ganesha, test.expectedGanesha) {
+			t.Logf("test case: %s", test.name)
+			t.Errorf("expected ganesha block to contain %q but got %q", test.expectedGanesha, ganesha)
+		}
+		kernel := (&kernelExportBlockCreator{test.rootSquash}).CreateExportBlock("1", "/export/pvc-1", test.options)
+		evaluate(t, test.name, false, nil, test.expectedKernel, kernel, "kernel block")
+	}
+}
+
 func TestGetServer(t *testing.T) {
 	tmpDir := utiltesting.MkTmpdirOrDie("nfsProvisionTest")
 	defer os.RemoveAll(tmpDir)
@@ -593,7 +2064,7 @@ func TestGetServer(t *testing.T) {
 		}
 
 		client := fake.NewSimpleClientset(test.objs...)
-		p := newNFSProvisionerInternal(tmpDir+"/", client, test.outOfCluster, &testExporter{}, newDummyQuotaer(), test.serverHostname)
+		p := newNFSProvisionerInternal(tmpDir+"/", client, test.outOfCluster, &testExporter{}, newDummyQuotaer(), test.serverHostname, nil, false)
 
 		server, err := p.getServer()
 
@@ -623,6 +2094,46 @@ func newClaim(capacity resource.Quantity, accessmodes []v1.PersistentVolumeAcces
 	return claim
 }
 
+func newBoundClaim(name, claimUID, volumeName string) *v1.PersistentVolumeClaim {
+	claim := newClaim(resource.MustParse("1Ki"), nil, nil)
+	claim.Name = name
+	claim.Namespace = v1.NamespaceDefault
+	claim.UID = types.UID(claimUID)
+	if volumeName != "" {
+		claim.Spec.VolumeName = volumeName
+		claim.Status.Phase = v1.ClaimBound
+	}
+	return claim
+}
+
+func newCloneSourceVolume(name, provisionerID string, claim *v1.PersistentVolumeClaim) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{annProvisionerID: provisionerID},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{
+				v1.ResourceName(v1.ResourceStorage): resource.MustParse("1Ki"),
+			},
+			ClaimRef: &v1.ObjectReference{
+				Namespace: claim.Namespace,
+				Name:      claim.Name,
+				UID:       claim.UID,
+			},
+		},
+	}
+}
+
+func newProvisionedVolume(name, provisionerID string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{annProvisionerID: provisionerID, annStateKey: name},
+		},
+	}
+}
+
 func newService(name, clusterIP string) *v1.Service {
 	return &v1.Service{
 		ObjectMeta: v1.ObjectMeta{
@@ -665,16 +2176,24 @@ func newEndpoints(name string, ips []string, ports []endpointPort) *v1.Endpoints
 }
 
 type testExporter struct {
-	config string
+	config     string
+	blocks     []configBlock
+	rootSquash bool
 }
 
 var _ exporter = &testExporter{}
 
-func (e *testExporter) AddExportBlock(path string) (string, uint16, error) {
+func (e *testExporter) AddExportBlock(path string, options exportOptions) (string, uint16, error) {
 	return "\nExport_Id = 0;\n", 0, nil
 }
 
 func (e *testExporter) RemoveExportBlock(block string, exportID uint16) error {
+	for i, b := range e.blocks {
+		if b.id == exportID {
+			e.blocks = append(e.blocks[:i], e.blocks[i+1:]...)
+			break
+		}
+	}
 	return nil
 }
 
@@ -685,7 +2204,32 @@ func (e *testExporter) Export(path string) error {
 	return nil
 }
 
-func (e *testExporter) Unexport(volume *v1.PersistentVolume) error {
+func (e *testExporter) Unexport(exportID uint16) error {
+	return nil
+}
+
+func (e *testExporter) GetExportBlocks() ([]configBlock, error) {
+	return e.blocks, nil
+}
+
+func (e *testExporter) SetRootSquash(rootSquash bool) {
+	e.rootSquash = rootSquash
+}
+
+type testProjectSetter struct {
+	projects map[string]uint16
+	limits   map[uint16]string
+}
+
+var _ projectSetter = &testProjectSetter{}
+
+func (s *testProjectSetter) SetProject(directory string, projectID uint16) error {
+	s.projects[directory] = projectID
+	return nil
+}
+
+func (s *testProjectSetter) SetLimit(projectID uint16, bhard string) error {
+	s.limits[projectID] = bhard
 	return nil
 }
 
@@ -20,7 +20,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"regexp"
 	"strconv"
@@ -35,26 +34,56 @@ type quotaer interface {
 	AddProject(string, string) (string, uint16, error)
 	RemoveProject(string, uint16) error
 	SetQuota(uint16, string, string) error
+	ResizeProject(string, uint16, string, string) (string, error)
 	UnsetQuota() error
+	GetProjectBlocks() ([]configBlock, error)
 }
 
-type xfsQuotaer struct {
-	xfsPath string
-
+// projectQuotaer sets per-directory quotas with filesystem project quotas: each
+// directory gets its own project whose block limit is the quota. The projects
+// are recorded in a projects file so that their quotas can be restored, e.g.
+// after the filesystem is remounted. How a directory is assigned to a project
+// and how a project's limit is set depends on the filesystem.
+type projectQuotaer struct {
 	// The file where we store mappings between project ids and directories, and
 	// each project's quota limit information, for backup.
 	// Similar to http://man7.org/linux/man-pages/man5/projects.5.html
 	projectsFile string
 
-	projectIDs map[uint16]bool
+	projectIDs *idAllocator
 
-	mapMutex  *sync.Mutex
 	fileMutex *sync.Mutex
+
+	setter projectSetter
 }
 
-var _ quotaer = &xfsQuotaer{}
+var _ quotaer = &projectQuotaer{}
+
+// projectSetter sets up project quotas on a particular filesystem.
+type projectSetter interface {
+	// SetProject assigns the directory and everything in it to the project.
+	SetProject(directory string, projectID uint16) error
+	// SetLimit sets the project's hard block limit in bytes.
+	SetLimit(projectID uint16, bhard string) error
+}
+
+// newQuotaer creates a quotaer for the filesystem mounted at the given path,
+// whichever of the supported filesystems it is.
+func newQuotaer(mountpoint string, idRange IDRange) (*projectQuotaer, error) {
+	fstype, err := getFilesystemType(path.Clean(mountpoint))
+	if err != nil {
+		return nil, err
+	}
+	switch fstype {
+	case "xfs":
+		return newXfsQuotaer(mountpoint, idRange)
+	case "ext4":
+		return newExt4Quotaer(mountpoint, idRange)
+	}
+	return nil, fmt.Errorf("path %s is a %s filesystem, quotas are only supported on xfs and ext4", mountpoint, fstype)
+}
 
-func newXfsQuotaer(xfsPath string) (*xfsQuotaer, error) {
+func newXfsQuotaer(xfsPath string, idRange IDRange) (*projectQuotaer, error) {
 	if _, err := os.Stat(xfsPath); os.IsNotExist(err) {
 		return nil, fmt.Errorf("xfs path %s does not exist", xfsPath)
 	}
@@ -75,16 +104,53 @@ func newXfsQuotaer(xfsPath string) (*xfsQuotaer, error) {
 		return nil, fmt.Errorf("xfs path %s was not mounted with pquota nor prjquota", xfsPath)
 	}
 
-	if _, err := exec.LookPath("xfs_quota"); err != nil {
+	setter, err := newQuotactlProjectSetter(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return newProjectQuotaer(xfsPath, idRange, setter)
+}
+
+// newExt4Quotaer creates a quotaer for an ext4 filesystem, which supports
+// project quotas since Linux 4.5 if created with the project and quota features,
+// e.g. mkfs.ext4 -O quota,project, and mounted with prjquota.
+func newExt4Quotaer(ext4Path string, idRange IDRange) (*projectQuotaer, error) {
+	if _, err := os.Stat(ext4Path); os.IsNotExist(err) {
+		return nil, fmt.Errorf("ext4 path %s does not exist", ext4Path)
+	}
+
+	magic, err := getFilesystemMagic(ext4Path)
+	if err != nil {
+		return nil, fmt.Errorf("error checking if ext4 path %s is an ext4 filesystem: %v", ext4Path, err)
+	}
+	if magic != ext4SuperMagic {
+		return nil, fmt.Errorf("ext4 path %s is not an ext4 filesystem", ext4Path)
+	}
+
+	entry, err := getMountEntry(path.Clean(ext4Path), "ext4")
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(entry.VfsOpts, "prjquota") {
+		return nil, fmt.Errorf("ext4 path %s was not mounted with prjquota", ext4Path)
+	}
+
+	setter, err := newQuotactlProjectSetter(entry)
+	if err != nil {
 		return nil, err
 	}
 
-	projectsFile := path.Join(xfsPath, "projects")
+	return newProjectQuotaer(ext4Path, idRange, setter)
+}
+
+func newProjectQuotaer(mountpoint string, idRange IDRange, setter projectSetter) (*projectQuotaer, error) {
+	projectsFile := path.Join(mountpoint, "projects")
 	projectIDs := map[uint16]bool{}
 	if _, err := os.Stat(projectsFile); os.IsNotExist(err) {
 		file, err := os.Create(projectsFile)
 		if err != nil {
-			return nil, fmt.Errorf("error creating xfs projects file %s: %v", projectsFile, err)
+			return nil, fmt.Errorf("error creating projects file %s: %v", projectsFile, err)
 		}
 		file.Close()
 	} else {
@@ -95,32 +161,26 @@ func newXfsQuotaer(xfsPath string) (*xfsQuotaer, error) {
 		}
 	}
 
-	xfsQuotaer := &xfsQuotaer{
-		xfsPath:      xfsPath,
+	quotaer := &projectQuotaer{
 		projectsFile: projectsFile,
-		projectIDs:   projectIDs,
-		mapMutex:     &sync.Mutex{},
+		projectIDs:   newIDAllocator(idRange, projectIDs),
 		fileMutex:    &sync.Mutex{},
+		setter:       setter,
 	}
 
-	err = xfsQuotaer.restoreQuotas()
-	if err != nil {
+	if err := quotaer.restoreQuotas(); err != nil {
 		return nil, fmt.Errorf("error restoring quotas from projects file %s: %v", projectsFile, err)
 	}
 
-	return xfsQuotaer, nil
+	return quotaer, nil
 }
 
 func isXfs(xfsPath string) (bool, error) {
-	cmd := exec.Command("stat", "-f", "-c", "%T", xfsPath)
-	out, err := cmd.Output()
+	magic, err := getFilesystemMagic(xfsPath)
 	if err != nil {
 		return false, err
 	}
-	if strings.TrimSpace(string(out)) != "xfs" {
-		return false, nil
-	}
-	return true, nil
+	return magic == xfsSuperMagic, nil
 }
 
 func getMountEntry(mountpoint, fstype string) (*mount.Info, error) {
@@ -136,7 +196,26 @@ func getMountEntry(mountpoint, fstype string) (*mount.Info, error) {
 	return nil, fmt.Errorf("mount entry for mountpoint %s, fstype %s not found", mountpoint, fstype)
 }
 
-func (q *xfsQuotaer) restoreQuotas() error {
+// getFilesystemType returns the type of the filesystem mounted at the given
+// mountpoint. If several are mounted there, it's the last, i.e. visible, one.
+func getFilesystemType(mountpoint string) (string, error) {
+	entries, err := mount.GetMounts()
+	if err != nil {
+		return "", err
+	}
+	fstype := ""
+	for _, e := range entries {
+		if e.Mountpoint == mountpoint {
+			fstype = e.Fstype
+		}
+	}
+	if fstype == "" {
+		return "", fmt.Errorf("path %s is not a mountpoint", mountpoint)
+	}
+	return fstype, nil
+}
+
+func (q *projectQuotaer) restoreQuotas() error {
 	read, err := ioutil.ReadFile(q.projectsFile)
 	if err != nil {
 		return err
@@ -165,8 +244,11 @@ func (q *xfsQuotaer) restoreQuotas() error {
 	return nil
 }
 
-func (q *xfsQuotaer) AddProject(directory, bhard string) (string, uint16, error) {
-	projectID := generateID(q.mapMutex, q.projectIDs)
+func (q *projectQuotaer) AddProject(directory, bhard string) (string, uint16, error) {
+	projectID, err := q.projectIDs.Allocate()
+	if err != nil {
+		return "", 0, err
+	}
 	projectIDStr := strconv.FormatUint(uint64(projectID), 10)
 
 	// Store project:directory mapping and also project's quota info
@@ -174,46 +256,63 @@ func (q *xfsQuotaer) AddProject(directory, bhard string) (string, uint16, error)
 
 	// Add the project block to the projects file
 	if err := addToFile(q.fileMutex, q.projectsFile, block); err != nil {
-		deleteID(q.mapMutex, q.projectIDs, projectID)
+		q.projectIDs.Release(projectID)
 		return "", 0, fmt.Errorf("error adding project block %s to projects file %s: %v", block, q.projectsFile, err)
 	}
 
 	// Specify the new project
-	cmd := exec.Command("xfs_quota", "-x", "-c", fmt.Sprintf("project -s -p %s %s", directory, projectIDStr), q.xfsPath)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		deleteID(q.mapMutex, q.projectIDs, projectID)
+	if err := q.setter.SetProject(directory, projectID); err != nil {
+		q.projectIDs.Release(projectID)
 		removeFromFile(q.fileMutex, q.projectsFile, block)
-		return "", 0, fmt.Errorf("xfs_quota failed with error: %v, output: %s", err, out)
+		return "", 0, err
 	}
 
 	return block, projectID, nil
 }
 
-func (q *xfsQuotaer) RemoveProject(block string, projectID uint16) error {
-	deleteID(q.mapMutex, q.projectIDs, projectID)
+func (q *projectQuotaer) RemoveProject(block string, projectID uint16) error {
+	q.projectIDs.Release(projectID)
 	return removeFromFile(q.fileMutex, q.projectsFile, block)
 }
 
-func (q *xfsQuotaer) SetQuota(projectID uint16, directory, bhard string) error {
-	if !q.projectIDs[projectID] {
+func (q *projectQuotaer) SetQuota(projectID uint16, directory, bhard string) error {
+	if !q.projectIDs.InUse(projectID) {
 		return fmt.Errorf("project with id %v has not been added", projectID)
 	}
+
+	return q.setter.SetLimit(projectID, bhard)
+}
+
+// ResizeProject rewrites the project's block in the projects file with the new
+// bhard limit and sets the project's quota to it. Returns the new block.
+func (q *projectQuotaer) ResizeProject(block string, projectID uint16, directory, bhard string) (string, error) {
 	projectIDStr := strconv.FormatUint(uint64(projectID), 10)
+	newBlock := "\n" + projectIDStr + ":" + directory + ":" + bhard + "\n"
 
-	cmd := exec.Command("xfs_quota", "-x", "-c", fmt.Sprintf("limit -p bhard=%s %s", bhard, projectIDStr), q.xfsPath)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("xfs_quota failed with error: %v, output: %s", err, out)
+	if err := replaceInFile(q.fileMutex, q.projectsFile, block, newBlock); err != nil {
+		return "", fmt.Errorf("error replacing project block %s with %s in projects file %s: %v", block, newBlock, q.projectsFile, err)
 	}
 
-	return nil
+	if err := q.SetQuota(projectID, directory, bhard); err != nil {
+		replaceInFile(q.fileMutex, q.projectsFile, newBlock, block)
+		return "", err
+	}
+
+	return newBlock, nil
 }
 
-func (q *xfsQuotaer) UnsetQuota() error {
+func (q *projectQuotaer) UnsetQuota() error {
 	return nil
 }
 
+// GetProjectBlocks returns the project blocks found in the projects file.
+func (q *projectQuotaer) GetProjectBlocks() ([]configBlock, error) {
+	return getConfigBlocks(q.fileMutex, q.projectsFile, projectBlockRe)
+}
+
+// projectBlockRe matches the blocks added to the projects file by AddProject
+var projectBlockRe = regexp.MustCompile("\n(?P<id>[0-9]+):(?P<path>[^:\n]+):[^\n]+\n")
+
 type dummyQuotaer struct{}
 
 var _ quotaer = &dummyQuotaer{}
@@ -231,6 +330,12 @@ func (q *dummyQuotaer) RemoveProject(_ string, _ uint16) error {
 func (q *dummyQuotaer) SetQuota(_ uint16, _, _ string) error {
 	return nil
 }
+func (q *dummyQuotaer) ResizeProject(block string, _ uint16, _, _ string) (string, error) {
+	return block, nil
+}
 func (q *dummyQuotaer) UnsetQuota() error {
 	return nil
 }
+func (q *dummyQuotaer) GetProjectBlocks() ([]configBlock, error) {
+	return nil, nil
+}
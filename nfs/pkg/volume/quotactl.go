@@ -0,0 +1,188 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/docker/docker/pkg/mount"
+)
+
+// Constants from linux/fs.h and linux/quota.h
+const (
+	// _IOR('X', 31, struct fsxattr) & _IOW('X', 32, struct fsxattr)
+	fsIocFsGetXattr = 0x801c581f
+	fsIocFsSetXattr = 0x401c5820
+
+	fsXflagProjInherit = 0x00000200
+
+	qSetQuota  = 0x800008
+	prjQuota   = 2
+	qifBLimits = 1
+	// The size of the blocks quotactl limits are in
+	qifDqblkSize = 1024
+
+	xfsSuperMagic  = 0x58465342
+	ext4SuperMagic = 0xef53
+)
+
+// fsxattr is struct fsxattr, the extended attributes of a file, including its
+// project id, got & set by FS_IOC_FSGETXATTR & FS_IOC_FSSETXATTR.
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// ifDqblk is struct if_dqblk, a quota set by Q_SETQUOTA.
+type ifDqblk struct {
+	bhardlimit uint64
+	bsoftlimit uint64
+	curspace   uint64
+	ihardlimit uint64
+	isoftlimit uint64
+	curinodes  uint64
+	btime      uint64
+	itime      uint64
+	valid      uint32
+	_          uint32
+}
+
+// quotactlProjectSetter sets up project quotas with the project id ioctls and
+// quotactl, which both xfs and ext4 support, rather than running their tools.
+type quotactlProjectSetter struct {
+	// The block device the filesystem is on
+	device string
+}
+
+var _ projectSetter = &quotactlProjectSetter{}
+
+// newQuotactlProjectSetter creates a quotactlProjectSetter for the filesystem
+// of the given mount entry. quotactl needs the filesystem's block device, so it
+// must be visible, e.g. to a privileged container.
+func newQuotactlProjectSetter(entry *mount.Info) (*quotactlProjectSetter, error) {
+	info, err := os.Stat(entry.Source)
+	if err != nil {
+		return nil, fmt.Errorf("error finding device %s of mountpoint %s: %v", entry.Source, entry.Mountpoint, err)
+	}
+	if info.Mode()&os.ModeDevice == 0 {
+		return nil, fmt.Errorf("source %s of mountpoint %s is not a device", entry.Source, entry.Mountpoint)
+	}
+	return &quotactlProjectSetter{device: entry.Source}, nil
+}
+
+// SetProject sets the project id of the directory and everything in it, and the
+// project inheritance flag of the directories so that what is created in them
+// later gets the project id too. Symlinks and special files are skipped, like
+// xfs_quota does.
+func (s *quotactlProjectSetter) SetProject(directory string, projectID uint16) error {
+	return filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		if err := setProjectID(path, projectID, info.IsDir()); err != nil {
+			return fmt.Errorf("error setting project id of %s: %v", path, err)
+		}
+		return nil
+	})
+}
+
+func setProjectID(path string, projectID uint16, inherit bool) error {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var attr fsxattr
+	if err := ioctl(fd, fsIocFsGetXattr, unsafe.Pointer(&attr)); err != nil {
+		return fmt.Errorf("FS_IOC_FSGETXATTR failed: %v", err)
+	}
+	attr.projid = uint32(projectID)
+	if inherit {
+		attr.xflags |= fsXflagProjInherit
+	}
+	if err := ioctl(fd, fsIocFsSetXattr, unsafe.Pointer(&attr)); err != nil {
+		return fmt.Errorf("FS_IOC_FSSETXATTR failed: %v", err)
+	}
+	return nil
+}
+
+// SetLimit sets the project's hard block limit, rounded up to the blocks
+// quotactl takes.
+func (s *quotactlProjectSetter) SetLimit(projectID uint16, bhard string) error {
+	blocks, err := bytesToQuotaBlocks(bhard)
+	if err != nil {
+		return err
+	}
+	dqblk := ifDqblk{bhardlimit: blocks, valid: qifBLimits}
+	if err := quotactl(qSetQuota, s.device, projectID, unsafe.Pointer(&dqblk)); err != nil {
+		return fmt.Errorf("quotactl Q_SETQUOTA on %s failed: %v", s.device, err)
+	}
+	return nil
+}
+
+// bytesToQuotaBlocks converts a limit in bytes to a limit in quota blocks,
+// rounding up.
+func bytesToQuotaBlocks(bytes string) (uint64, error) {
+	b, err := strconv.ParseUint(bytes, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit %s: %v", bytes, err)
+	}
+	return (b + qifDqblkSize - 1) / qifDqblkSize, nil
+}
+
+func ioctl(fd int, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func quotactl(cmd int, device string, id uint16, addr unsafe.Pointer) error {
+	special, err := syscall.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+	// QCMD(cmd, PRJQUOTA)
+	qcmd := cmd<<8 | prjQuota
+	if _, _, errno := syscall.Syscall6(syscall.SYS_QUOTACTL, uintptr(qcmd), uintptr(unsafe.Pointer(special)), uintptr(id), uintptr(addr), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// getFilesystemMagic returns the magic number of the filesystem the given path
+// is on, e.g. xfsSuperMagic.
+func getFilesystemMagic(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Type), nil
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/client-go/pkg/api/resource"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var _ controller.Resizer = &nfsProvisioner{}
+
+// Resize raises the quota, if any, of the directory backing the given PV to the
+// given capacity and returns a copy of the PV with its capacity updated.
+func (p *nfsProvisioner) Resize(volume *v1.PersistentVolume, capacity resource.Quantity) (*v1.PersistentVolume, error) {
+	// Ignore the call if this provisioner was not the one to provision the
+	// volume, like Delete does
+	provisioned, err := p.provisioned(volume)
+	if err != nil {
+		return nil, fmt.Errorf("error determining if this provisioner was the one to provision volume %q: %v", volume.Name, err)
+	}
+	if !provisioned {
+		strerr := fmt.Sprintf("this provisioner id %s didn't provision volume %q and so can't resize it; id %s did & can", p.identity, volume.Name, volume.Annotations[annProvisionerID])
+		return nil, &controller.IgnoredError{Reason: strerr}
+	}
+
+	current := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	if capacity.Cmp(current) < 0 {
+		return nil, fmt.Errorf("shrinking volume %q from %s to %s is not supported", volume.Name, current.String(), capacity.String())
+	}
+	if err := p.validateAvailable(capacity.Value() - current.Value()); err != nil {
+		return nil, err
+	}
+
+	if err := p.resizeQuota(volume, capacity); err != nil {
+		return nil, fmt.Errorf("error resizing quota for volume: %v", err)
+	}
+
+	newVolume := *volume
+	newVolume.Spec.Capacity = make(v1.ResourceList)
+	for k, v := range volume.Spec.Capacity {
+		newVolume.Spec.Capacity[k] = v
+	}
+	newVolume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)] = capacity
+
+	return &newVolume, nil
+}
+
+// resizeQuota sets the quota of the project representing the directory backing
+// the PV to the given capacity and saves the project's new block in its state.
+// Volumes provisioned without a quota have an empty project block and are left
+// without one, so only their capacity changes.
+func (p *nfsProvisioner) resizeQuota(volume *v1.PersistentVolume, capacity resource.Quantity) error {
+	key, err := getStateKey(volume)
+	if err != nil {
+		return err
+	}
+	state, err := p.getVolumeState(volume)
+	if err != nil {
+		return fmt.Errorf("error getting state of volume: %v", err)
+	}
+	if state.ProjectBlock == "" {
+		glog.V(4).Infof("Volume %q has no quota project, only resizing its capacity", volume.Name)
+		return nil
+	}
+
+	path := path.Join(p.exportDir, volume.ObjectMeta.Name)
+	limit := strconv.FormatInt(capacity.Value(), 10)
+
+	newBlock, err := p.quotaer.ResizeProject(state.ProjectBlock, state.ProjectID, path, limit)
+	if err != nil {
+		return fmt.Errorf("error resizing project for path %s: %v", path, err)
+	}
+
+	state.ProjectBlock = newBlock
+	if err := p.state.Put(key, state); err != nil {
+		return fmt.Errorf("resized project for path %s but error saving its new block: %v", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/util/validation"
+)
+
+var _ controller.Snapshotter = &nfsProvisioner{}
+
+// Snapshot copies the directory backing the given PV to the snapshot area,
+// sharing blocks with it via reflink if the filesystem supports it, e.g. xfs
+// formatted with reflink=1, else doing a full copy.
+func (p *nfsProvisioner) Snapshot(volume *v1.PersistentVolume, name string) error {
+	// Ignore the call if this provisioner was not the one to provision the
+	// volume, like Delete does
+	provisioned, err := p.provisioned(volume)
+	if err != nil {
+		return fmt.Errorf("error determining if this provisioner was the one to provision volume %q: %v", volume.Name, err)
+	}
+	if !provisioned {
+		strerr := fmt.Sprintf("this provisioner id %s didn't provision volume %q and so can't snapshot it; id %s did & can", p.identity, volume.Name, volume.Annotations[annProvisionerID])
+		return &controller.IgnoredError{Reason: strerr}
+	}
+
+	snapshotPath := p.getSnapshotPath(volume.Name, name)
+	if _, err := os.Stat(snapshotPath); err == nil {
+		// Taken already but not recorded
+		return nil
+	}
+
+	if err := os.MkdirAll(path.Dir(snapshotPath), 0700); err != nil {
+		return fmt.Errorf("error creating snapshot directory for volume %q: %v", volume.Name, err)
+	}
+
+	// Copy to a temporary path first so that a snapshot only ever exists in
+	// full. Snapshot names can't contain dots so it can't clash with another.
+	tmpPath := snapshotPath + ".tmp"
+	os.RemoveAll(tmpPath)
+	cmd := exec.Command("cp", "-a", "--reflink=auto", path.Join(p.exportDir, volume.Name), tmpPath)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return fmt.Errorf("cp failed with error: %v, output: %s", err, out)
+	}
+
+	if err := os.Rename(tmpPath, snapshotPath); err != nil {
+		os.RemoveAll(tmpPath)
+		return fmt.Errorf("error renaming snapshot %s to %s: %v", tmpPath, snapshotPath, err)
+	}
+
+	return nil
+}
+
+// validateSnapshotSource checks that the snapshot the claim's AnnSnapshotSource
+// annotation names, if any, exists. If it doesn't, the claim is ignored so that
+// the provisioner that has it may provision it. The snapshot's volume must
+// still exist and be bound to a claim in the claim's namespace, so that claims
+// can't read other namespaces' data, and the claim must request at least its
+// capacity.
+func (p *nfsProvisioner) validateSnapshotSource(options controller.VolumeOptions) error {
+	source, ok := options.PVC.Annotations[controller.AnnSnapshotSource]
+	if !ok {
+		return nil
+	}
+	volumeName, name, err := parseSnapshotSource(source)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(p.getSnapshotPath(volumeName, name)); os.IsNotExist(err) {
+		return &controller.IgnoredError{Reason: fmt.Sprintf("snapshot %q not found", source)}
+	}
+
+	volume, err := p.client.Core().PersistentVolumes().Get(volumeName)
+	if err != nil {
+		return fmt.Errorf("error getting snapshot source volume %q: %v", volumeName, err)
+	}
+	if volume.Spec.ClaimRef == nil || volume.Spec.ClaimRef.Namespace != options.PVC.Namespace {
+		return fmt.Errorf("snapshot source volume %q is not bound to a claim in namespace %s", volumeName, options.PVC.Namespace)
+	}
+
+	requested := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	capacity := volume.Spec.Capacity[v1.ResourceName(v1.ResourceStorage)]
+	if requested.Cmp(capacity) < 0 {
+		return fmt.Errorf("requested capacity %s is less than snapshot source volume %q capacity %s", requested.String(), volumeName, capacity.String())
+	}
+
+	return nil
+}
+
+// restoreSnapshot populates the directory with the contents of the snapshot
+// named by source, leaving the directory's own permissions as createDirectory
+// set them.
+func (p *nfsProvisioner) restoreSnapshot(source, directory string) error {
+	snapshotPath, err := p.getSnapshotSourcePath(source)
+	if err != nil {
+		return err
+	}
+
+	if err := copyContents(snapshotPath, path.Join(p.exportDir, directory)); err != nil {
+		return fmt.Errorf("error copying snapshot %q: %v", source, err)
+	}
+
+	return nil
+}
+
+// deleteSnapshots removes all the snapshots of the given volume, which can't
+// be restored once its PV is gone.
+func (p *nfsProvisioner) deleteSnapshots(volumeName string) error {
+	return os.RemoveAll(path.Join(p.exportDir, snapshotDir, volumeName))
+}
+
+func (p *nfsProvisioner) getSnapshotPath(volumeName, name string) string {
+	return path.Join(p.exportDir, snapshotDir, volumeName, name)
+}
+
+// getSnapshotSourcePath returns the path of the snapshot named by source,
+// "<PV name>/<snapshot name>".
+func (p *nfsProvisioner) getSnapshotSourcePath(source string) (string, error) {
+	volumeName, name, err := parseSnapshotSource(source)
+	if err != nil {
+		return "", err
+	}
+	return p.getSnapshotPath(volumeName, name), nil
+}
+
+// parseSnapshotSource splits source, "<PV name>/<snapshot name>", into the PV
+// name and the snapshot name.
+func parseSnapshotSource(source string) (string, string, error) {
+	parts := strings.Split(source, "/")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid snapshot source %q, must be of the form <PV name>/<snapshot name>", source)
+	}
+	if errs := validation.IsDNS1123Subdomain(parts[0]); len(errs) != 0 {
+		return "", "", fmt.Errorf("invalid PV name in snapshot source %q: %s", source, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1123Label(parts[1]); len(errs) != 0 {
+		return "", "", fmt.Errorf("invalid snapshot name in snapshot source %q: %s", source, strings.Join(errs, ", "))
+	}
+	return parts[0], parts[1], nil
+}
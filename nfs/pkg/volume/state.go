@@ -0,0 +1,227 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/nfs/pkg/util"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/util/validation"
+)
+
+// volumeState is what the provisioner needs to know about a volume it
+// provisioned in order to resize & delete it, kept in the stateStore rather
+// than on the PV so that edits to the PV can't break it.
+type volumeState struct {
+	// The block added to either the ganesha config or /etc/exports, and the
+	// exportID
+	ExportBlock string `json:"exportBlock"`
+	ExportID    uint16 `json:"exportID"`
+	// The block added to the projects file, and the projectID. Empty and zero
+	// if the volume has no quota.
+	ProjectBlock string `json:"projectBlock"`
+	ProjectID    uint16 `json:"projectID"`
+	// The StorageClass parameters the volume was provisioned with
+	Parameters map[string]string `json:"parameters"`
+}
+
+// stateStore stores the volumeState of each volume as a JSON file, each
+// written atomically.
+type stateStore struct {
+	dir   string
+	mutex *sync.Mutex
+}
+
+func newStateStore(dir string) (*stateStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &stateStore{dir: dir, mutex: &sync.Mutex{}}, nil
+}
+
+// Get returns the state of the given volume. The error satisfies os.IsNotExist
+// if there is none.
+func (s *stateStore) Get(volumeName string) (*volumeState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	read, err := ioutil.ReadFile(path.Join(s.dir, volumeName))
+	if err != nil {
+		return nil, err
+	}
+	state := &volumeState{}
+	if err := json.Unmarshal(read, state); err != nil {
+		return nil, fmt.Errorf("error parsing state of volume %q: %v", volumeName, err)
+	}
+	return state, nil
+}
+
+// Put sets the state of the given volume.
+func (s *stateStore) Put(volumeName string, state *volumeState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return util.WriteFileAtomic(path.Join(s.dir, volumeName), data, 0600)
+}
+
+// Delete removes the state of the given volume, if any.
+func (s *stateStore) Delete(volumeName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.Remove(path.Join(s.dir, volumeName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// getStateKey returns the key of the given PV's entry in the stateStore, named
+// by its annotation or, for PVs provisioned without one, the PV's name.
+func getStateKey(volume *v1.PersistentVolume) (string, error) {
+	key, ok := volume.Annotations[annStateKey]
+	if !ok {
+		return volume.Name, nil
+	}
+	// The key names a file in the store, so it mustn't lead out of it
+	if errs := validation.IsDNS1123Subdomain(key); len(errs) != 0 {
+		return "", fmt.Errorf("invalid %s annotation %q on volume %q: %s", annStateKey, key, volume.Name, strings.Join(errs, ", "))
+	}
+	return key, nil
+}
+
+// getVolumeState returns the state of the given PV from the stateStore or, if
+// it was provisioned before there was one & hasn't been migrated, from its
+// annotations.
+func (p *nfsProvisioner) getVolumeState(volume *v1.PersistentVolume) (*volumeState, error) {
+	key, err := getStateKey(volume)
+	if err != nil {
+		return nil, err
+	}
+	state, err := p.state.Get(key)
+	if err == nil {
+		return state, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if _, ok := volume.Annotations[annExportBlock]; !ok {
+		return nil, fmt.Errorf("volume %q has neither a state entry nor a %s annotation", volume.Name, annExportBlock)
+	}
+	return getAnnotatedState(volume)
+}
+
+// getAnnotatedState returns the state stored in the given PV's annotations by
+// provisioners that didn't have a stateStore.
+func getAnnotatedState(volume *v1.PersistentVolume) (*volumeState, error) {
+	exportBlock, exportID, err := getBlockAndID(volume, annExportBlock, annExportID)
+	if err != nil {
+		return nil, err
+	}
+	projectBlock, projectID, err := getBlockAndID(volume, annProjectBlock, annProjectID)
+	if err != nil {
+		return nil, err
+	}
+	return &volumeState{
+		ExportBlock:  exportBlock,
+		ExportID:     exportID,
+		ProjectBlock: projectBlock,
+		ProjectID:    projectID,
+	}, nil
+}
+
+func getBlockAndID(volume *v1.PersistentVolume, annBlock, annID string) (string, uint16, error) {
+	block, ok := volume.Annotations[annBlock]
+	if !ok {
+		return "", 0, fmt.Errorf("PV doesn't have an annotation with key %s", annBlock)
+	}
+
+	idStr, ok := volume.Annotations[annID]
+	if !ok {
+		return "", 0, fmt.Errorf("PV doesn't have an annotation %s", annID)
+	}
+	id, _ := strconv.ParseUint(idStr, 10, 16)
+
+	return block, uint16(id), nil
+}
+
+// migrateAnnotations moves the state of this provisioner's PVs provisioned
+// before there was a stateStore from their annotations to the store, leaving
+// them with only a reference to their entry. PVs that fail to migrate keep
+// their annotations, which are used instead, and are retried on next startup.
+func (p *nfsProvisioner) migrateAnnotations() error {
+	volumes, err := p.client.Core().PersistentVolumes().List(v1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing PVs: %v", err)
+	}
+
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		if _, ok := volume.Annotations[annExportBlock]; !ok {
+			continue
+		}
+		if provisioned, err := p.provisioned(volume); err != nil || !provisioned {
+			continue
+		}
+
+		if p.dryRun {
+			glog.Infof("Would migrate state of volume %q from its annotations", volume.Name)
+			continue
+		}
+
+		// An entry may already exist if the PV failed to update last time, in
+		// which case it is the more up to date
+		if _, err := p.state.Get(volume.Name); os.IsNotExist(err) {
+			state, err := getAnnotatedState(volume)
+			if err != nil {
+				glog.Errorf("Error migrating state of volume %q: %v", volume.Name, err)
+				continue
+			}
+			if err := p.state.Put(volume.Name, state); err != nil {
+				glog.Errorf("Error migrating state of volume %q: %v", volume.Name, err)
+				continue
+			}
+		} else if err != nil {
+			glog.Errorf("Error migrating state of volume %q: %v", volume.Name, err)
+			continue
+		}
+
+		for _, ann := range []string{annExportBlock, annExportID, annProjectBlock, annProjectID} {
+			delete(volume.Annotations, ann)
+		}
+		volume.Annotations[annStateKey] = volume.Name
+		if _, err := p.client.Core().PersistentVolumes().Update(volume); err != nil {
+			glog.Errorf("Error removing migrated annotations from volume %q: %v", volume.Name, err)
+			continue
+		}
+		glog.Infof("Migrated state of volume %q from its annotations", volume.Name)
+	}
+
+	return nil
+}
@@ -19,33 +19,15 @@ package volume
 import (
 	"fmt"
 	"io/ioutil"
-	"math"
-	"os"
+	"os/exec"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
-)
-
-// generateID generates a unique exportID to assign an export
-func generateID(mutex *sync.Mutex, ids map[uint16]bool) uint16 {
-	mutex.Lock()
-	id := uint16(1)
-	for ; id <= math.MaxUint16; id++ {
-		if _, ok := ids[id]; !ok {
-			break
-		}
-	}
-	ids[id] = true
-	mutex.Unlock()
-	return id
-}
 
-func deleteID(mutex *sync.Mutex, ids map[uint16]bool, id uint16) {
-	mutex.Lock()
-	delete(ids, id)
-	mutex.Unlock()
-}
+	"github.com/kubernetes-incubator/external-storage/nfs/pkg/util"
+)
 
 // getExistingIDs populates a map with existing ids found in the given config
 // file using the given regexp. Regexp must have a "digits" submatch.
@@ -73,42 +55,128 @@ func getExistingIDs(config string, re *regexp.Regexp) (map[uint16]bool, error) {
 	return ids, nil
 }
 
-func addToFile(mutex *sync.Mutex, path string, toAdd string) error {
+// configBlock is a block of a config file, e.g. an export or a project, along
+// with the path and id it was added for.
+type configBlock struct {
+	block string
+	path  string
+	id    uint16
+}
+
+// getConfigBlocks finds the blocks in the given config file using the given
+// regexp. Regexp must have "id" and "path" named submatches.
+func getConfigBlocks(mutex *sync.Mutex, config string, re *regexp.Regexp) ([]configBlock, error) {
+	idIndex, pathIndex := -1, -1
+	for i, name := range re.SubexpNames() {
+		switch name {
+		case "id":
+			idIndex = i
+		case "path":
+			pathIndex = i
+		}
+	}
+	if idIndex == -1 || pathIndex == -1 {
+		return nil, fmt.Errorf("regexp %s doesn't contain id and path submatches", re.String())
+	}
+
 	mutex.Lock()
+	read, err := ioutil.ReadFile(config)
+	mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
 
-	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	blocks := []configBlock{}
+	for _, match := range re.FindAllSubmatch(read, -1) {
+		id, err := strconv.ParseUint(string(match[idIndex]), 10, 16)
+		if err != nil {
+			continue
+		}
+		blocks = append(blocks, configBlock{
+			block: string(match[0]),
+			path:  string(match[pathIndex]),
+			id:    uint16(id),
+		})
+	}
+
+	return blocks, nil
+}
+
+// copyContents copies the contents of the src directory into the existing dst
+// directory, preserving their ownership and modes but leaving dst's own as
+// they are. Blocks are shared via reflink if the filesystem supports it.
+func copyContents(src, dst string) error {
+	entries, err := ioutil.ReadDir(src)
 	if err != nil {
-		mutex.Unlock()
 		return err
 	}
-	defer file.Close()
+	if len(entries) == 0 {
+		return nil
+	}
 
-	if _, err = file.WriteString(toAdd); err != nil {
-		mutex.Unlock()
-		return err
+	args := []string{"-a", "--reflink=auto", "-t", dst}
+	for _, entry := range entries {
+		args = append(args, path.Join(src, entry.Name()))
+	}
+	cmd := exec.Command("cp", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cp failed with error: %v, output: %s", err, out)
 	}
-	file.Sync()
 
-	mutex.Unlock()
 	return nil
 }
 
-func removeFromFile(mutex *sync.Mutex, path string, toRemove string) error {
+func addToFile(mutex *sync.Mutex, path string, toAdd string) error {
 	mutex.Lock()
+	defer mutex.Unlock()
 
 	read, err := ioutil.ReadFile(path)
 	if err != nil {
-		mutex.Unlock()
 		return err
 	}
 
-	removed := strings.Replace(string(read), toRemove, "", -1)
-	err = ioutil.WriteFile(path, []byte(removed), 0)
+	return util.WriteFileAtomic(path, append(read, toAdd...), 0600)
+}
+
+// replaceInFile replaces toRemove in the file with toAdd. If the file already
+// contains toAdd instead, e.g. because the replacement is being retried, it
+// does nothing.
+func replaceInFile(mutex *sync.Mutex, path string, toRemove string, toAdd string) error {
+	// An empty string is contained in any file and would be replaced between
+	// every character
+	if toRemove == "" {
+		return fmt.Errorf("nothing to replace in file %s", path)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	read, err := ioutil.ReadFile(path)
 	if err != nil {
-		mutex.Unlock()
 		return err
 	}
 
-	mutex.Unlock()
-	return nil
+	if !strings.Contains(string(read), toRemove) {
+		if strings.Contains(string(read), toAdd) {
+			return nil
+		}
+		return fmt.Errorf("%q not found in file %s", toRemove, path)
+	}
+
+	replaced := strings.Replace(string(read), toRemove, toAdd, -1)
+	return util.WriteFileAtomic(path, []byte(replaced), 0600)
+}
+
+func removeFromFile(mutex *sync.Mutex, path string, toRemove string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	read, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	removed := strings.Replace(string(read), toRemove, "", -1)
+	return util.WriteFileAtomic(path, []byte(removed), 0600)
 }